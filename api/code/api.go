@@ -10,18 +10,20 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 import (
 	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/google/nftables/expr"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"golang.org/x/sys/unix"
 )
 
 var TEST_PREFIX = "."
@@ -38,18 +40,29 @@ type PluginConfig struct {
 	Name string
 	URI string
 	UnixPath string
+	//scopes the plugin may exercise, on its callback socket and on
+	//behalf of its callers
+	Capabilities []string
+}
+
+type WebAuthnConfig struct {
+	RPDisplayName string
+	RPID string
+	RPOrigin string
 }
 
 type APIConfig struct {
 	InfluxDB InfluxConfig
 	Plugins	[]PluginConfig
+	WebAuthn WebAuthnConfig
+	TLS TLSConfig
 }
 
 
 var config = APIConfig{}
 
 func loadConfig() {
-	data, err := ioutil.ReadFile(TEST_PREFIX + "/state/api/config")
+	data, err := ioutil.ReadFile(ConfigPath)
 	err = json.Unmarshal(data, &config)
 	if (err != nil) {
 		fmt.Println(err)
@@ -96,9 +109,26 @@ type Client struct {
 	Comment string
 }
 
+// ZonePort lets zone members reach the members of Zone on a single protocol and port
+type ZonePort struct {
+	Zone     string
+	Protocol string
+	Port     uint16
+}
+
+var zonePortProtocols = map[string]uint8{"tcp": unix.IPPROTO_TCP, "udp": unix.IPPROTO_UDP}
+
 type ClientZone struct {
 	Name    string
 	Clients []Client
+
+	//policy metadata, managed through /zones/{name}
+	Description  string     `json:",omitempty"`
+	AllowedZones []string   `json:",omitempty"`
+	AllowedPorts []ZonePort `json:",omitempty"`
+	WAN          bool       `json:",omitempty"`
+	DNS          bool       `json:",omitempty"`
+	LAN          bool       `json:",omitempty"`
 }
 
 func readZone(dir string, filename string) *ClientZone {
@@ -131,11 +161,18 @@ func readZone(dir string, filename string) *ClientZone {
 	return zone
 }
 
+type StatusDetail struct {
+	Status string
+	Influx InfluxHealth
+	TLS    TLSStatus
+}
+
 func getStatus(w http.ResponseWriter, r *http.Request) {
 	reply := "Online"
 	WSNotifyString("StatusCalled", "test")
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(reply)
+	//the CA fingerprint is always included, for clients to pin it
+	json.NewEncoder(w).Encode(StatusDetail{reply, getInfluxHealth(), getTLSStatus()})
 }
 
 var Zonesmtx sync.Mutex
@@ -154,6 +191,17 @@ type Device struct {
 	PskType string
 	Comment string
 	Zones   []string
+
+	//from the device inventory
+	FirstSeen time.Time `json:",omitempty"`
+	LastSeen  time.Time `json:",omitempty"`
+	LastIP    string    `json:",omitempty"`
+	Interface string    `json:",omitempty"`
+	Hostname  string    `json:",omitempty"`
+	Vendor    string    `json:",omitempty"`
+	Name      string    `json:",omitempty"`
+	Owner     string    `json:",omitempty"`
+	Tags      []string  `json:",omitempty"`
 }
 
 func getDevices(w http.ResponseWriter, r *http.Request) {
@@ -196,6 +244,8 @@ func getDevices(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	mergeInventory(devices)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(devices)
 }
@@ -280,6 +330,7 @@ func addZoneMember(w http.ResponseWriter, r *http.Request) {
 			for c_idx, entry := range zone.Clients {
 				if equalMAC(entry.Mac, client.Mac) {
 					if entry.Comment != client.Comment {
+						auditChange(r, entry, client)
 						zone.Clients[c_idx].Comment = client.Comment
 						zones[z_idx] = zone
 						saveZones(zones)
@@ -289,6 +340,7 @@ func addZoneMember(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			//add new entry to zone
+			auditChange(r, nil, client)
 			zone.Clients = append(zone.Clients, client)
 			zones[z_idx] = zone
 			saveZones(zones)
@@ -298,6 +350,13 @@ func addZoneMember(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	err = validateZoneName(name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	auditChange(r, nil, client)
 	zones = append(zones, ClientZone{Name: name, Clients: []Client{client}})
 	saveZones(zones)
 
@@ -323,6 +382,7 @@ func delZoneMember(w http.ResponseWriter, r *http.Request) {
 		if zone.Name == name {
 			for c_idx, entry := range zone.Clients {
 				if equalMAC(entry.Mac, client.Mac) {
+					auditChange(r, entry, nil)
 					zone.Clients = append(zone.Clients[:c_idx], zone.Clients[c_idx+1:]...)
 					zones[z_idx] = zone
 					saveZones(zones)
@@ -359,125 +419,124 @@ var (
 	default_zones = []string{"isolated", "lan", "wan", "dns"}
 )
 
+func isDefaultZone(name string) bool {
+	for _, y := range default_zones {
+		if y == name {
+			return true
+		}
+	}
+	return false
+}
+
 func getVerdictMapNames() []string {
 	//get custom maps from zones
 	custom_maps := []string{}
 	zones := getZonesJson()
 	for _, z := range zones {
-		skip := false
-		for _, y := range default_zones {
-			if y == z.Name {
-				skip = true
-				break
-			}
-		}
-		if skip == false {
+		if !isDefaultZone(z.Name) {
 			custom_maps = append(custom_maps, z.Name+"_mac_src_access")
 			custom_maps = append(custom_maps, z.Name+"_dst_access")
+			custom_maps = append(custom_maps, z.Name+"_port_dst_access")
+		}
+	}
+
+	names := append(append([]string{}, builtin_maps...), custom_maps...)
+
+	//each map has an ipv6 counterpart
+	names6 := []string{}
+	for _, name := range names {
+		names6 = append(names6, name+"6")
+	}
+	return append(names, names6...)
+}
+
+// getVerdictMapNames4 returns the maps holding ipv4 addresses
+func getVerdictMapNames4() []string {
+	names := []string{}
+	for _, name := range getVerdictMapNames() {
+		if !isIPv6Map(name) {
+			names = append(names, name)
 		}
 	}
-	return append(builtin_maps, custom_maps...)
+	return names
+}
+
+// getVerdictMapNames6 returns the maps holding ipv6 addresses
+func getVerdictMapNames6() []string {
+	names := []string{}
+	for _, name := range getVerdictMapNames() {
+		if isIPv6Map(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func isIPv6(IP string) bool {
+	ip := net.ParseIP(IP)
+	return ip != nil && ip.To4() == nil
 }
 
 type verdictEntry struct {
-	ipv4   string
+	ip     string
 	ifname string
 	mac    string
+	//only set in _port_dst_access maps
+	proto uint8
+	port  uint16
 }
 
-func getNFTVerdictMap(map_name string) []verdictEntry {
-	//google/nftables is incomplete and does not support custom set key types
-
-	existing := []verdictEntry{}
-
-	//nft -j list map inet filter name
-	cmd := exec.Command("nft", "-j", "list", "map", "inet", "filter", map_name)
-	stdout, err := cmd.Output()
+func getNFTVerdictMap(map_name string) ([]verdictEntry, error) {
+	batch, err := NewNFTBatch()
 	if err != nil {
-		fmt.Println("getNFTVerdictMap failed to list", map_name, err)
-		return existing
-	}
-
-	//jq .nftables[1].map.elem[][0].concat
-	var data map[string]interface{}
-	err = json.Unmarshal(stdout, &data)
-	data2, ok := data["nftables"].([]interface{})
-	if ok != true {
-		log.Fatal("invalid json")
-	}
-	data3, ok := data2[1].(map[string]interface{})
-	data4, ok := data3["map"].(map[string]interface{})
-	data5, ok := data4["elem"].([]interface{})
-	for _, d := range data5 {
-		e, ok := d.([]interface{})
-		f, ok := e[0].(map[string]interface{})
-		g, ok := f["concat"].([]interface{})
-		if ok {
-			first, _ := g[0].(string)
-			second, second_ok := g[1].(string)
-			if len(g) > 2 {
-				third, third_ok := g[2].(string)
-				if third_ok {
-					existing = append(existing, verdictEntry{first, second, third})
-				}
-			} else {
-				if second_ok {
-					if map_name == "dhcp_access" {
-						// type ifname . ether_addr : verdict (no IP)
-						existing = append(existing, verdictEntry{"", first, second})
-					} else {
-						// for _dst_access
-						// type ipv4_addr . ifname : verdict (no MAC)
-						existing = append(existing, verdictEntry{first, second, ""})
-					}
-				}
-			}
-		}
+		return nil, err
 	}
-	return existing
+	return batch.ListVerdictMap(map_name)
 }
 
-func getMapVerdict(name string) string {
+func getMapVerdict(name string) expr.VerdictKind {
 	//custom map filtering for destinations is split between two tables.
 	// the mac_src_access table is the second half, and _dst_access is the first half
 	// The first half uses a continue verdict to transfer into the second verdict map
 	if strings.Contains(name, "_dst_access") {
-		return "continue"
+		return expr.VerdictContinue
 	}
-	return "accept"
+	return expr.VerdictAccept
 }
 
-func flushVmaps(IP string, MAC string, Ifname string, vmap_names []string, matchInterface bool) {
+func flushVmaps(batch *NFTBatch, IP string, MAC string, Ifname string, vmap_names []string, matchInterface bool) error {
 	for _, name := range vmap_names {
-		entries := getNFTVerdictMap(name)
-		verdict := getMapVerdict(name)
+		entries, err := batch.ListVerdictMap(name)
+		if err != nil {
+			if errors.Is(err, ErrNFTMapNotFound) {
+				//custom zone maps are only created once a member joins
+				continue
+			}
+			return err
+		}
 		for _, entry := range entries {
-			if (entry.ipv4 == IP) || (matchInterface && (entry.ifname == Ifname)) || (equalMAC(entry.mac, MAC) && (MAC != "")) {
-				if entry.mac != "" {
-					err := exec.Command("nft", "delete", "element", "inet", "filter", name, "{", entry.ipv4, ".", entry.ifname, ".", entry.mac, ":", verdict, "}").Run()
-					if err != nil {
-						fmt.Println("nft delete failed", err)
-					}
-				} else {
-					err := exec.Command("nft", "delete", "element", "inet", "filter", name, "{", entry.ipv4, ".", entry.ifname, ":", verdict, "}").Run()
-					if err != nil {
-						fmt.Println("nft delete failed", err)
-						return
-					}
+			if (entry.ip == IP) || (matchInterface && (entry.ifname == Ifname)) || (equalMAC(entry.mac, MAC) && (MAC != "")) {
+				err = batch.DeleteElement(name, entry)
+				if err != nil {
+					return err
 				}
 			}
 		}
 	}
+	return nil
 }
 
 func searchVmapsByMac(MAC string, VMaps []string) (error, string, string) {
 	//Search verdict maps and return the ipv4 and interface name
 	for _, name := range VMaps {
-		entries := getNFTVerdictMap(name)
+		entries, err := getNFTVerdictMap(name)
+		if err != nil {
+			continue
+		}
 		for _, entry := range entries {
 			if equalMAC(entry.mac, MAC) {
-				if entry.ifname != "" && entry.ipv4 != "" {
-					return nil, entry.ipv4, entry.ifname
+				if entry.ifname != "" && entry.ip != "" {
+					return nil, entry.ip, entry.ifname
 				}
 			}
 		}
@@ -485,117 +544,274 @@ func searchVmapsByMac(MAC string, VMaps []string) (error, string, string) {
 	return errors.New("Mac not found"), "", ""
 }
 
-func updateArp(Ifname string, IP string, MAC string) {
+func updateArp(Ifname string, IP string, MAC string) error {
 	err := exec.Command("arp", "-i", Ifname, "-s", IP, MAC).Run()
 	if err != nil {
-		fmt.Println("arp -i", Ifname, IP, MAC, "failed", err)
-		return
+		return fmt.Errorf("arp -i %s -s %s %s failed: %v", Ifname, IP, MAC, err)
 	}
+	return nil
 }
 
-func updateAddr(Router string, Ifname string) {
-	err := exec.Command("ip", "addr", "add", Router+"/30", "dev", Ifname).Run()
+func deleteArp(Ifname string, IP string) error {
+	err := exec.Command("arp", "-i", Ifname, "-d", IP).Run()
 	if err != nil {
-		fmt.Println("update addr failed", Router, Ifname, err)
-		return
+		return fmt.Errorf("arp -i %s -d %s failed: %v", Ifname, IP, err)
 	}
+	return nil
 }
 
-func addVerdict(IP string, MAC string, Iface string, Table string) {
-	err := exec.Command("nft", "add", "element", "inet", "filter", Table, "{", IP, ".", Iface, ".", MAC, ":", "accept", "}").Run()
+// ipv6 clients are pinned in the neighbor table the same way
+func updateNeigh(Ifname string, IP string, MAC string) error {
+	err := exec.Command("ip", "-6", "neigh", "replace", IP, "lladdr", MAC, "dev", Ifname, "nud", "permanent").Run()
 	if err != nil {
-		fmt.Println("addVerdict Failed", MAC, Iface, Table, err)
-		return
+		return fmt.Errorf("ip -6 neigh replace %s lladdr %s dev %s failed: %v", IP, MAC, Ifname, err)
 	}
+	return nil
 }
 
-func addDNSVerdict(IP string, MAC string, Iface string) {
-	addVerdict(IP, MAC, Iface, "dns_access")
+func deleteNeigh(Ifname string, IP string) error {
+	err := exec.Command("ip", "-6", "neigh", "del", IP, "dev", Ifname).Run()
+	if err != nil {
+		return fmt.Errorf("ip -6 neigh del %s dev %s failed: %v", IP, Ifname, err)
+	}
+	return nil
 }
 
-func addLANVerdict(IP string, MAC string, Iface string) {
-	addVerdict(IP, MAC, Iface, "lan_access")
+// flushConntrack drops the tracked connections from and to an address. The
+// FORWARD chain accepts established flows before the verdict maps, so access
+// that was taken away only applies to open connections after a flush
+func flushConntrack(IP string) error {
+	family := "ipv4"
+	if strings.Contains(IP, ":") {
+		family = "ipv6"
+	}
+	for _, direction := range []string{"-s", "-d"} {
+		err := exec.Command("conntrack", "-D", "-f", family, direction, IP).Run()
+		//conntrack exits with 1 when no connection matched
+		var exitErr *exec.ExitError
+		if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+			return fmt.Errorf("conntrack -D -f %s %s %s failed: %v", family, direction, IP, err)
+		}
+	}
+	return nil
 }
 
-func addInternetVerdict(IP string, MAC string, Iface string) {
-	addVerdict(IP, MAC, Iface, "internet_access")
+func hasAddr(Router string, Ifname string) bool {
+	iface, err := net.InterfaceByName(Ifname)
+	if err != nil {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err == nil && ip.String() == Router {
+			return true
+		}
+	}
+	return false
 }
 
-func addCustomVerdict(ZoneName string, IP string, MAC string, Iface string) {
-	//create verdict maps if they do not exist
-	err := exec.Command("nft", "list", "map", "inet", "filter", ZoneName+"_dst_access").Run()
+func updateAddr(Router string, Ifname string) error {
+	err := exec.Command("ip", "addr", "add", Router+"/30", "dev", Ifname).Run()
 	if err != nil {
-		//two verdict maps are used for establishing custom groups.
-		// the {name}_dst_access map allows Inet packets to a certain IP/interface pair
-		//the {name}_mac_src_access part allows Inet packets from a IP/IFace/MAC set
+		return fmt.Errorf("update addr failed %s %s: %v", Router, Ifname, err)
+	}
+	return nil
+}
 
-		err = exec.Command("nft", "add", "map", "inet", "filter", ZoneName+"_mac_src_access", "{", "type", "ipv4_addr", ".", "ifname", ".", "ether_addr", ":", "verdict", ";", "}").Run()
-		if err != nil {
-			fmt.Println("addCustomVerdict Failed", err)
-			return
-		}
-		err = exec.Command("nft", "add", "map", "inet", "filter", ZoneName+"_dst_access", "{", "type", "ipv4_addr", ".", "ifname", ":", "verdict", ";", "}").Run()
-		if err != nil {
-			fmt.Println("addCustomVerdict Failed", err)
-			return
+func deleteAddr(Router string, Ifname string) error {
+	err := exec.Command("ip", "addr", "del", Router+"/30", "dev", Ifname).Run()
+	if err != nil {
+		return fmt.Errorf("delete addr failed %s %s: %v", Router, Ifname, err)
+	}
+	return nil
+}
+
+func zoneVerdictMaps(zone ClientZone) []string {
+	switch zone.Name {
+	case "isolated":
+		return []string{}
+	case "dns":
+		return []string{"dns_access"}
+	case "lan":
+		return []string{"lan_access"}
+	case "wan":
+		return []string{"internet_access"}
+	}
+
+	//custom group
+	maps := []string{zone.Name + "_dst_access", zone.Name + "_mac_src_access"}
+
+	//the zone policy may grant the builtin access as well
+	if zone.WAN {
+		maps = append(maps, "internet_access")
+	}
+	if zone.DNS {
+		maps = append(maps, "dns_access")
+	}
+	if zone.LAN {
+		maps = append(maps, "lan_access")
+	}
+	return maps
+}
+
+func isZoneClient(zone ClientZone, MAC string) bool {
+	for _, client := range zone.Clients {
+		if equalMAC(client.Mac, MAC) {
+			return true
 		}
-		err = exec.Command("nft", "insert", "rule", "inet", "filter", "FORWARD", "ip", "daddr", ".", "oifname", "vmap", "@"+ZoneName+"_dst_access", "ip", "saddr", ".", "iifname", ".", "ether", "saddr", "vmap", "@"+ZoneName+"_mac_src_access").Run()
-		if err != nil {
-			fmt.Println("addCustomVerdict Failed", err)
-			return
+	}
+	return false
+}
+
+func customZoneOfMap(name string) string {
+	name = ipv4MapName(name)
+	for _, suffix := range []string{"_port_dst_access", "_dst_access", "_mac_src_access"} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
 		}
 	}
+	return ""
+}
 
-	err = exec.Command("nft", "add", "element", "inet", "filter", ZoneName+"_dst_access", "{", IP, ".", Iface, ":", "continue", "}").Run()
-	if err != nil {
-		fmt.Println("addCustomVerdict Failed", err)
-		return
+// getVmapElements returns the verdict map elements a client should have based on its zones
+func getVmapElements(zones []ClientZone, IP string, MAC string, Iface string) []nftElement {
+	elements := []nftElement{}
+	seen := map[nftElement]bool{}
+
+	add := func(name string, proto uint8, port uint16) {
+		element := verdictEntry{IP, Iface, trimLower(MAC), proto, port}
+		if strings.HasSuffix(name, "_dst_access") {
+			// type ipv4_addr . ifname : verdict (no MAC)
+			// or ipv4_addr . ifname . inet_proto . inet_service : verdict
+			element.mac = ""
+		}
+		if isIPv6(IP) {
+			name += "6"
+		}
+		e := nftElement{name, element, getMapVerdict(name)}
+		if !seen[e] {
+			seen[e] = true
+			elements = append(elements, e)
+		}
 	}
 
-	err = exec.Command("nft", "add", "element", "inet", "filter", ZoneName+"_mac_src_access", "{", IP, ".", Iface, ".", MAC, ":", "accept", "}").Run()
-	if err != nil {
-		fmt.Println("addCustomVerdict Failed", err)
-		return
+	zonesByName := map[string]ClientZone{}
+	for _, zone := range zones {
+		zonesByName[zone.Name] = zone
 	}
-}
 
-func populateVmapEntries(IP string, MAC string, Iface string) {
-	zones := getZonesJson()
 	for _, zone := range zones {
-		if zone.Name == "isolated" {
-			continue
+		if isZoneClient(zone, MAC) {
+			for _, name := range zoneVerdictMaps(zone) {
+				add(name, 0, 0)
+			}
 		}
-		for _, entry := range zone.Clients {
-			if equalMAC(entry.Mac, MAC) {
-				//client belongs to verdict map, add it
-				switch zone.Name {
-				case "dns":
-					addDNSVerdict(IP, MAC, Iface)
-				case "lan":
-					addLANVerdict(IP, MAC, Iface)
-				case "wan":
-					addInternetVerdict(IP, MAC, Iface)
-				default:
-					//custom group
-					addCustomVerdict(zone.Name, IP, MAC, Iface)
+
+		//members of allowed zones are reachable destinations of this zone
+		if !isDefaultZone(zone.Name) {
+			for _, allowed := range zone.AllowedZones {
+				if isZoneClient(zonesByName[allowed], MAC) {
+					add(zone.Name+"_dst_access", 0, 0)
+				}
+			}
+
+			//and on the listed protocol and port for port rules
+			for _, port := range zone.AllowedPorts {
+				if isZoneClient(zonesByName[port.Zone], MAC) {
+					add(zone.Name+"_port_dst_access", zonePortProtocols[port.Protocol], port.Port)
 				}
 			}
 		}
 	}
 
+	//devices over their quota lose internet access until the period ends
+	if isQuotaBlocked(MAC) {
+		allowed := []nftElement{}
+		for _, element := range elements {
+			if ipv4MapName(element.Map) != "internet_access" {
+				allowed = append(allowed, element)
+			}
+		}
+		elements = allowed
+	}
+	return elements
+}
+
+// populateVmapEntries adds the entries of a client for its ipv4 address and
+// refreshes the ones of the ipv6 addresses it was bound to by dhcpUpdate6.
+// The ipv6 maps are flushed by address, so that the entries of other clients
+// on the interface are kept
+func populateVmapEntries(batch *NFTBatch, IP string, MAC string, Iface string) error {
+	if IP != "" {
+		err := addVmapEntries(batch, IP, MAC, Iface)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, addr := range getBindingIPv6(MAC) {
+		err := flushVmaps(batch, addr, "", Iface, getVerdictMapNames6(), false)
+		if err != nil {
+			return err
+		}
+		err = addVmapEntries(batch, addr, MAC, Iface)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addVmapEntries(batch *NFTBatch, IP string, MAC string, Iface string) error {
+	for _, element := range getVmapElements(getActiveZones(), IP, MAC, Iface) {
+		zoneName := customZoneOfMap(element.Map)
+		if zoneName != "" {
+			//create verdict maps if they do not exist
+			err := batch.EnsureZoneMaps(zoneName)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := batch.AddElement(element.Map, element.Entry, element.Verdict)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 var LocalMappingsmtx sync.Mutex
+var LocalMappingsPath = TEST_PREFIX + "/state/dns/local_mappings"
 
-func updateLocalMappings(IP string, Name string) {
+func readLocalMappings() ([]byte, error) {
+	LocalMappingsmtx.Lock()
+	defer LocalMappingsmtx.Unlock()
+	return ioutil.ReadFile(LocalMappingsPath)
+}
+
+func writeLocalMappings(data []byte) error {
+	LocalMappingsmtx.Lock()
+	defer LocalMappingsmtx.Unlock()
+	return ioutil.WriteFile(LocalMappingsPath, data, 0644)
+}
 
-  LocalMappingsmtx.Lock()
-  defer LocalMappingsmtx.Unlock()
+func updateLocalMappings(IP string, Name string) error {
 
-	var localMappingsPath = TEST_PREFIX + "/state/dns/local_mappings"
-	data, err := ioutil.ReadFile(localMappingsPath)
+	LocalMappingsmtx.Lock()
+	defer LocalMappingsmtx.Unlock()
+
+	data, err := ioutil.ReadFile(LocalMappingsPath)
 	if err != nil {
-		return
+		if os.IsNotExist(err) {
+			//dns has not created the mappings file
+			return nil
+		}
+		return err
 	}
 	entryName := Name + ".lan"
 	new_data := ""
@@ -606,13 +822,14 @@ func updateLocalMappings(IP string, Name string) {
 		}
 		ip := pieces[0]
 		hostname := pieces[1]
-		if ip == IP || entryName == hostname {
+		//a name keeps one address of each family
+		if ip == IP || (entryName == hostname && isIPv6(ip) == isIPv6(IP)) {
 			continue
 		}
 		new_data += ip + " " + hostname + "\n"
 	}
 	new_data += IP + " " + entryName + "\n"
-	ioutil.WriteFile(localMappingsPath, []byte(new_data), 0644)
+	return ioutil.WriteFile(LocalMappingsPath, []byte(new_data), 0644)
 }
 
 var DHCPmtx sync.Mutex
@@ -626,37 +843,6 @@ func shouldFlushByInterface(Iface string) bool {
 	return matchInterface
 }
 
-func dhcpUpdate(w http.ResponseWriter, r *http.Request) {
-	DHCPmtx.Lock()
-	defer DHCPmtx.Unlock()
-
-	//Handle networking tasks upon a DHCP
-	dhcp := DHCPUpdate{}
-	err := json.NewDecoder(r.Body).Decode(&dhcp)
-	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
-	}
-
-	WSNotifyValue("DHCPUpdateRequest", dhcp)
-
-	//1. delete this ip, mac from any existing verdict maps
-	flushVmaps(dhcp.IP, dhcp.MAC, dhcp.Iface, getVerdictMapNames(), shouldFlushByInterface(dhcp.Iface))
-
-	//2. update static arp entry
-	updateAddr(dhcp.Router, dhcp.Iface)
-
-	updateArp(dhcp.Iface, dhcp.IP, dhcp.MAC)
-
-	//3. add entry to appropriate verdict maps
-	populateVmapEntries(dhcp.IP, dhcp.MAC, dhcp.Iface)
-
-	//4. update local mappings file for DNS
-	updateLocalMappings(dhcp.IP, dhcp.Name)
-
-	WSNotifyString("DHCPUpdateProcessed", "")
-}
-
 func refreshClientZones(MAC string) {
 	ifname := ""
 	ipv4 := ""
@@ -669,8 +855,18 @@ func refreshClientZones(MAC string) {
 
 	ipv4 = arp_entry.IP
 
+	batch, err := NewNFTBatch()
+	if err != nil {
+		fmt.Println("refreshClientZones failed", MAC, err)
+		return
+	}
+
 	//check dhcp vmap for the interface
-	entries := getNFTVerdictMap("dhcp_access")
+	entries, err := batch.ListVerdictMap("dhcp_access")
+	if err != nil {
+		fmt.Println("refreshClientZones failed", MAC, err)
+		return
+	}
 	for _, entry := range entries {
 		if equalMAC(entry.mac, MAC) {
 			ifname = entry.ifname
@@ -683,10 +879,17 @@ func refreshClientZones(MAC string) {
 	}
 
 	//remove from existing verdict maps
-	flushVmaps(ipv4, MAC, ifname, getVerdictMapNames(), shouldFlushByInterface(ifname))
-
-	//and re-add
-	populateVmapEntries(ipv4, MAC, ifname)
+	err = flushVmaps(batch, ipv4, MAC, ifname, getVerdictMapNames4(), shouldFlushByInterface(ifname))
+	if err == nil {
+		//and re-add
+		err = populateVmapEntries(batch, ipv4, MAC, ifname)
+	}
+	if err == nil {
+		err = batch.Commit()
+	}
+	if err != nil {
+		fmt.Println("refreshClientZones failed", MAC, err)
+	}
 }
 
 // from https://github.com/ItsJimi/go-arp/blob/master/arp.go
@@ -794,6 +997,9 @@ func reportPSKAuthFailure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	metricPSKAuthFailures.WithLabelValues(pskf.Type, pskf.Reason).Inc()
+	defer auditChange(r, nil, &pskf)
+
 	psks := getPSKJson()
 	pendingPSK, exists := psks["pending"]
 	if pskf.Reason == "noentry" && exists {
@@ -848,6 +1054,7 @@ func reportPSKAuthSuccess(w http.ResponseWriter, r *http.Request) {
 	}
 
 	pska.Status = "Okay"
+	defer auditChange(r, nil, &pska)
 
 	//check if there is a pending psk to assign. if the mac is not known, then it was the pending psk
 
@@ -970,6 +1177,9 @@ func setPSK(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodDelete {
 		//delete by MAC
+		if previous, exists := psks[psk.Mac]; exists {
+			auditChange(r, redactPSK(previous), nil)
+		}
 		delete(psks, psk.Mac)
 		savePSKs(psks)
 		doReloadPSKFiles()
@@ -995,12 +1205,17 @@ func setPSK(w http.ResponseWriter, r *http.Request) {
 		pskGenerated = true
 	}
 
-	if psk.Mac == "" {
+	key := psk.Mac
+	if key == "" {
 		//assign a pending PSK for later
-		psks["pending"] = psk
+		key = "pending"
+	}
+	if previous, exists := psks[key]; exists {
+		auditChange(r, redactPSK(previous), redactPSK(psk))
 	} else {
-		psks[psk.Mac] = psk
+		auditChange(r, nil, redactPSK(psk))
 	}
+	psks[key] = psk
 
 	savePSKs(psks)
 	doReloadPSKFiles()
@@ -1014,6 +1229,14 @@ func setPSK(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// redactPSK hides the key of an entry for the audit log
+func redactPSK(psk PSKEntry) PSKEntry {
+	if psk.Psk != "" {
+		psk.Psk = "***"
+	}
+	return psk
+}
+
 func reloadPSKFiles(w http.ResponseWriter, r *http.Request) {
 	PSKmtx.Lock()
 	defer PSKmtx.Unlock()
@@ -1184,50 +1407,40 @@ func logRequest(handler http.Handler) http.Handler {
 }
 
 
-func PluginProxy(config PluginConfig) (*httputil.ReverseProxy, error) {
-	return &httputil.ReverseProxy{
-				Director: func(req *http.Request) {
-					req.URL.Scheme = "http"
-					req.URL.Host = config.Name
-
-					//Empty headers from the request
-					//SECURITY benefit: API extensions do not receive credentials
-					req.Header = http.Header{}
-				},
-				Transport: &http.Transport {
-							Dial: func(network, addr string) (net.Conn, error) {
-								return net.Dial("unix", config.UnixPath)
-							},
-				},
-	}, nil
-}
-
-func ProxyRequestHandler(proxy *httputil.ReverseProxy) func(http.ResponseWriter, *http.Request) {
-  return func(w http.ResponseWriter, r *http.Request) {
-		rest := mux.Vars(r)["rest"]
-		if rest != "" {
-			r.URL.Path = "/" + rest
-		}
-    proxy.ServeHTTP(w, r)
-  }
-}
-
-
 func main() {
 
 	loadConfig()
+	migrateZoneNames()
+
+	initUsers()
+	initTokens()
+	initAudit()
+	initPluginIdentity()
+	initPlugins()
+	initQuotas()
+	initMetrics()
+
+	rp := config.WebAuthn
+	if rp.RPID == "" {
+		rp.RPID = "localhost"
+	}
+	if rp.RPOrigin == "" {
+		rp.RPOrigin = "http://" + rp.RPID // The origin URL for WebAuthn requests
+	}
+	if rp.RPDisplayName == "" {
+		rp.RPDisplayName = "SPR"
+	}
 
-	auth := new(authnconfig)
 	w, err := webauthn.New(&webauthn.Config{
-		RPDisplayName: "SPR",
-		RPID:          "localhost",
-		RPOrigin:      "http://localhost", // The origin URL for WebAuthn requests
+		RPDisplayName: rp.RPDisplayName,
+		RPID:          rp.RPID,
+		RPOrigin:      rp.RPOrigin,
 	})
 
 	if err != nil {
 		log.Fatal("failed to create WebAuthn from config:", err)
 	}
-	auth.webAuthn = w
+	auth := newAuthnConfig(w)
 
 	unix_dhcpd_router := mux.NewRouter().StrictSlash(true)
 	unix_wifid_router := mux.NewRouter().StrictSlash(true)
@@ -1236,10 +1449,16 @@ func main() {
 
 	external_router_public.Use(setSecurityHeaders)
 	external_router_authenticated.Use(setSecurityHeaders)
+	external_router_authenticated.Use(auditMiddleware)
+	unix_dhcpd_router.Use(auditInternal("dhcpd"))
+	unix_wifid_router.Use(auditInternal("wifid"))
 
 	//public websocket with internal authentication
 	external_router_public.HandleFunc("/ws", auth.webSocket).Methods("GET")
 
+	//local CA of the https listener
+	external_router_public.HandleFunc("/tls/ca.crt", getTLSCA).Methods("GET")
+
 	spa := spaHandler{staticPath: "/ui", indexPath: "index.html"}
 	external_router_public.PathPrefix("/").Handler(spa)
 
@@ -1256,12 +1475,27 @@ func main() {
 
 	//Misc
 	external_router_authenticated.HandleFunc("/status", getStatus).Methods("GET", "OPTIONS")
+	external_router_authenticated.HandleFunc("/reconcile/status", getReconcileStatus).Methods("GET")
+	external_router_authenticated.Handle("/metrics", metricsHandler).Methods("GET")
 
 	// Zone management
 	external_router_authenticated.HandleFunc("/zones", getZones).Methods("GET")
 	external_router_authenticated.HandleFunc("/zone/{name}", addZoneMember).Methods("PUT")
 	external_router_authenticated.HandleFunc("/zone/{name}", delZoneMember).Methods("DELETE")
+	external_router_authenticated.HandleFunc("/zones/{name}", getZone).Methods("GET")
+	external_router_authenticated.HandleFunc("/zones/{name}", putZone).Methods("PUT")
+	external_router_authenticated.HandleFunc("/zones/{name}", deleteZone).Methods("DELETE")
+	external_router_authenticated.HandleFunc("/zones/{name}/rename", renameZone).Methods("PUT")
+	external_router_authenticated.HandleFunc("/zones/{name}/ports", getZonePorts).Methods("GET")
+	external_router_authenticated.HandleFunc("/zones/{name}/ports", modifyZonePort).Methods("PUT", "DELETE")
+	external_router_authenticated.HandleFunc("/schedules", getSchedules).Methods("GET")
+	external_router_authenticated.HandleFunc("/schedules/{name}", putSchedule).Methods("PUT")
+	external_router_authenticated.HandleFunc("/schedules/{name}", deleteSchedule).Methods("DELETE")
+	external_router_authenticated.HandleFunc("/quotas", getQuotas).Methods("GET")
+	external_router_authenticated.HandleFunc("/quotas/{mac}", modifyQuota).Methods("PUT", "DELETE")
 	external_router_authenticated.HandleFunc("/devices", getDevices).Methods("GET")
+	external_router_authenticated.HandleFunc("/devices/{mac}", getDevice).Methods("GET")
+	external_router_authenticated.HandleFunc("/devices/{mac}", modifyDevice).Methods("PUT", "DELETE")
 	external_router_authenticated.HandleFunc("/pendingPSK", pendingPSK).Methods("GET")
 
 	//Assign a PSK
@@ -1276,12 +1510,39 @@ func main() {
 	//ip information
 	external_router_authenticated.HandleFunc("/ip/addr", ipAddr).Methods("GET")
 
+	//user accounts
+	external_router_authenticated.HandleFunc("/users", getUsers).Methods("GET")
+	external_router_authenticated.HandleFunc("/users/{name}", putUser).Methods("PUT")
+	external_router_authenticated.HandleFunc("/users/{name}", deleteUser).Methods("DELETE")
+	external_router_authenticated.HandleFunc("/users/{name}/password", putUserPassword).Methods("PUT")
+
+	//login lockouts
+	external_router_authenticated.HandleFunc("/lockouts", getLockouts).Methods("GET")
+	external_router_authenticated.HandleFunc("/lockouts", deleteLockouts).Methods("DELETE")
+	external_router_authenticated.HandleFunc("/lockouts/{kind}/{name}", deleteLockouts).Methods("DELETE")
+
+	//audit log
+	external_router_authenticated.HandleFunc("/audit", getAudit).Methods("GET")
+	external_router_authenticated.HandleFunc("/audit/verify", getAuditVerification).Methods("GET")
+
+	//api tokens
+	external_router_authenticated.HandleFunc("/tokens", getAPITokens).Methods("GET")
+	external_router_authenticated.HandleFunc("/tokens", mintAPIToken).Methods("PUT")
+	external_router_authenticated.HandleFunc("/tokens/{id}", modifyAPIToken).Methods("PUT", "DELETE")
+
+	//plugins
+	external_router_authenticated.HandleFunc("/plugins", getPlugins).Methods("GET")
+	external_router_authenticated.HandleFunc("/plugins", modifyPlugins).Methods("PUT", "DELETE")
+	external_router_authenticated.HandleFunc("/plugins/{uri}/", ProxyRequestHandler)
+	external_router_authenticated.HandleFunc("/plugins/{uri}/{rest:.*}", ProxyRequestHandler)
+
 	// PSK management for stations
 	unix_wifid_router.HandleFunc("/reportPSKAuthFailure", reportPSKAuthFailure).Methods("PUT")
 	unix_wifid_router.HandleFunc("/reportPSKAuthSuccess", reportPSKAuthSuccess).Methods("PUT")
 
 	// DHCP actions
 	unix_dhcpd_router.HandleFunc("/dhcpUpdate", dhcpUpdate).Methods("PUT")
+	unix_dhcpd_router.HandleFunc("/dhcpUpdate6", dhcpUpdate6).Methods("PUT")
 
 	os.Remove(UNIX_WIFID_LISTENER)
 	unixWifidListener, err := net.Listen("unix", UNIX_WIFID_LISTENER)
@@ -1295,16 +1556,6 @@ func main() {
 		panic(err)
 	}
 
-	//Set up Plugin Proxies
-	for _, entry := range config.Plugins {
-		proxy, err := PluginProxy(entry)
-		if err != nil {
-			panic(err)
-		}
-		external_router_authenticated.HandleFunc("/plugins/" + entry.URI + "/", ProxyRequestHandler(proxy) );
-		external_router_authenticated.HandleFunc("/plugins/" + entry.URI + "/" + "{rest:.*}", ProxyRequestHandler(proxy) );
-	}
-
 	wifidServer := http.Server{Handler: logRequest(unix_wifid_router)}
 	dhcpdServer := http.Server{Handler: logRequest(unix_dhcpd_router)}
 
@@ -1316,8 +1567,17 @@ func main() {
 	WSRunNotify()
 	// collect traffic accounting statistics
 	trafficTimer()
-
-	go http.ListenAndServe("0.0.0.0:80", logRequest(handlers.CORS(originsOk, headersOk, methodsOk)(auth.Authenticate(external_router_authenticated, external_router_public))))
+	// repair drift between zones and the verdict maps
+	reconcileTimer()
+	// restore verdict maps on startup and after the ruleset is recreated
+	restoreTimer()
+	scheduleTimer()
+	// probe plugin sockets
+	pluginTimer()
+
+	handler := logRequest(handlers.CORS(originsOk, headersOk, methodsOk)(auth.Authenticate(external_router_authenticated, external_router_public)))
+	//https, with plain http redirected to it when configured
+	go http.ListenAndServe("0.0.0.0:80", serveTLS(config.TLS, handler))
 
 	go wifidServer.Serve(unixWifidListener)
 
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// The audit log records every mutating api call as a line of json. Each
+// entry carries the hash of the previous entry, so that editing or removing
+// a line breaks the chain from that entry on. The hashes are keyed with a
+// secret kept outside of the log, and the last entry is recorded in an
+// anchor file so that cutting entries off the end is noticed as well.
+
+type AuditEntry struct {
+	Seq    uint64
+	Time   time.Time
+	Actor  string
+	Source string
+	Action string
+	Path   string
+	Before json.RawMessage `json:",omitempty"`
+	After  json.RawMessage `json:",omitempty"`
+	Status int
+	Result string
+	//hash of the previous entry, and of this entry with an empty Hash
+	PrevHash string
+	Hash     string
+}
+
+type AuditPage struct {
+	Total   int
+	Entries []AuditEntry
+}
+
+type AuditVerification struct {
+	Valid   bool
+	Entries int
+	//sequence number of the first entry that does not match its hash
+	FirstInvalid uint64 `json:",omitempty"`
+	Reason       string `json:",omitempty"`
+}
+
+// AuditAnchor is the position of an entry in the chain
+type AuditAnchor struct {
+	Seq  uint64
+	Hash string
+}
+
+var Auditmtx sync.Mutex
+var AuditLogPath = TEST_PREFIX + "/state/api/audit.log"
+var AuditKeyPath = TEST_PREFIX + "/state/api/audit.key"
+var AuditAnchorPath = TEST_PREFIX + "/state/api/audit.anchor"
+
+// the log is rotated to AuditLogPath.1 past this size
+var AuditLogMaxSize int64 = 16 * 1024 * 1024
+
+var AuditPageLimit = 1000
+
+// last entry written and the chain key, guarded by Auditmtx
+var gAuditSeq uint64
+var gAuditHash string
+var gAuditKey []byte
+
+type auditContextKey int
+
+const (
+	auditActorKey auditContextKey = iota
+	auditRecordKey
+)
+
+// details a handler adds to the entry of its request
+type auditRecord struct {
+	before interface{}
+	after  interface{}
+}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	result string
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	//keep the start of error replies as the result
+	if w.status >= 400 && len(w.result) < 256 {
+		w.result += string(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// withAuditActor attaches the authenticated actor to a request
+func withAuditActor(r *http.Request, actor string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), auditActorKey, actor))
+}
+
+func auditActor(r *http.Request) string {
+	actor, ok := r.Context().Value(auditActorKey).(string)
+	if !ok {
+		return "unknown"
+	}
+	return actor
+}
+
+// auditChange records the state a request changed from and to
+func auditChange(r *http.Request, before interface{}, after interface{}) {
+	record, ok := r.Context().Value(auditRecordKey).(*auditRecord)
+	if ok {
+		record.before = before
+		record.after = after
+	}
+}
+
+func auditSource(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+			return "unix"
+		}
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func auditValue(value interface{}) json.RawMessage {
+	if value == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func hashAuditEntry(key []byte, entry AuditEntry) string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadAuditKey returns the chain key, created along with a new log
+func loadAuditKey() ([]byte, error) {
+	data, err := ioutil.ReadFile(AuditKeyPath)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) < 32 {
+			return nil, fmt.Errorf("invalid audit key in %s", AuditKeyPath)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	//a new key would start a new chain that verification can not tell apart
+	// from a rewritten log
+	for _, path := range []string{AuditLogPath, AuditLogPath + ".1", AuditAnchorPath} {
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("%s is missing but %s exists, move the audit log aside to start a new chain", AuditKeyPath, path)
+		}
+	}
+
+	key := make([]byte, 32)
+	_, err = crand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(AuditKeyPath, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	return key, err
+}
+
+func loadAuditAnchor() AuditAnchor {
+	anchor := AuditAnchor{}
+	data, err := ioutil.ReadFile(AuditAnchorPath)
+	if err != nil {
+		return anchor
+	}
+	err = json.Unmarshal(data, &anchor)
+	if err != nil {
+		fmt.Println("failed to load audit anchor", err)
+	}
+	return anchor
+}
+
+func saveAuditAnchor(anchor AuditAnchor) error {
+	file, _ := json.MarshalIndent(anchor, "", " ")
+	return ioutil.WriteFile(AuditAnchorPath, file, 0600)
+}
+
+// auditLogTail returns the last entry of a log
+func auditLogTail(path string) (AuditAnchor, error) {
+	entries, err := readAuditLog(path)
+	if err != nil || len(entries) == 0 {
+		return AuditAnchor{}, err
+	}
+	last := entries[len(entries)-1]
+	return AuditAnchor{last.Seq, last.Hash}, nil
+}
+
+func readAuditLog(path string) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return entries, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		entry := AuditEntry{}
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func initAudit() {
+	Auditmtx.Lock()
+	defer Auditmtx.Unlock()
+
+	key, err := loadAuditKey()
+	if err != nil {
+		log.Fatal("failed to load audit key: ", err)
+	}
+	gAuditKey = key
+
+	tail, err := auditLogTail(AuditLogPath)
+	if err == nil && tail.Seq == 0 {
+		//the chain continues from the rotated log
+		tail, err = auditLogTail(AuditLogPath + ".1")
+	}
+	if err != nil {
+		fmt.Println("failed to read audit log", err)
+	}
+
+	anchor := loadAuditAnchor()
+	if anchor != (AuditAnchor{}) && anchor != tail {
+		fmt.Println("audit log does not end at its anchor", anchor.Seq, "found", tail.Seq)
+	}
+	//a log that lost entries continues after the anchor, which leaves a gap
+	// that verification reports
+	if anchor.Seq > tail.Seq {
+		tail = anchor
+	}
+	gAuditSeq = tail.Seq
+	gAuditHash = tail.Hash
+}
+
+func rotateAuditLog() {
+	info, err := os.Stat(AuditLogPath)
+	if err == nil && info.Size() > AuditLogMaxSize {
+		os.Rename(AuditLogPath, AuditLogPath+".1")
+	}
+}
+
+func appendAudit(entry AuditEntry) error {
+	Auditmtx.Lock()
+	defer Auditmtx.Unlock()
+
+	rotateAuditLog()
+
+	entry.Seq = gAuditSeq + 1
+	entry.PrevHash = gAuditHash
+	entry.Hash = hashAuditEntry(gAuditKey, entry)
+
+	data, _ := json.Marshal(entry)
+	file, err := os.OpenFile(AuditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	gAuditSeq = entry.Seq
+	gAuditHash = entry.Hash
+	return saveAuditAnchor(AuditAnchor{entry.Seq, entry.Hash})
+}
+
+// auditMiddleware appends an entry for every request that is not a read
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		record := &auditRecord{}
+		recorder := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditRecordKey, record)))
+
+		action := r.URL.Path
+		route := mux.CurrentRoute(r)
+		if route != nil {
+			template, err := route.GetPathTemplate()
+			if err == nil {
+				action = template
+			}
+		}
+
+		result := "ok"
+		if recorder.status >= 400 {
+			result = strings.TrimSpace(recorder.result)
+		}
+
+		entry := AuditEntry{
+			Time:   time.Now().UTC(),
+			Actor:  auditActor(r),
+			Source: auditSource(r),
+			Action: r.Method + " " + action,
+			Path:   r.URL.Path,
+			Before: auditValue(record.before),
+			After:  auditValue(record.after),
+			Status: recorder.status,
+			Result: result,
+		}
+
+		err := appendAudit(entry)
+		if err != nil {
+			fmt.Println("failed to write audit log", err)
+			return
+		}
+		WSNotifyValue("AuditEntry", entry)
+	})
+}
+
+// auditInternal audits the requests of a unix socket as the given service
+func auditInternal(actor string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		audited := auditMiddleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			audited.ServeHTTP(w, withAuditActor(r, actor))
+		})
+	}
+}
+
+func matchAuditEntry(entry AuditEntry, query map[string]string) bool {
+	if query["actor"] != "" && entry.Actor != query["actor"] {
+		return false
+	}
+	if query["action"] != "" && !strings.Contains(entry.Action, query["action"]) {
+		return false
+	}
+	if query["path"] != "" && !strings.Contains(entry.Path, query["path"]) {
+		return false
+	}
+	if query["failed"] == "true" && entry.Status < 400 {
+		return false
+	}
+	return true
+}
+
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	vals := r.URL.Query()
+
+	query := map[string]string{}
+	for _, key := range []string{"actor", "action", "path", "failed"} {
+		query[key] = vals.Get(key)
+	}
+
+	var since, until time.Time
+	var err error
+	if vals.Get("since") != "" {
+		since, err = time.Parse(time.RFC3339, vals.Get("since"))
+		if err != nil {
+			http.Error(w, "invalid since, expected RFC3339", 400)
+			return
+		}
+	}
+	if vals.Get("until") != "" {
+		until, err = time.Parse(time.RFC3339, vals.Get("until"))
+		if err != nil {
+			http.Error(w, "invalid until, expected RFC3339", 400)
+			return
+		}
+	}
+
+	limit := 100
+	offset := 0
+	if vals.Get("limit") != "" {
+		limit, err = strconv.Atoi(vals.Get("limit"))
+		if err != nil || limit <= 0 || limit > AuditPageLimit {
+			http.Error(w, fmt.Sprintf("invalid limit, expected 1 to %d", AuditPageLimit), 400)
+			return
+		}
+	}
+	if vals.Get("offset") != "" {
+		offset, err = strconv.Atoi(vals.Get("offset"))
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", 400)
+			return
+		}
+	}
+
+	Auditmtx.Lock()
+	entries, err := readAuditLog(AuditLogPath)
+	Auditmtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	//newest entries first
+	matched := []AuditEntry{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if !since.IsZero() && entry.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !entry.Time.Before(until) {
+			continue
+		}
+		if matchAuditEntry(entry, query) {
+			matched = append(matched, entry)
+		}
+	}
+
+	page := AuditPage{Total: len(matched), Entries: []AuditEntry{}}
+	if offset < len(matched) {
+		end := offset + limit
+		if end > len(matched) {
+			end = len(matched)
+		}
+		page.Entries = matched[offset:end]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// verifyAuditLog checks the hash chain of the log. The first entry follows
+// prev, or starts the chain when prev is empty. The log has to end at the anchor when one was written
+func verifyAuditLog(key []byte, entries []AuditEntry, prev AuditAnchor, anchor AuditAnchor) AuditVerification {
+	result := AuditVerification{Valid: true, Entries: len(entries)}
+	fail := func(seq uint64, reason string) AuditVerification {
+		result.Valid = false
+		result.FirstInvalid = seq
+		result.Reason = reason
+		return result
+	}
+
+	last := prev
+	for _, entry := range entries {
+		if entry.Seq != last.Seq+1 {
+			return fail(entry.Seq, fmt.Sprintf("expected entry %d", last.Seq+1))
+		}
+		if entry.PrevHash != last.Hash {
+			return fail(entry.Seq, "not linked to the previous entry")
+		}
+		if !hmac.Equal([]byte(hashAuditEntry(key, entry)), []byte(entry.Hash)) {
+			return fail(entry.Seq, "does not match its hash")
+		}
+		last = AuditAnchor{entry.Seq, entry.Hash}
+	}
+
+	if anchor != (AuditAnchor{}) && anchor != last {
+		return fail(last.Seq+1, fmt.Sprintf("the log ends before the anchor at entry %d", anchor.Seq))
+	}
+	return result
+}
+
+// readAuditChain returns the entries of the rotated and the current log, and
+// the entry the first of them follows. Older rotations are gone, so the
+// chain is checked from the first entry that was kept
+func readAuditChain() ([]AuditEntry, AuditAnchor, error) {
+	entries, err := readAuditLog(AuditLogPath + ".1")
+	if err != nil {
+		return nil, AuditAnchor{}, err
+	}
+	current, err := readAuditLog(AuditLogPath)
+	if err != nil {
+		return nil, AuditAnchor{}, err
+	}
+	entries = append(entries, current...)
+
+	prev := AuditAnchor{}
+	if len(entries) > 0 && entries[0].Seq > 1 {
+		prev = AuditAnchor{entries[0].Seq - 1, entries[0].PrevHash}
+	}
+	return entries, prev, nil
+}
+
+func getAuditVerification(w http.ResponseWriter, r *http.Request) {
+	Auditmtx.Lock()
+	entries, prev, err := readAuditChain()
+	anchor := loadAuditAnchor()
+	key := gAuditKey
+	Auditmtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verifyAuditLog(key, entries, prev, anchor))
+}
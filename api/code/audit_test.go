@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// auditChain returns n linked entries following prev
+func auditChain(key []byte, prev AuditAnchor, n int) []AuditEntry {
+	entries := []AuditEntry{}
+	for i := 0; i < n; i++ {
+		entry := AuditEntry{Seq: prev.Seq + 1, PrevHash: prev.Hash, Actor: "user:admin", Action: "PUT", Path: "/zones/lan", Status: 200}
+		entry.Hash = hashAuditEntry(key, entry)
+		entries = append(entries, entry)
+		prev = AuditAnchor{entry.Seq, entry.Hash}
+	}
+	return entries
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	rotated := AuditAnchor{41, "rotated-tail-hash"}
+
+	tests := []struct {
+		name string
+		//changes a chain of three entries following prev
+		modify func(entries []AuditEntry) []AuditEntry
+		//tail the chain was written after, and the tail of the rotated log
+		start        AuditAnchor
+		prev         AuditAnchor
+		anchored     bool
+		key          []byte
+		valid        bool
+		firstInvalid uint64
+	}{
+		{"valid", nil, AuditAnchor{}, AuditAnchor{}, true, key, true, 0},
+		{"valid without anchor", nil, AuditAnchor{}, AuditAnchor{}, false, key, true, 0},
+		{"follows the rotated log", nil, rotated, rotated, true, key, true, 0},
+		{"empty log", func(entries []AuditEntry) []AuditEntry { return entries[:0] }, AuditAnchor{}, AuditAnchor{}, false, key, true, 0},
+		{"edited entry", func(entries []AuditEntry) []AuditEntry {
+			entries[1].Path = "/zones/wan"
+			return entries
+		}, AuditAnchor{}, AuditAnchor{}, true, key, false, 2},
+		{"removed entry", func(entries []AuditEntry) []AuditEntry {
+			return append(entries[:1], entries[2:]...)
+		}, AuditAnchor{}, AuditAnchor{}, true, key, false, 3},
+		{"removed last entry", func(entries []AuditEntry) []AuditEntry {
+			return entries[:2]
+		}, AuditAnchor{}, AuditAnchor{}, true, key, false, 3},
+		{"removed first entry", func(entries []AuditEntry) []AuditEntry {
+			return entries[1:]
+		}, AuditAnchor{}, AuditAnchor{}, true, key, false, 2},
+		{"renumbered entry", func(entries []AuditEntry) []AuditEntry {
+			entries[2].Seq = 5
+			entries[2].Hash = hashAuditEntry(key, entries[2])
+			return entries
+		}, AuditAnchor{}, AuditAnchor{}, false, key, false, 5},
+		{"rotated log replaced", nil, rotated, AuditAnchor{41, "other-hash"}, true, key, false, 42},
+		{"rotated log removed", nil, rotated, AuditAnchor{}, true, key, false, 42},
+		{"rehashed without the key", func(entries []AuditEntry) []AuditEntry {
+			entries[0].Path = "/zones/wan"
+			entries[0].Hash = hashAuditEntry([]byte("guessed key"), entries[0])
+			return entries
+		}, AuditAnchor{}, AuditAnchor{}, false, key, false, 1},
+	}
+
+	for _, test := range tests {
+		entries := auditChain(key, test.start, 3)
+		anchor := AuditAnchor{}
+		if test.anchored {
+			anchor = AuditAnchor{entries[2].Seq, entries[2].Hash}
+		}
+		if test.modify != nil {
+			entries = test.modify(entries)
+		}
+
+		result := verifyAuditLog(test.key, entries, test.prev, anchor)
+		if result.Valid != test.valid {
+			t.Errorf("%s: valid %v, expected %v (%s)", test.name, result.Valid, test.valid, result.Reason)
+		}
+		if result.FirstInvalid != test.firstInvalid {
+			t.Errorf("%s: first invalid %d, expected %d", test.name, result.FirstInvalid, test.firstInvalid)
+		}
+	}
+}
+
+func TestAppendAudit(t *testing.T) {
+	dir := t.TempDir()
+	AuditLogPath = dir + "/audit.log"
+	AuditKeyPath = dir + "/audit.key"
+	AuditAnchorPath = dir + "/audit.anchor"
+
+	initAudit()
+	for i := 0; i < 3; i++ {
+		//the last entry goes to a new log
+		if i == 2 {
+			AuditLogMaxSize = 1
+		}
+		err := appendAudit(AuditEntry{Actor: "user:admin", Action: "PUT", Path: "/zones/lan"})
+		AuditLogMaxSize = 16 * 1024 * 1024
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, _ := readAuditLog(AuditLogPath + ".1")
+	entries, prev, err := readAuditChain()
+	if err != nil || len(rotated) != 2 || len(entries) != 3 || prev != (AuditAnchor{}) {
+		t.Fatalf("read %d entries, %d rotated, after %+v: %v", len(entries), len(rotated), prev, err)
+	}
+	result := verifyAuditLog(gAuditKey, entries, prev, loadAuditAnchor())
+	if !result.Valid {
+		t.Errorf("log is invalid: %s", result.Reason)
+	}
+
+	//a restart continues the chain with the same key
+	initAudit()
+	appendAudit(AuditEntry{Actor: "user:admin", Action: "DELETE", Path: "/zones/lan"})
+	entries, prev, _ = readAuditChain()
+	result = verifyAuditLog(gAuditKey, entries, prev, loadAuditAnchor())
+	if !result.Valid || result.Entries != 4 {
+		t.Errorf("log is invalid after a restart: %s", result.Reason)
+	}
+
+	//edits of the rotated log are found as well
+	rotated[1].Path = "/zones/wan"
+	var data []byte
+	for _, entry := range rotated {
+		line, _ := json.Marshal(entry)
+		data = append(data, append(line, '\n')...)
+	}
+	ioutil.WriteFile(AuditLogPath+".1", data, 0600)
+	entries, prev, _ = readAuditChain()
+	result = verifyAuditLog(gAuditKey, entries, prev, loadAuditAnchor())
+	if result.Valid || result.FirstInvalid != 2 {
+		t.Errorf("edited rotated log verified as %+v", result)
+	}
+
+	//a lost key does not silently start a new chain
+	os.Remove(AuditKeyPath)
+	if _, err := loadAuditKey(); err == nil {
+		t.Errorf("a new key was created for an existing log")
+	}
+}
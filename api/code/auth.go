@@ -2,8 +2,6 @@ package main
 
 import (
 	crand "crypto/rand"
-	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
@@ -12,6 +10,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 import (
 	"github.com/duo-labs/webauthn.io/session"
@@ -39,24 +39,114 @@ type User struct {
 	id          uint64
 	username    string
 	credentials []webauthn.Credential
+	//the user account whose role applies, linked at registration
+	account string
 }
 
+// WebAuthnUser is the stored form of a User
+type WebAuthnUser struct {
+	ID          uint64
+	Username    string
+	Credentials []webauthn.Credential
+	Account     string `json:",omitempty"`
+}
+
+var WebAuthnUsersPath = TEST_PREFIX + "/state/api/webauthn_users.json"
+
+// lifetime of a login, and of a registration or login ceremony in progress
+var WebAuthnSessionLifetime = 12 * time.Hour
+var WebAuthnCeremonyLifetime = 5 * time.Minute
+
 //webauthn PoC based off of https://github.com/hbolimovsky/webauthn-example
 
+type authnSession struct {
+	user    *User
+	expires time.Time
+}
+
+type authnCeremony struct {
+	sessionData *webauthn.SessionData
+	user        *User
+	expires     time.Time
+}
+
 type authnconfig struct {
 	sessionStore *session.Store
 	webAuthn     *webauthn.WebAuthn
 
-	//token -> webauth session mapping
-	sessionMap map[string]*webauthn.SessionData
-	//token -> username mapping
-	regMap map[string]*User
+	//guards the maps below
+	mtx sync.Mutex
+
+	//token -> registration or login in progress
+	ceremonyMap map[string]authnCeremony
 
 	//username -> user mapping
 	userMap map[string]*User
 
-	//token to username mapping
-	authMap map[string]*User
+	//token to authenticated user mapping
+	authMap map[string]authnSession
+}
+
+func newAuthnConfig(w *webauthn.WebAuthn) *authnconfig {
+	auth := &authnconfig{
+		webAuthn:    w,
+		ceremonyMap: map[string]authnCeremony{},
+		userMap:     map[string]*User{},
+		authMap:     map[string]authnSession{},
+	}
+	auth.loadUsers()
+	return auth
+}
+
+func (auth *authnconfig) loadUsers() {
+	entries := []WebAuthnUser{}
+	data, err := os.ReadFile(WebAuthnUsersPath)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		log.Println("failed to load webauthn users", err)
+		return
+	}
+	for _, entry := range entries {
+		auth.userMap[entry.Username] = &User{entry.ID, entry.Username, entry.Credentials, entry.Account}
+	}
+}
+
+// saveUsers writes the registered users, the caller holds auth.mtx
+func (auth *authnconfig) saveUsers() error {
+	entries := []WebAuthnUser{}
+	for _, user := range auth.userMap {
+		entries = append(entries, WebAuthnUser{user.id, user.username, user.credentials, user.account})
+	}
+	file, _ := json.MarshalIndent(entries, "", " ")
+	return os.WriteFile(WebAuthnUsersPath, file, 0600)
+}
+
+// nextUserID returns an id not used by a registered user, the caller holds auth.mtx
+func (auth *authnconfig) nextUserID() uint64 {
+	id := uint64(1)
+	for _, user := range auth.userMap {
+		if user.id >= id {
+			id = user.id + 1
+		}
+	}
+	return id
+}
+
+// pruneSessions drops expired sessions and ceremonies, the caller holds auth.mtx
+func (auth *authnconfig) pruneSessions(now time.Time) {
+	for token, ceremony := range auth.ceremonyMap {
+		if now.After(ceremony.expires) {
+			delete(auth.ceremonyMap, token)
+		}
+	}
+	for token, session := range auth.authMap {
+		if now.After(session.expires) {
+			delete(auth.authMap, token)
+		}
+	}
 }
 
 func genBearerToken() string {
@@ -94,6 +184,15 @@ func (u *User) AddCredential(cred webauthn.Credential) {
 	u.credentials = append(u.credentials, cred)
 }
 
+// UpdateCredential stores the sign count of a credential after a login
+func (u *User) UpdateCredential(cred webauthn.Credential) {
+	for i := range u.credentials {
+		if string(u.credentials[i].ID) == string(cred.ID) {
+			u.credentials[i] = cred
+		}
+	}
+}
+
 func (auth *authnconfig) BeginRegistration(w http.ResponseWriter, r *http.Request) {
 	vals := r.URL.Query()
 	usernames, ok := vals["username"]
@@ -130,10 +229,38 @@ func (auth *authnconfig) BeginRegistration(w http.ResponseWriter, r *http.Reques
 
 	username := usernames[0]
 
+	//the credential is linked to the user account of the same name, which
+	// an admin has to create first
+	Usersmtx.Lock()
+	_, exists := loadUsers()[username]
+	Usersmtx.Unlock()
+	if !exists {
+		http.Error(w, "no user account "+username+", create it before registering a device", http.StatusBadRequest)
+		return
+	}
+
+	auth.mtx.Lock()
+	defer auth.mtx.Unlock()
+
+	//a registered user adds another credential under the same id
 	user := &User{}
-	//tbd get last user id and do + 1
-	user.id = 0
+	existing, exists := auth.userMap[username]
+	if exists {
+		user.id = existing.id
+		user.credentials = append(user.credentials, existing.credentials...)
+	} else {
+		user.id = auth.nextUserID()
+	}
 	user.username = username
+	user.account = username
+
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, cred := range user.credentials {
+		exclusions = append(exclusions, protocol.CredentialDescriptor{
+			Type:         protocol.PublicKeyCredentialType,
+			CredentialID: cred.ID,
+		})
+	}
 
 	token := genBearerToken()
 
@@ -141,17 +268,7 @@ func (auth *authnconfig) BeginRegistration(w http.ResponseWriter, r *http.Reques
 		credCreationOpts.Extensions = protocol.AuthenticationExtensions{"SPR-Bearer": token}
 	}
 
-	options, sessionData, err := auth.webAuthn.BeginRegistration(user, registerOptions)
-
-	if auth.sessionMap == nil {
-		auth.sessionMap = map[string]*webauthn.SessionData{}
-	}
-	if auth.regMap == nil {
-		auth.regMap = map[string]*User{}
-	}
-
-	auth.sessionMap[token] = sessionData
-	auth.regMap[token] = user
+	options, sessionData, err := auth.webAuthn.BeginRegistration(user, registerOptions, webauthn.WithExclusions(exclusions))
 
 	if err != nil {
 		log.Println(err)
@@ -159,6 +276,9 @@ func (auth *authnconfig) BeginRegistration(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	auth.pruneSessions(time.Now())
+	auth.ceremonyMap[token] = authnCeremony{sessionData, user, time.Now().Add(WebAuthnCeremonyLifetime)}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(options)
 }
@@ -174,19 +294,25 @@ func (auth *authnconfig) ExtractRequestToken(r *http.Request) string {
 	return ""
 }
 
+// ExtractSessionData takes the ceremony of the request token, which can only
+// be finished once. The caller holds auth.mtx
 func (auth *authnconfig) ExtractSessionData(r *http.Request) (*webauthn.SessionData, *User) {
 	bearerToken := auth.ExtractRequestToken(r)
-	sessionData, exists := auth.sessionMap[bearerToken]
-	if exists {
-		user, exists := auth.regMap[bearerToken]
-		if exists {
-			return sessionData, user
-		}
+	ceremony, exists := auth.ceremonyMap[bearerToken]
+	if !exists {
+		return nil, nil
 	}
-	return nil, nil
+	delete(auth.ceremonyMap, bearerToken)
+	if time.Now().After(ceremony.expires) {
+		return nil, nil
+	}
+	return ceremony.sessionData, ceremony.user
 }
 
 func (auth *authnconfig) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	auth.mtx.Lock()
+	defer auth.mtx.Unlock()
+
 	sessionData, user := auth.ExtractSessionData(r)
 
 	if sessionData == nil {
@@ -208,11 +334,14 @@ func (auth *authnconfig) FinishRegistration(w http.ResponseWriter, r *http.Reque
 	}
 
 	user.AddCredential(*credential)
-	if auth.userMap == nil {
-		auth.userMap = map[string]*User{}
-	}
 	auth.userMap[user.username] = user
 
+	err = auth.saveUsers()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode("success")
 }
@@ -227,6 +356,9 @@ func (auth *authnconfig) BeginLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	username := usernames[0]
 
+	auth.mtx.Lock()
+	defer auth.mtx.Unlock()
+
 	user, exists := auth.userMap[username]
 	if !exists {
 		w.Header().Set("Content-Type", "application/json")
@@ -248,18 +380,16 @@ func (auth *authnconfig) BeginLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if auth.sessionMap == nil {
-		auth.sessionMap = map[string]*webauthn.SessionData{}
-	}
-
-	auth.sessionMap[token] = sessionData
-	auth.regMap[token] = user
+	auth.pruneSessions(time.Now())
+	auth.ceremonyMap[token] = authnCeremony{sessionData, user, time.Now().Add(WebAuthnCeremonyLifetime)}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(options)
 }
 
 func (auth *authnconfig) FinishLogin(w http.ResponseWriter, r *http.Request) {
+	auth.mtx.Lock()
+	defer auth.mtx.Unlock()
 
 	sessionData, user := auth.ExtractSessionData(r)
 
@@ -281,60 +411,91 @@ func (auth *authnconfig) FinishLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user.AddCredential(*credential)
+	//a sign count that did not increase points to a cloned authenticator
+	if credential.Authenticator.CloneWarning {
+		http.Error(w, "authenticator sign count did not increase", 400)
+		return
+	}
 
-	//add bearer token to authenticated users etc
-	if auth.authMap == nil {
-		auth.authMap = map[string]*User{}
+	user.UpdateCredential(*credential)
+	err = auth.saveUsers()
+	if err != nil {
+		log.Println("failed to save webauthn users", err)
 	}
-	auth.authMap[auth.ExtractRequestToken(r)] = user
+
+	//add bearer token to authenticated users etc
+	auth.authMap[auth.ExtractRequestToken(r)] = authnSession{user, time.Now().Add(WebAuthnSessionLifetime)}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode("success")
 }
 
-func (auth *authnconfig) authenticateToken(token string) bool {
-	// check webauthn
-	_, exists := auth.authMap[token]
+// Logout revokes the session of the request token
+func (auth *authnconfig) Logout(w http.ResponseWriter, r *http.Request) {
+	auth.mtx.Lock()
+	defer auth.mtx.Unlock()
 
-	if !exists {
-		//check api tokens
-		tokens := []string{}
-		data, err := os.ReadFile(TEST_PREFIX + "/state/api/auth_tokens")
-		if err == nil {
-			json.Unmarshal(data, &tokens)
-		}
+	token := auth.ExtractRequestToken(r)
+	if _, exists := auth.authMap[token]; !exists {
+		http.Error(w, "no session", 400)
+		return
+	}
+	delete(auth.authMap, token)
 
-		for _, s := range tokens {
-			if subtle.ConstantTimeCompare([]byte(token), []byte(s)) == 1 {
-				exists = true
-				break
-			}
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode("success")
+}
 
-	}
+// sessionUser returns the user of a webauthn session that has not expired
+func (auth *authnconfig) sessionUser(token string) (*User, bool) {
+	auth.mtx.Lock()
+	defer auth.mtx.Unlock()
 
-	return exists
+	session, exists := auth.authMap[token]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(session.expires) {
+		delete(auth.authMap, token)
+		return nil, false
+	}
+	return session.user, true
 }
 
-func (auth *authnconfig) authenticateUser(username string, password string) bool {
-	users := map[string]string{}
-	data, err := os.ReadFile(TEST_PREFIX + "/state/api/auth_users")
-	if err == nil {
-		json.Unmarshal(data, &users)
+// sessionAccount returns the account whose role applies to a webauthn user.
+// Users registered before credentials were linked to accounts, or whose
+// account was deleted, get no role and are denied every route
+func sessionAccount(user *User) UserAccount {
+	if user.account == "" {
+		return UserAccount{Name: user.username}
 	}
 
-	pwEntry, exists := users[username]
+	Usersmtx.Lock()
+	account, exists := loadUsers()[user.account]
+	Usersmtx.Unlock()
+	if exists {
+		return account
+	}
+	return UserAccount{Name: user.username}
+}
 
+// authenticateToken returns the caller of a webauthn session or api token
+func (auth *authnconfig) authenticateToken(token string) (PluginCaller, bool) {
+	// check webauthn
+	user, exists := auth.sessionUser(token)
 	if exists {
-		passwordHash := sha256.Sum256([]byte(password))
-		expectedPasswordHash := sha256.Sum256([]byte(pwEntry))
-		passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
-		if passwordMatch {
-			return true
-		}
+		return accountCaller(sessionAccount(user)), true
 	}
-	return false
+
+	//check api tokens
+	entry, exists := verifyToken(token)
+	return tokenCaller(entry), exists
+}
+
+// authenticateUser returns the caller of an account
+func (auth *authnconfig) authenticateUser(username string, password string) (PluginCaller, bool) {
+	account, ok := verifyUserPassword(username, password)
+	return accountCaller(account), ok
 }
 
 func (auth *authnconfig) Authenticate(authenticatedNext *mux.Router, publicNext *mux.Router) http.HandlerFunc {
@@ -344,36 +505,82 @@ func (auth *authnconfig) Authenticate(authenticatedNext *mux.Router, publicNext
 	webauth_router.HandleFunc("/register/", auth.FinishRegistration).Methods("POST", "OPTIONS")
 	webauth_router.HandleFunc("/login/", auth.BeginLogin).Methods("GET", "OPTIONS")
 	webauth_router.HandleFunc("/login/", auth.FinishLogin).Methods("POST", "OPTIONS")
+	webauth_router.HandleFunc("/logout/", auth.Logout).Methods("POST", "OPTIONS")
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var matchInfo mux.RouteMatch
 
-		/*
-		// disable webauth code for now
 		//first match webuath
 		if webauth_router.Match(r, &matchInfo) {
 			webauth_router.ServeHTTP(w, r)
 			return
 		}
-		*/
 
 		//next match api
 
 		token := auth.ExtractRequestToken(r)
+		source := auditSource(r)
+		tokenFailed, basicFailed := false, false
 
 		if token != "" {
-			if auth.authenticateToken(token) {
-				authenticatedNext.ServeHTTP(w, r)
+			if wait, locked := loginLocked(source, ""); locked {
+				lockedOut(w, wait)
+				return
+			}
+
+			user, exists := auth.sessionUser(token)
+			if exists {
+				//the role of the user has to permit the route
+				account := sessionAccount(user)
+				authenticatedNext.Match(r, &matchInfo)
+				if !authorizeUser(account, r, &matchInfo) {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				r = withPluginCaller(r, accountCaller(account))
+				authenticatedNext.ServeHTTP(w, withAuditActor(r, "webauthn:"+user.username))
+				return
+			}
+
+			entry, ok := verifyToken(token)
+			if ok {
+				//the scopes of the token have to permit the route
+				authenticatedNext.Match(r, &matchInfo)
+				if !authorizeToken(entry, r, &matchInfo) {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				clearLoginFailures(source, "")
+				r = withPluginCaller(r, tokenCaller(entry))
+				authenticatedNext.ServeHTTP(w, withAuditActor(r, "token:"+entry.actorName()))
 				return
 			}
+
+			tokenFailed = true
 		}
 
 		//check basic auth next
 		//https://www.alexedwards.net/blog/basic-authentication-in-go
 		username, password, ok := r.BasicAuth()
 		if ok {
-			if auth.authenticateUser(username, password) {
-				authenticatedNext.ServeHTTP(w, r)
+			if wait, locked := loginLocked(source, username); locked {
+				lockedOut(w, wait)
+				return
+			}
+
+			account, ok := verifyUserPassword(username, password)
+			if !ok {
+				basicFailed = true
+			} else {
+				clearLoginFailures(source, username)
+				//the role of the user has to permit the route
+				authenticatedNext.Match(r, &matchInfo)
+				if !authorizeUser(account, r, &matchInfo) {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				r = withPluginCaller(r, accountCaller(account))
+				authenticatedNext.ServeHTTP(w, withAuditActor(r, "user:"+account.Name))
 				return
 			}
 		}
@@ -384,6 +591,13 @@ func (auth *authnconfig) Authenticate(authenticatedNext *mux.Router, publicNext
 			return
 		}
 
+		//bad credentials only count as failures when the request is rejected
+		if tokenFailed {
+			recordLoginFailure(source, "")
+		}
+		if basicFailed {
+			recordLoginFailure(source, username)
+		}
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 	})
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionAccount(t *testing.T) {
+	UsersPath = t.TempDir() + "/users.json"
+	err := saveUsers(map[string]UserAccount{
+		"alice": {Name: "alice", Role: RoleViewer},
+		"bob":   {Name: "bob", Role: RoleAdmin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user User
+		role string
+	}{
+		{"linked viewer", User{username: "alice", account: "alice"}, RoleViewer},
+		{"linked admin", User{username: "bob", account: "bob"}, RoleAdmin},
+		{"not linked", User{username: "bob"}, ""},
+		{"deleted account", User{username: "carol", account: "carol"}, ""},
+	}
+
+	for _, test := range tests {
+		account := sessionAccount(&test.user)
+		if account.Role != test.role {
+			t.Errorf("%s: role %q, expected %q", test.name, account.Role, test.role)
+		}
+	}
+}
+
+func TestAuthenticateFailures(t *testing.T) {
+	TokensPath = t.TempDir() + "/tokens.json"
+	auth := &authnconfig{authMap: map[string]authnSession{}}
+	handler := auth.Authenticate(testRouter("/private"), testRouter("/public"))
+
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		recorded bool
+	}{
+		{"public route", "/public", 200, false},
+		{"private route", "/private", 401, true},
+	}
+
+	for _, test := range tests {
+		source := "192.0.2.10"
+		clearLoginFailures(source, "")
+
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.RemoteAddr = source + ":1234"
+		r.Header.Set("Authorization", "Bearer stale-token")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, expected %d", test.name, w.Code, test.status)
+		}
+
+		Lockoutmtx.Lock()
+		_, recorded := gLoginFailures["ip:"+source]
+		Lockoutmtx.Unlock()
+		if recorded != test.recorded {
+			t.Errorf("%s: failure recorded %v, expected %v", test.name, recorded, test.recorded)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/google/nftables/expr"
+)
+
+// The ip, interface and mac of every client learned through dhcpUpdate are
+// saved so that the verdict maps can be repopulated after the api restarts
+// or the base container flushes the ruleset, without waiting for clients
+// to renew their DHCP lease.
+
+type clientBinding struct {
+	IP      string
+	Iface   string
+	MAC     string
+	Name    string
+	Updated time.Time
+	//addresses learned from dhcpUpdate6, oldest first
+	IPv6 []string `json:",omitempty"`
+}
+
+// clients keep several ipv6 addresses at once with SLAAC privacy extensions
+var MaxBindingIPv6 = 4
+
+var Bindingsmtx sync.Mutex
+var BindingsStatePath = TEST_PREFIX + "/state/api/bindings.json"
+
+// set added to the inet filter table after a restore. When it goes missing
+// the table was recreated and the verdict maps need to be restored again
+var RestoreMarkerSet = "api_restored"
+var RestoreCheckInterval = 10 * time.Second
+
+func loadBindings() map[string]clientBinding {
+	Bindingsmtx.Lock()
+	defer Bindingsmtx.Unlock()
+
+	bindings := map[string]clientBinding{}
+	data, err := ioutil.ReadFile(BindingsStatePath)
+	if err != nil {
+		return bindings
+	}
+	err = json.Unmarshal(data, &bindings)
+	if err != nil {
+		fmt.Println("failed to load bindings", err)
+	}
+	return bindings
+}
+
+func saveBindings(bindings map[string]clientBinding) error {
+	file, _ := json.MarshalIndent(bindings, "", " ")
+	return ioutil.WriteFile(BindingsStatePath, file, 0644)
+}
+
+func updateBinding(dhcp DHCPUpdate) error {
+	bindings := loadBindings()
+
+	Bindingsmtx.Lock()
+	defer Bindingsmtx.Unlock()
+
+	mac := trimLower(dhcp.MAC)
+	for key, binding := range bindings {
+		//the ip was handed to a different client
+		if key != mac && binding.IP == dhcp.IP {
+			delete(bindings, key)
+		}
+	}
+
+	bindings[mac] = clientBinding{IP: dhcp.IP, Iface: dhcp.Iface, MAC: mac, Name: dhcp.Name, Updated: time.Now(), IPv6: bindings[mac].IPv6}
+	return saveBindings(bindings)
+}
+
+// nextIPv6 adds an address to the ones a client holds, splitting off the
+// oldest addresses beyond MaxBindingIPv6
+func nextIPv6(addrs []string, addr string) ([]string, []string) {
+	addrs = append(removeAddr(addrs, addr), addr)
+	if len(addrs) <= MaxBindingIPv6 {
+		return addrs, []string{}
+	}
+	cut := len(addrs) - MaxBindingIPv6
+	return addrs[cut:], addrs[:cut]
+}
+
+// updateBinding6 records an ipv6 address of a client
+func updateBinding6(dhcp DHCPUpdate6) error {
+	bindings := loadBindings()
+
+	Bindingsmtx.Lock()
+	defer Bindingsmtx.Unlock()
+
+	mac := trimLower(dhcp.MAC)
+	for key, binding := range bindings {
+		if key != mac {
+			binding.IPv6 = removeAddr(binding.IPv6, dhcp.IP)
+			bindings[key] = binding
+		}
+	}
+
+	binding, exists := bindings[mac]
+	if !exists {
+		binding = clientBinding{MAC: mac, Iface: dhcp.Iface, Name: dhcp.Name}
+	}
+	binding.IPv6, _ = nextIPv6(binding.IPv6, dhcp.IP)
+	binding.Updated = time.Now()
+	bindings[mac] = binding
+
+	return saveBindings(bindings)
+}
+
+func getBindingIPv6(MAC string) []string {
+	return loadBindings()[trimLower(MAC)].IPv6
+}
+
+func removeAddr(addrs []string, addr string) []string {
+	result := []string{}
+	for _, entry := range addrs {
+		if entry != addr {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func (binding clientBinding) addrs() []string {
+	addrs := []string{}
+	if binding.IP != "" {
+		addrs = append(addrs, binding.IP)
+	}
+	return append(addrs, binding.IPv6...)
+}
+
+func validateBinding(binding clientBinding) error {
+	if binding.Iface == "" || len(binding.Iface) > 15 {
+		return fmt.Errorf("invalid interface %q", binding.Iface)
+	}
+	_, err := net.ParseMAC(binding.MAC)
+	if err != nil {
+		return fmt.Errorf("invalid mac %q", binding.MAC)
+	}
+	for _, addr := range binding.addrs() {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("invalid ip %q", addr)
+		}
+	}
+	return nil
+}
+
+// restoreElements returns the elements the reconciler would compute for the
+// saved bindings: only zone members get a dhcp_access entry, and their
+// verdict map entries follow the active zones. Bad bindings are skipped
+func restoreElements(bindings map[string]clientBinding, zones []ClientZone, active []ClientZone) []nftElement {
+	elements := []nftElement{}
+	for _, binding := range bindings {
+		err := validateBinding(binding)
+		if err != nil {
+			fmt.Println("skipping binding of", binding.MAC, err)
+			continue
+		}
+
+		member := false
+		for _, zone := range zones {
+			if isZoneClient(zone, binding.MAC) {
+				member = true
+			}
+		}
+		if !member {
+			continue
+		}
+
+		entry := verdictEntry{ifname: binding.Iface, mac: trimLower(binding.MAC)}
+		elements = append(elements, nftElement{"dhcp_access", entry, expr.VerdictAccept})
+		for _, addr := range binding.addrs() {
+			elements = append(elements, getVmapElements(active, addr, binding.MAC, binding.Iface)...)
+		}
+	}
+	return elements
+}
+
+func restoreVerdictMaps() error {
+	DHCPmtx.Lock()
+	defer DHCPmtx.Unlock()
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	batch, err := NewNFTBatch()
+	if err != nil {
+		return err
+	}
+
+	for _, element := range restoreElements(loadBindings(), getZonesJson(), getActiveZones()) {
+		zoneName := customZoneOfMap(element.Map)
+		if zoneName != "" {
+			err = batch.EnsureZoneMaps(zoneName)
+			if err != nil {
+				return err
+			}
+		}
+		err = batch.AddElement(element.Map, element.Entry, element.Verdict)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = batch.AddMarkerSet(RestoreMarkerSet)
+	if err != nil {
+		return err
+	}
+
+	return batch.Commit()
+}
+
+func needsRestore() (bool, error) {
+	batch, err := NewNFTBatch()
+	if err != nil {
+		return false, err
+	}
+
+	//wait for nft_rules.sh to finish creating the table
+	ready, err := batch.HasSet("dhcp_access")
+	if err != nil || !ready {
+		return false, err
+	}
+
+	marked, err := batch.HasSet(RestoreMarkerSet)
+	return !marked, err
+}
+
+func restoreTimer() {
+	runTimer := func() {
+		ticker := time.NewTicker(RestoreCheckInterval)
+		//always restore once on startup
+		restore := true
+		for {
+			if restore {
+				err := restoreVerdictMaps()
+				if err != nil {
+					fmt.Println("failed to restore verdict maps", err)
+				} else {
+					WSNotifyString("VerdictMapsRestored", "")
+				}
+			}
+
+			<-ticker.C
+
+			var err error
+			restore, err = needsRestore()
+			if err != nil {
+				fmt.Println("restore check failed", err)
+			}
+		}
+	}
+
+	go runTimer()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+import (
+	"github.com/google/nftables/expr"
+)
+
+func TestRestoreElements(t *testing.T) {
+	zones := []ClientZone{
+		{Name: "lan", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}, {Mac: "aa:bb:cc:dd:ee:02"}}},
+		{Name: "dns", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}, {Mac: "aa:bb:cc:dd:ee:04"}}},
+	}
+	//aa:bb:cc:dd:ee:02 is outside of its schedule
+	active := []ClientZone{
+		{Name: "lan", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}}},
+		zones[1],
+	}
+
+	tests := []struct {
+		name     string
+		binding  clientBinding
+		elements []nftElement
+	}{
+		{"member", clientBinding{IP: "192.168.2.10", Iface: "wlan0", MAC: "aa:bb:cc:dd:ee:01"}, []nftElement{
+			{"dhcp_access", verdictEntry{ifname: "wlan0", mac: "aa:bb:cc:dd:ee:01"}, expr.VerdictAccept},
+			{"lan_access", verdictEntry{ip: "192.168.2.10", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:01"}, expr.VerdictAccept},
+			{"dns_access", verdictEntry{ip: "192.168.2.10", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:01"}, expr.VerdictAccept},
+		}},
+		{"member with ipv6", clientBinding{Iface: "wlan0", MAC: "aa:bb:cc:dd:ee:04", IPv6: []string{"fd00::4"}}, []nftElement{
+			{"dhcp_access", verdictEntry{ifname: "wlan0", mac: "aa:bb:cc:dd:ee:04"}, expr.VerdictAccept},
+			{"dns_access6", verdictEntry{ip: "fd00::4", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:04"}, expr.VerdictAccept},
+		}},
+		{"inactive member", clientBinding{IP: "192.168.2.11", Iface: "wlan0", MAC: "aa:bb:cc:dd:ee:02"}, []nftElement{
+			{"dhcp_access", verdictEntry{ifname: "wlan0", mac: "aa:bb:cc:dd:ee:02"}, expr.VerdictAccept},
+		}},
+		{"not a member", clientBinding{IP: "192.168.2.12", Iface: "wlan0", MAC: "aa:bb:cc:dd:ee:03"}, []nftElement{}},
+		{"no interface", clientBinding{IP: "192.168.2.10", MAC: "aa:bb:cc:dd:ee:01"}, []nftElement{}},
+		{"bad mac", clientBinding{IP: "192.168.2.10", Iface: "wlan0", MAC: "aa:bb"}, []nftElement{}},
+		{"bad ip", clientBinding{IP: "192.168.2", Iface: "wlan0", MAC: "aa:bb:cc:dd:ee:01"}, []nftElement{}},
+	}
+
+	for _, test := range tests {
+		bindings := map[string]clientBinding{test.binding.MAC: test.binding}
+		elements := restoreElements(bindings, zones, active)
+		if !reflect.DeepEqual(elements, test.elements) {
+			t.Errorf("%s: elements %v, expected %v", test.name, elements, test.elements)
+		}
+	}
+}
+
+func TestNextIPv6(t *testing.T) {
+	tests := []struct {
+		addrs   []string
+		addr    string
+		result  []string
+		expired []string
+	}{
+		{[]string{}, "fd00::1", []string{"fd00::1"}, []string{}},
+		{[]string{"fd00::1", "fd00::2"}, "fd00::1", []string{"fd00::2", "fd00::1"}, []string{}},
+		{[]string{"fd00::1", "fd00::2", "fd00::3", "fd00::4"}, "fd00::5", []string{"fd00::2", "fd00::3", "fd00::4", "fd00::5"}, []string{"fd00::1"}},
+		{[]string{"fd00::1", "fd00::2", "fd00::3", "fd00::4"}, "fd00::2", []string{"fd00::1", "fd00::3", "fd00::4", "fd00::2"}, []string{}},
+	}
+
+	for _, test := range tests {
+		result, expired := nextIPv6(test.addrs, test.addr)
+		if !reflect.DeepEqual(result, test.result) || !reflect.DeepEqual(expired, test.expired) {
+			t.Errorf("nextIPv6(%v, %s) = %v, %v, expected %v, %v", test.addrs, test.addr, result, expired, test.result, test.expired)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// A DHCP update is applied as a transaction. Each step records the state it
+// replaces so that a failure in a later step can roll the earlier ones back,
+// leaving the client as it was before the request.
+
+type DHCPStepResult struct {
+	Name       string
+	Status     string
+	Error      string `json:",omitempty"`
+	RollbackOK bool   `json:",omitempty"`
+}
+
+type DHCPUpdateResult struct {
+	IP     string
+	MAC    string
+	Iface  string
+	Status string
+	Error  string `json:",omitempty"`
+	Steps  []DHCPStepResult
+}
+
+type dhcpStep struct {
+	name     string
+	apply    func() error
+	rollback func() error
+}
+
+type dhcpTransaction struct {
+	IP    string
+	MAC   string
+	Iface string
+	steps []dhcpStep
+}
+
+// DHCPUpdate6 reports an ipv6 address of a client, leased over DHCPv6 or
+// configured through SLAAC and seen in the neighbor table
+type DHCPUpdate6 struct {
+	IP     string
+	MAC    string
+	Name   string
+	Iface  string
+	Source string
+}
+
+func getArpEntryFromIP(IP string) (ArpEntry, error) {
+	entries, err := GetArpEntries()
+	if err != nil {
+		return ArpEntry{}, err
+	}
+
+	for _, entry := range entries {
+		if entry.IP == IP && entry.Mac != "00:00:00:00:00:00" {
+			return entry, nil
+		}
+	}
+
+	return ArpEntry{}, errors.New("IP address not found")
+}
+
+func newDHCPTransaction(dhcp DHCPUpdate) *dhcpTransaction {
+	txn := &dhcpTransaction{IP: dhcp.IP, MAC: dhcp.MAC, Iface: dhcp.Iface}
+
+	var batch *NFTBatch
+	txn.steps = append(txn.steps, dhcpStep{
+		name: "verdict maps",
+		apply: func() error {
+			var err error
+			batch, err = NewNFTBatch()
+			if err != nil {
+				return err
+			}
+			//delete this ip, mac from any existing verdict maps
+			err = flushVmaps(batch, dhcp.IP, dhcp.MAC, dhcp.Iface, getVerdictMapNames4(), shouldFlushByInterface(dhcp.Iface))
+			if err != nil {
+				return err
+			}
+			//add entry to appropriate verdict maps
+			err = populateVmapEntries(batch, dhcp.IP, dhcp.MAC, dhcp.Iface)
+			if err != nil {
+				return err
+			}
+			//the flush and the new entries are applied in one transaction
+			return batch.Commit()
+		},
+		rollback: func() error {
+			return batch.Revert()
+		},
+	})
+
+	addrAdded := false
+	txn.steps = append(txn.steps, dhcpStep{
+		name: "router address",
+		apply: func() error {
+			if hasAddr(dhcp.Router, dhcp.Iface) {
+				return nil
+			}
+			err := updateAddr(dhcp.Router, dhcp.Iface)
+			addrAdded = err == nil
+			return err
+		},
+		rollback: func() error {
+			if !addrAdded {
+				return nil
+			}
+			return deleteAddr(dhcp.Router, dhcp.Iface)
+		},
+	})
+
+	var priorArp *ArpEntry
+	txn.steps = append(txn.steps, dhcpStep{
+		name: "static arp",
+		apply: func() error {
+			entry, err := getArpEntryFromIP(dhcp.IP)
+			if err == nil {
+				priorArp = &entry
+			}
+			return updateArp(dhcp.Iface, dhcp.IP, dhcp.MAC)
+		},
+		rollback: func() error {
+			if priorArp == nil {
+				return deleteArp(dhcp.Iface, dhcp.IP)
+			}
+			return updateArp(priorArp.Device, priorArp.IP, priorArp.Mac)
+		},
+	})
+
+	var priorMappings []byte
+	txn.steps = append(txn.steps, dhcpStep{
+		name: "local mappings",
+		apply: func() error {
+			data, err := readLocalMappings()
+			if err == nil {
+				priorMappings = data
+			}
+			return updateLocalMappings(dhcp.IP, dhcp.Name)
+		},
+		rollback: func() error {
+			if priorMappings == nil {
+				return nil
+			}
+			return writeLocalMappings(priorMappings)
+		},
+	})
+
+	return txn
+}
+
+type ipNeighbor struct {
+	Dst    string `json:"dst"`
+	Dev    string `json:"dev"`
+	Lladdr string `json:"lladdr"`
+}
+
+func getNeighEntryFromIP(IP string) (ipNeighbor, error) {
+	stdout, err := exec.Command("ip", "-6", "-j", "neigh", "show", IP).Output()
+	if err != nil {
+		return ipNeighbor{}, err
+	}
+
+	entries := []ipNeighbor{}
+	err = json.Unmarshal(stdout, &entries)
+	if err != nil {
+		return ipNeighbor{}, err
+	}
+
+	for _, entry := range entries {
+		if entry.Lladdr != "" {
+			return entry, nil
+		}
+	}
+
+	return ipNeighbor{}, errors.New("IP address not found")
+}
+
+func newDHCPTransaction6(dhcp DHCPUpdate6) *dhcpTransaction {
+	txn := &dhcpTransaction{IP: dhcp.IP, MAC: dhcp.MAC, Iface: dhcp.Iface}
+
+	var batch *NFTBatch
+	txn.steps = append(txn.steps, dhcpStep{
+		name: "verdict maps",
+		apply: func() error {
+			var err error
+			batch, err = NewNFTBatch()
+			if err != nil {
+				return err
+			}
+
+			//the client keeps its other addresses, only the ones it
+			// rotated out and any previous holder of this one are flushed
+			_, dropped := nextIPv6(getBindingIPv6(dhcp.MAC), dhcp.IP)
+			for _, addr := range append(dropped, dhcp.IP) {
+				err = flushVmaps(batch, addr, "", dhcp.Iface, getVerdictMapNames6(), false)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = addVmapEntries(batch, dhcp.IP, dhcp.MAC, dhcp.Iface)
+			if err != nil {
+				return err
+			}
+			return batch.Commit()
+		},
+		rollback: func() error {
+			return batch.Revert()
+		},
+	})
+
+	var priorNeigh *ipNeighbor
+	txn.steps = append(txn.steps, dhcpStep{
+		name: "neighbor table",
+		apply: func() error {
+			entry, err := getNeighEntryFromIP(dhcp.IP)
+			if err == nil {
+				priorNeigh = &entry
+			}
+			return updateNeigh(dhcp.Iface, dhcp.IP, dhcp.MAC)
+		},
+		rollback: func() error {
+			if priorNeigh == nil {
+				return deleteNeigh(dhcp.Iface, dhcp.IP)
+			}
+			return updateNeigh(priorNeigh.Dev, priorNeigh.Dst, priorNeigh.Lladdr)
+		},
+	})
+
+	if dhcp.Name == "" {
+		return txn
+	}
+
+	var priorMappings []byte
+	txn.steps = append(txn.steps, dhcpStep{
+		name: "local mappings",
+		apply: func() error {
+			data, err := readLocalMappings()
+			if err == nil {
+				priorMappings = data
+			}
+			return updateLocalMappings(dhcp.IP, dhcp.Name)
+		},
+		rollback: func() error {
+			if priorMappings == nil {
+				return nil
+			}
+			return writeLocalMappings(priorMappings)
+		},
+	})
+
+	return txn
+}
+
+func (txn *dhcpTransaction) run() (DHCPUpdateResult, error) {
+	result := DHCPUpdateResult{IP: txn.IP, MAC: txn.MAC, Iface: txn.Iface, Status: "applied"}
+
+	for idx, step := range txn.steps {
+		err := step.apply()
+		if err == nil {
+			result.Steps = append(result.Steps, DHCPStepResult{Name: step.name, Status: "applied"})
+			continue
+		}
+
+		result.Steps = append(result.Steps, DHCPStepResult{Name: step.name, Status: "failed", Error: err.Error()})
+		result.Status = "rolled back"
+		result.Error = fmt.Sprintf("%s: %v", step.name, err)
+
+		//undo the completed steps in reverse order
+		for i := idx - 1; i >= 0; i-- {
+			rerr := txn.steps[i].rollback()
+			result.Steps[i].Status = "rolled back"
+			result.Steps[i].RollbackOK = rerr == nil
+			if rerr != nil {
+				result.Steps[i].Error = rerr.Error()
+				result.Status = "rollback failed"
+			}
+		}
+		return result, err
+	}
+
+	return result, nil
+}
+
+func dhcpUpdate(w http.ResponseWriter, r *http.Request) {
+	DHCPmtx.Lock()
+	defer DHCPmtx.Unlock()
+
+	//Handle networking tasks upon a DHCP
+	dhcp := DHCPUpdate{}
+	err := json.NewDecoder(r.Body).Decode(&dhcp)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	WSNotifyValue("DHCPUpdateRequest", dhcp)
+
+	started := time.Now()
+	result, err := newDHCPTransaction(dhcp).run()
+	observeDHCPUpdate("ipv4", result.Status, started)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		fmt.Println("dhcpUpdate failed", dhcp.MAC, dhcp.IP, result.Status, err)
+		WSNotifyValue("DHCPUpdateFailed", result)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	previous, exists := loadBindings()[trimLower(dhcp.MAC)]
+	if exists {
+		auditChange(r, previous, dhcp)
+	} else {
+		auditChange(r, nil, dhcp)
+	}
+
+	err = updateBinding(dhcp)
+	if err != nil {
+		fmt.Println("failed to save binding", dhcp.MAC, err)
+	}
+	recordDeviceSeen(dhcp.MAC, dhcp.IP, dhcp.Iface, dhcp.Name)
+
+	WSNotifyValue("DHCPUpdateProcessed", result)
+	json.NewEncoder(w).Encode(result)
+}
+
+func dhcpUpdate6(w http.ResponseWriter, r *http.Request) {
+	DHCPmtx.Lock()
+	defer DHCPmtx.Unlock()
+
+	dhcp := DHCPUpdate6{}
+	err := json.NewDecoder(r.Body).Decode(&dhcp)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	ip := net.ParseIP(dhcp.IP)
+	if ip == nil || ip.To4() != nil || !ip.IsGlobalUnicast() {
+		http.Error(w, "invalid ipv6 address "+dhcp.IP, 400)
+		return
+	}
+	//verdict map entries are compared in their canonical form
+	dhcp.IP = ip.String()
+	dhcp.MAC = trimLower(dhcp.MAC)
+	dhcp.Source = trimLower(dhcp.Source)
+	if dhcp.Source != "dhcpv6" && dhcp.Source != "slaac" {
+		http.Error(w, "invalid source "+dhcp.Source, 400)
+		return
+	}
+
+	WSNotifyValue("DHCPUpdate6Request", dhcp)
+
+	_, dropped := nextIPv6(getBindingIPv6(dhcp.MAC), dhcp.IP)
+	started := time.Now()
+	result, err := newDHCPTransaction6(dhcp).run()
+	observeDHCPUpdate("ipv6", result.Status, started)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		fmt.Println("dhcpUpdate6 failed", dhcp.MAC, dhcp.IP, result.Status, err)
+		WSNotifyValue("DHCPUpdate6Failed", result)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	auditChange(r, getBindingIPv6(dhcp.MAC), dhcp)
+
+	err = updateBinding6(dhcp)
+	if err != nil {
+		fmt.Println("failed to save binding", dhcp.MAC, err)
+	}
+	//the last ip stays the ipv4 address
+	recordDeviceSeen(dhcp.MAC, "", dhcp.Iface, dhcp.Name)
+
+	//unpin the addresses the client rotated out
+	for _, addr := range dropped {
+		err = deleteNeigh(dhcp.Iface, addr)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	WSNotifyValue("DHCPUpdate6Processed", result)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDHCPTransactionRun(t *testing.T) {
+	errApply := errors.New("apply failed")
+	errRollback := errors.New("rollback failed")
+
+	tests := []struct {
+		name string
+		//per step: fail apply, fail rollback
+		steps      [][2]bool
+		status     string
+		statuses   []string
+		rolledBack []string
+	}{
+		{"all applied", [][2]bool{{false, false}, {false, false}}, "applied", []string{"applied", "applied"}, []string{}},
+		{"first fails", [][2]bool{{true, false}, {false, false}}, "rolled back", []string{"failed"}, []string{}},
+		{"last fails", [][2]bool{{false, false}, {false, false}, {true, false}}, "rolled back", []string{"rolled back", "rolled back", "failed"}, []string{"b", "a"}},
+		{"rollback fails", [][2]bool{{false, true}, {true, false}}, "rollback failed", []string{"rolled back", "failed"}, []string{"a"}},
+	}
+
+	for _, test := range tests {
+		rolledBack := []string{}
+		txn := &dhcpTransaction{}
+		for i, step := range test.steps {
+			name := string(rune('a' + i))
+			failApply, failRollback := step[0], step[1]
+			txn.steps = append(txn.steps, dhcpStep{
+				name: name,
+				apply: func() error {
+					if failApply {
+						return errApply
+					}
+					return nil
+				},
+				rollback: func() error {
+					rolledBack = append(rolledBack, name)
+					if failRollback {
+						return errRollback
+					}
+					return nil
+				},
+			})
+		}
+
+		result, err := txn.run()
+		if (err != nil) != (test.status != "applied") {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if result.Status != test.status {
+			t.Errorf("%s: status %q, expected %q", test.name, result.Status, test.status)
+		}
+		statuses := []string{}
+		for _, step := range result.Steps {
+			statuses = append(statuses, step.Status)
+		}
+		if !reflect.DeepEqual(statuses, test.statuses) {
+			t.Errorf("%s: steps %v, expected %v", test.name, statuses, test.statuses)
+		}
+		if !reflect.DeepEqual(rolledBack, test.rolledBack) {
+			t.Errorf("%s: rolled back %v, expected %v", test.name, rolledBack, test.rolledBack)
+		}
+	}
+}
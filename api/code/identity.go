@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests proxied to a plugin carry a short lived assertion of who made
+// them, signed with an ed25519 key of the api. Plugins verify it with the
+// public key in PluginIdentityPubPath. The scopes of the assertion are the
+// capabilities of the plugin that the caller holds as well.
+//
+// The public key has a directory of its own, which plugin containers mount
+// read only. The private key stays in /state/api, which is never shared
+// with a plugin.
+//
+// The assertion is base64url(claims json) "." base64url(signature)
+
+const PluginIdentityHeader = "X-SPR-Identity"
+
+type PluginIdentity struct {
+	//name of the plugin the assertion is meant for
+	Plugin string
+	User   string
+	Role   string
+	Scopes []string
+	//unix seconds
+	Issued  int64
+	Expires int64
+}
+
+// PluginCaller is the authenticated caller of a request
+type PluginCaller struct {
+	User   string
+	Role   string
+	Scopes []string
+}
+
+var PluginIdentitymtx sync.Mutex
+var PluginIdentityKeyPath = TEST_PREFIX + "/state/api/plugin_identity.key"
+var PluginIdentityPubPath = TEST_PREFIX + "/state/api/plugin_identity/identity.pub"
+var PluginIdentityLifetime = time.Minute
+
+const RoleToken = "token"
+
+// guarded by PluginIdentitymtx
+var gPluginIdentityKey ed25519.PrivateKey
+
+type pluginCallerContextKey int
+
+const pluginCallerKey pluginCallerContextKey = 0
+
+func withPluginCaller(r *http.Request, caller PluginCaller) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pluginCallerKey, caller))
+}
+
+func pluginCaller(r *http.Request) (PluginCaller, bool) {
+	caller, ok := r.Context().Value(pluginCallerKey).(PluginCaller)
+	return caller, ok
+}
+
+func loadPluginIdentityKey() (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(PluginIdentityKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no key in %s", PluginIdentityKeyPath)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ed25519 key in %s", PluginIdentityKeyPath)
+	}
+	return key, nil
+}
+
+func generatePluginIdentityKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = writePEM(PluginIdentityKeyPath, "PRIVATE KEY", data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// initPluginIdentity loads or generates the signing key and publishes the
+// public key for plugins
+func initPluginIdentity() {
+	PluginIdentitymtx.Lock()
+	defer PluginIdentitymtx.Unlock()
+
+	key, err := loadPluginIdentityKey()
+	if err != nil {
+		fmt.Println("generating the plugin identity key")
+		key, err = generatePluginIdentityKey()
+		if err != nil {
+			fmt.Println("failed to generate the plugin identity key", err)
+			return
+		}
+	}
+
+	data, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(PluginIdentityPubPath), 0755)
+	}
+	if err == nil {
+		err = writePEM(PluginIdentityPubPath, "PUBLIC KEY", data, 0644)
+	}
+	if err != nil {
+		fmt.Println("failed to write the plugin identity public key", err)
+	}
+	gPluginIdentityKey = key
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, entry := range scopes {
+		if entry == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// grantScopes returns the capabilities of a plugin that the caller holds.
+// A write capability is reduced to read when the caller may only read
+func grantScopes(caller []string, capabilities []string) []string {
+	all := hasScope(caller, ScopeAll)
+	granted := map[string]bool{}
+	for _, capability := range capabilities {
+		if capability == ScopeAll {
+			for _, scope := range caller {
+				granted[scope] = true
+			}
+			continue
+		}
+
+		pieces := strings.Split(capability, ":")
+		if len(pieces) != 2 {
+			continue
+		}
+		resource := pieces[0]
+		if all || hasScope(caller, capability) || hasScope(caller, resource+":write") {
+			granted[capability] = true
+		} else if pieces[1] == "write" && hasScope(caller, resource+":read") {
+			granted[resource+":read"] = true
+		}
+	}
+
+	scopes := []string{}
+	for scope := range granted {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func signPluginIdentity(config PluginConfig, caller PluginCaller) (string, error) {
+	PluginIdentitymtx.Lock()
+	key := gPluginIdentityKey
+	PluginIdentitymtx.Unlock()
+	if key == nil {
+		return "", fmt.Errorf("no plugin identity key")
+	}
+
+	now := time.Now()
+	claims, err := json.Marshal(PluginIdentity{
+		Plugin:  config.Name,
+		User:    caller.User,
+		Role:    caller.Role,
+		Scopes:  grantScopes(caller.Scopes, config.Capabilities),
+		Issued:  now.Unix(),
+		Expires: now.Add(PluginIdentityLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	signature := ed25519.Sign(key, []byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// mayRead reports whether the caller may GET a route template. Viewers go by
+// viewerRoutes, everyone else by scopes as in authorizeToken
+func (caller PluginCaller) mayRead(template string) bool {
+	if hasScope(caller.Scopes, ScopeAll) {
+		return true
+	}
+	if caller.Role == RoleViewer {
+		return viewerAllowed(template, http.MethodGet)
+	}
+	resource := routeScopes[template]
+	return resource != "" && (hasScope(caller.Scopes, resource+":read") || hasScope(caller.Scopes, resource+":write"))
+}
+
+func accountCaller(account UserAccount) PluginCaller {
+	return PluginCaller{User: account.Name, Role: account.Role, Scopes: accountScopes(account)}
+}
+
+func tokenCaller(token APIToken) PluginCaller {
+	return PluginCaller{User: token.actorName(), Role: RoleToken, Scopes: token.Scopes}
+}
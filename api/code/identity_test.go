@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrantScopes(t *testing.T) {
+	tests := []struct {
+		name         string
+		caller       []string
+		capabilities []string
+		granted      []string
+	}{
+		{"admin", []string{ScopeAll}, []string{"devices:read", "zones:write"}, []string{"devices:read", "zones:write"}},
+		{"same scopes", []string{"devices:read", "zones:write"}, []string{"devices:read", "zones:write"}, []string{"devices:read", "zones:write"}},
+		{"write covers read", []string{"devices:write"}, []string{"devices:read"}, []string{"devices:read"}},
+		{"write reduced to read", []string{"zones:read"}, []string{"zones:write"}, []string{"zones:read"}},
+		{"not held", []string{"traffic:read"}, []string{"devices:read", "zones:write"}, []string{}},
+		{"plugin with all", []string{"devices:read", "quotas:write"}, []string{ScopeAll}, []string{"devices:read", "quotas:write"}},
+		{"both all", []string{ScopeAll}, []string{ScopeAll}, []string{ScopeAll}},
+		{"no capabilities", []string{ScopeAll}, []string{}, []string{}},
+		{"no scopes", []string{}, []string{"devices:read"}, []string{}},
+		{"malformed capability", []string{ScopeAll}, []string{"devices"}, []string{}},
+	}
+
+	for _, test := range tests {
+		granted := grantScopes(test.caller, test.capabilities)
+		if !reflect.DeepEqual(granted, test.granted) {
+			t.Errorf("%s: granted %v, expected %v", test.name, granted, test.granted)
+		}
+	}
+}
+
+func TestAccountCaller(t *testing.T) {
+	tests := []struct {
+		account UserAccount
+		granted []string
+	}{
+		{UserAccount{Name: "admin", Role: RoleAdmin}, []string{"devices:read", "zones:write"}},
+		{UserAccount{Name: "viewer", Role: RoleViewer}, []string{"devices:read"}},
+		{UserAccount{Name: "nobody"}, []string{}},
+	}
+
+	for _, test := range tests {
+		caller := accountCaller(test.account)
+		if caller.User != test.account.Name || caller.Role != test.account.Role {
+			t.Errorf("%s: unexpected caller %+v", test.account.Name, caller)
+		}
+		granted := grantScopes(caller.Scopes, []string{"devices:read", "zones:write"})
+		if !reflect.DeepEqual(granted, test.granted) {
+			t.Errorf("%s: granted %v, expected %v", test.account.Name, granted, test.granted)
+		}
+	}
+}
+
+func TestSignPluginIdentity(t *testing.T) {
+	PluginIdentityKeyPath = t.TempDir() + "/plugin_identity.key"
+	key, err := generatePluginIdentityKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gPluginIdentityKey = key
+
+	config := PluginConfig{Name: "sample_plugin", Capabilities: []string{"devices:read", "zones:write"}}
+	caller := tokenCaller(APIToken{Label: "ci", Scopes: []string{"zones:read"}})
+	assertion, err := signPluginIdentity(config, caller)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pieces := strings.Split(assertion, ".")
+	if len(pieces) != 2 {
+		t.Fatalf("malformed assertion %q", assertion)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(pieces[1])
+	if !ed25519.Verify(key.Public().(ed25519.PublicKey), []byte(pieces[0]), signature) {
+		t.Errorf("invalid signature")
+	}
+
+	claims, _ := base64.RawURLEncoding.DecodeString(pieces[0])
+	identity := PluginIdentity{}
+	err = json.Unmarshal(claims, &identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Plugin != "sample_plugin" || identity.User != caller.User || identity.Role != RoleToken {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+	if !reflect.DeepEqual(identity.Scopes, []string{"zones:read"}) {
+		t.Errorf("scopes %v, expected [zones:read]", identity.Scopes)
+	}
+	if time.Duration(identity.Expires-identity.Issued)*time.Second != PluginIdentityLifetime {
+		t.Errorf("lifetime %ds", identity.Expires-identity.Issued)
+	}
+
+	//the key is reloaded as generated
+	loaded, err := loadPluginIdentityKey()
+	if err != nil || !loaded.Equal(key) {
+		t.Errorf("failed to reload the key: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// The influx exporter writes the points of a collection cycle as one batch
+// from its own goroutine. Batches that can not be written, or that arrive
+// while the queue is full, are spooled to disk in line protocol and sent
+// ahead of the next batch once influx is reachable again.
+
+type InfluxHealth struct {
+	Enabled       bool
+	LastFlush     time.Time `json:",omitempty"`
+	LastError     string    `json:",omitempty"`
+	LastErrorTime time.Time `json:",omitempty"`
+	//batches waiting to be written
+	Queued int
+	//lines waiting on disk
+	Spooled int
+	//lines lost to a full spool
+	Dropped uint64
+}
+
+var InfluxSpoolPath = TEST_PREFIX + "/state/api/influx_spool.lp"
+var InfluxSpoolLimit = 500000
+var InfluxQueueSize = 8
+var InfluxWriteTimeout = 30 * time.Second
+var InfluxChunkSize = 5000
+
+type influxExporter struct {
+	writer  api.WriteAPIBlocking
+	batches chan []string
+
+	//guards health and overflow. The spool file is only touched by run
+	mtx      sync.Mutex
+	health   InfluxHealth
+	overflow []string
+}
+
+var gInflux *influxExporter
+
+func newInfluxExporter(config InfluxConfig) *influxExporter {
+	client := influxdb2.NewClient(config.URL, config.Token)
+	exporter := &influxExporter{
+		writer:  client.WriteAPIBlocking(config.Org, config.Bucket),
+		batches: make(chan []string, InfluxQueueSize),
+		health:  InfluxHealth{Enabled: true, Spooled: len(readSpool())},
+	}
+	go exporter.run()
+	return exporter
+}
+
+func readSpool() []string {
+	lines := []string{}
+	data, err := ioutil.ReadFile(InfluxSpoolPath)
+	if err != nil {
+		return lines
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Enqueue hands the points of a collection cycle to the exporter without
+// blocking the caller
+func (e *influxExporter) Enqueue(points []*write.Point) {
+	if len(points) == 0 {
+		return
+	}
+
+	lines := []string{}
+	for _, point := range points {
+		lines = append(lines, write.PointToLineProtocol(point, time.Nanosecond))
+	}
+
+	select {
+	case e.batches <- lines:
+	default:
+		//the writer is falling behind, the lines go out with the next batch
+		// or to the spool
+		e.mtx.Lock()
+		if e.health.Spooled+len(e.overflow)+len(lines) > InfluxSpoolLimit {
+			e.health.Dropped += uint64(len(lines))
+		} else {
+			e.overflow = append(e.overflow, lines...)
+		}
+		e.mtx.Unlock()
+	}
+}
+
+func (e *influxExporter) run() {
+	failing := false
+	for lines := range e.batches {
+		err := e.flush(lines)
+		if err != nil {
+			fmt.Println("influx write failed", err)
+			//only the start of an outage is reported to the ui
+			if !failing {
+				WSNotifyString("InfluxWriteFailed", err.Error())
+			}
+		}
+		failing = err != nil
+	}
+}
+
+// write sends the lines in chunks and returns the number of lines written
+// before a chunk failed
+func (e *influxExporter) write(lines []string) (int, error) {
+	for start := 0; start < len(lines); start += InfluxChunkSize {
+		end := start + InfluxChunkSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), InfluxWriteTimeout)
+		err := e.writer.WriteRecord(ctx, lines[start:end]...)
+		cancel()
+		if err != nil {
+			return start, err
+		}
+	}
+	return len(lines), nil
+}
+
+func (e *influxExporter) flush(lines []string) error {
+	e.mtx.Lock()
+	lines = append(e.overflow, lines...)
+	e.overflow = nil
+	e.mtx.Unlock()
+
+	//spooled lines are sent first to keep the points in order
+	spooled := readSpool()
+	written, err := e.write(append(spooled, lines...))
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if err == nil {
+		e.health.LastFlush = time.Now()
+		e.health.Spooled = 0
+		if len(spooled) > 0 {
+			os.Remove(InfluxSpoolPath)
+		}
+		return nil
+	}
+
+	e.health.LastError = err.Error()
+	e.health.LastErrorTime = time.Now()
+	//only the chunks that were not written are kept
+	e.spool(append(spooled, lines...)[written:])
+	return err
+}
+
+// spool replaces the spool file with the lines that are still to be written.
+// Lines beyond InfluxSpoolLimit are dropped, newest first
+func (e *influxExporter) spool(lines []string) {
+	if len(lines) > InfluxSpoolLimit {
+		e.health.Dropped += uint64(len(lines) - InfluxSpoolLimit)
+		lines = lines[:InfluxSpoolLimit]
+	}
+
+	err := writeSpool(lines)
+	if err != nil {
+		e.health.Dropped += uint64(len(lines))
+		e.health.Spooled = 0
+		fmt.Println("failed to spool influx points", err)
+		return
+	}
+	e.health.Spooled = len(lines)
+}
+
+func writeSpool(lines []string) error {
+	if len(lines) == 0 {
+		err := os.Remove(InfluxSpoolPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	//written aside and renamed, so that a crash leaves either spool intact
+	tmp := InfluxSpoolPath + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, InfluxSpoolPath)
+}
+
+func (e *influxExporter) Health() InfluxHealth {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	health := e.health
+	health.Queued = len(e.batches)
+	return health
+}
+
+// getClientZoneNames maps the mac of every client to its zones, joined by
+// commas for the influx zone tags
+func getClientZoneNames() map[string]string {
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	names := map[string][]string{}
+	for _, zone := range getZonesJson() {
+		for _, client := range zone.Clients {
+			mac := trimLower(client.Mac)
+			names[mac] = append(names[mac], zone.Name)
+		}
+	}
+
+	zones := map[string]string{}
+	for mac, entries := range names {
+		sort.Strings(entries)
+		zones[mac] = strings.Join(entries, ",")
+	}
+	return zones
+}
+
+func getInfluxHealth() InfluxHealth {
+	if gInflux == nil {
+		return InfluxHealth{}
+	}
+	return gInflux.Health()
+}
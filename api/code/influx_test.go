@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+import (
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// fakeInfluxWriter fails every chunk from the failAt-th call on
+type fakeInfluxWriter struct {
+	calls   int
+	failAt  int
+	written []string
+}
+
+func (f *fakeInfluxWriter) WriteRecord(ctx context.Context, line ...string) error {
+	f.calls++
+	if f.failAt > 0 && f.calls >= f.failAt {
+		return errors.New("influx unavailable")
+	}
+	f.written = append(f.written, line...)
+	return nil
+}
+
+func (f *fakeInfluxWriter) WritePoint(ctx context.Context, point ...*write.Point) error {
+	return errors.New("not implemented")
+}
+
+func TestInfluxFlush(t *testing.T) {
+	InfluxSpoolPath = t.TempDir() + "/influx_spool.lp"
+	InfluxChunkSize = 2
+	defer func() { InfluxChunkSize = 5000 }()
+
+	tests := []struct {
+		name    string
+		spooled []string
+		lines   []string
+		failAt  int
+		written []string
+		spool   []string
+	}{
+		{"written", []string{}, []string{"a", "b", "c"}, 0,
+			[]string{"a", "b", "c"}, []string{}},
+		{"spool first", []string{"a", "b"}, []string{"c"}, 0,
+			[]string{"a", "b", "c"}, []string{}},
+		{"all chunks fail", []string{}, []string{"a", "b", "c"}, 1,
+			nil, []string{"a", "b", "c"}},
+		{"only the remainder is spooled", []string{"a", "b"}, []string{"c", "d", "e"}, 2,
+			[]string{"a", "b"}, []string{"c", "d", "e"}},
+		{"last chunk fails", []string{"a"}, []string{"b", "c", "d"}, 2,
+			[]string{"a", "b"}, []string{"c", "d"}},
+	}
+
+	for _, test := range tests {
+		err := writeSpool(test.spooled)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writer := &fakeInfluxWriter{failAt: test.failAt}
+		exporter := &influxExporter{writer: writer, health: InfluxHealth{Spooled: len(test.spooled)}}
+		err = exporter.flush(test.lines)
+		if (err != nil) != (test.failAt > 0) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if !reflect.DeepEqual(writer.written, test.written) {
+			t.Errorf("%s: written %v, expected %v", test.name, writer.written, test.written)
+		}
+		spool := readSpool()
+		if !reflect.DeepEqual(spool, test.spool) {
+			t.Errorf("%s: spool %v, expected %v", test.name, spool, test.spool)
+		}
+		if exporter.Health().Spooled != len(test.spool) {
+			t.Errorf("%s: %d lines reported spooled, expected %d", test.name, exporter.Health().Spooled, len(test.spool))
+		}
+	}
+}
+
+func TestInfluxSpoolLimit(t *testing.T) {
+	InfluxSpoolPath = t.TempDir() + "/influx_spool.lp"
+	InfluxSpoolLimit = 3
+	defer func() { InfluxSpoolLimit = 500000 }()
+
+	exporter := &influxExporter{}
+	exporter.spool([]string{"a", "b", "c", "d", "e"})
+
+	if spool := readSpool(); !reflect.DeepEqual(spool, []string{"a", "b", "c"}) {
+		t.Errorf("spool %v", spool)
+	}
+	health := exporter.Health()
+	if health.Spooled != 3 || health.Dropped != 2 {
+		t.Errorf("%d spooled and %d dropped, expected 3 and 2", health.Spooled, health.Dropped)
+	}
+}
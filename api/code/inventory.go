@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// The device inventory keeps a record of every device by MAC: when it was
+// first and last seen through dhcpUpdate, its address, interface and DHCP
+// hostname, the vendor of its OUI, and the name, owner and tags users give
+// it. /devices merges the records into the devices of the zones and psks.
+
+type DeviceRecord struct {
+	Mac       string
+	FirstSeen time.Time `json:",omitempty"`
+	LastSeen  time.Time `json:",omitempty"`
+	LastIP    string    `json:",omitempty"`
+	Interface string    `json:",omitempty"`
+	//name the device sent in its DHCP request
+	Hostname string `json:",omitempty"`
+	//empty for unknown and locally administered (random) addresses
+	Vendor string `json:",omitempty"`
+
+	//assigned by users
+	Name  string   `json:",omitempty"`
+	Owner string   `json:",omitempty"`
+	Tags  []string `json:",omitempty"`
+}
+
+type DeviceMetadata struct {
+	Name  string
+	Owner string
+	Tags  []string
+}
+
+var Inventorymtx sync.Mutex
+var InventoryPath = TEST_PREFIX + "/state/api/devices.json"
+
+// IEEE registry from the ieee-data package, read once
+var OUIPath = "/usr/share/ieee-data/oui.txt"
+
+var MaxDeviceTags = 32
+var MaxDeviceFieldLength = 128
+
+var ouiOnce sync.Once
+var gOUIVendors = map[string]string{}
+
+// loadOUI reads lines of the form "00-00-0C   (hex)		Cisco Systems, Inc"
+func loadOUI() {
+	file, err := os.Open(OUIPath)
+	if err != nil {
+		fmt.Println("vendor lookup disabled, failed to open", OUIPath, err)
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		idx := strings.Index(line, "(hex)")
+		if idx == -1 {
+			continue
+		}
+		prefix := strings.ToLower(strings.Replace(strings.TrimSpace(line[:idx]), "-", ":", -1))
+		vendor := strings.TrimSpace(line[idx+len("(hex)"):])
+		if len(prefix) == 8 && vendor != "" {
+			gOUIVendors[prefix] = vendor
+		}
+	}
+}
+
+func lookupVendor(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) < 3 {
+		return ""
+	}
+	//locally administered, such as randomized wifi addresses
+	if hw[0]&0x02 != 0 {
+		return ""
+	}
+	ouiOnce.Do(loadOUI)
+	return gOUIVendors[strings.ToLower(hw.String()[:8])]
+}
+
+// normalizeMAC returns the lower case, colon separated form of a MAC
+func normalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(mac))
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("invalid mac %q", mac)
+	}
+	return hw.String(), nil
+}
+
+func loadInventory() map[string]DeviceRecord {
+	records := map[string]DeviceRecord{}
+	data, err := ioutil.ReadFile(InventoryPath)
+	if err != nil {
+		return records
+	}
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		fmt.Println("failed to load device inventory", err)
+	}
+	return records
+}
+
+func saveInventory(records map[string]DeviceRecord) error {
+	file, _ := json.MarshalIndent(records, "", " ")
+	return ioutil.WriteFile(InventoryPath, file, 0644)
+}
+
+// the name dhcp_helper.sh sends for clients without a hostname
+const DHCPMissingName = "DefaultMissingName"
+
+// recordDeviceSeen updates the inventory from a DHCP update. The address
+// and hostname are only replaced when the update has them
+func recordDeviceSeen(mac string, ip string, iface string, hostname string) {
+	if hostname == DHCPMissingName {
+		hostname = ""
+	}
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return
+	}
+
+	Inventorymtx.Lock()
+	records := loadInventory()
+	now := time.Now()
+	record, exists := records[mac]
+	if !exists {
+		record = DeviceRecord{Mac: mac, FirstSeen: now, Vendor: lookupVendor(mac)}
+	}
+	record.LastSeen = now
+	if ip != "" {
+		record.LastIP = ip
+	}
+	if iface != "" {
+		record.Interface = iface
+	}
+	if hostname != "" {
+		record.Hostname = hostname
+	}
+	records[mac] = record
+	err = saveInventory(records)
+	Inventorymtx.Unlock()
+
+	if err != nil {
+		fmt.Println("failed to save device inventory", mac, err)
+	}
+	if !exists {
+		WSNotifyValue("DeviceDiscovered", record)
+	}
+}
+
+// mergeInventory adds the inventory to the devices of the zones and psks,
+// and the devices only the inventory knows
+func mergeInventory(devices map[string]Device) {
+	Inventorymtx.Lock()
+	records := loadInventory()
+	Inventorymtx.Unlock()
+
+	for mac, record := range records {
+		device, exists := devices[mac]
+		if !exists {
+			device = Device{Mac: mac, Zones: []string{}}
+		}
+		device.FirstSeen = record.FirstSeen
+		device.LastSeen = record.LastSeen
+		device.LastIP = record.LastIP
+		device.Interface = record.Interface
+		device.Hostname = record.Hostname
+		device.Vendor = record.Vendor
+		device.Name = record.Name
+		device.Owner = record.Owner
+		device.Tags = record.Tags
+		devices[mac] = device
+	}
+}
+
+func validateDeviceMetadata(metadata DeviceMetadata) (DeviceMetadata, error) {
+	metadata.Name = strings.TrimSpace(metadata.Name)
+	metadata.Owner = strings.TrimSpace(metadata.Owner)
+	if len(metadata.Name) > MaxDeviceFieldLength || len(metadata.Owner) > MaxDeviceFieldLength {
+		return metadata, fmt.Errorf("name and owner are limited to %d characters", MaxDeviceFieldLength)
+	}
+
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range metadata.Tags {
+		tag = trimLower(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > MaxDeviceFieldLength {
+			return metadata, fmt.Errorf("tags are limited to %d characters", MaxDeviceFieldLength)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > MaxDeviceTags {
+		return metadata, fmt.Errorf("a device has at most %d tags", MaxDeviceTags)
+	}
+	sort.Strings(tags)
+	metadata.Tags = tags
+	return metadata, nil
+}
+
+func getDevice(w http.ResponseWriter, r *http.Request) {
+	mac, err := normalizeMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	Inventorymtx.Lock()
+	record, exists := loadInventory()[mac]
+	Inventorymtx.Unlock()
+	if !exists {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
+// modifyDevice sets the metadata of a device (PUT), adding it to the
+// inventory as needed, or forgets the device (DELETE). Zones and psks of
+// the device are left as they are
+func modifyDevice(w http.ResponseWriter, r *http.Request) {
+	mac, err := normalizeMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	metadata := DeviceMetadata{}
+	if r.Method == http.MethodPut {
+		err = json.NewDecoder(r.Body).Decode(&metadata)
+		if err == nil {
+			metadata, err = validateDeviceMetadata(metadata)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	Inventorymtx.Lock()
+	defer Inventorymtx.Unlock()
+
+	records := loadInventory()
+	record, exists := records[mac]
+
+	if r.Method == http.MethodDelete {
+		if !exists {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		auditChange(r, record, nil)
+		delete(records, mac)
+	} else {
+		before := record
+		if !exists {
+			record = DeviceRecord{Mac: mac, Vendor: lookupVendor(mac)}
+		}
+		record.Name = metadata.Name
+		record.Owner = metadata.Owner
+		record.Tags = metadata.Tags
+		if exists {
+			auditChange(r, before, record)
+		} else {
+			auditChange(r, nil, record)
+		}
+		records[mac] = record
+	}
+
+	err = saveInventory(records)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodDelete {
+		json.NewEncoder(w).Encode(true)
+		return
+	}
+	json.NewEncoder(w).Encode(record)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLookupVendor(t *testing.T) {
+	OUIPath = t.TempDir() + "/oui.txt"
+	ioutil.WriteFile(OUIPath, []byte(strings.Join([]string{
+		"OUI/MA-L                                                    Organization",
+		"company_id                                                  Organization",
+		"",
+		"00-00-0C   (hex)\t\tCisco Systems, Inc",
+		"00000C     (base 16)\t\tCisco Systems, Inc",
+		"\t\t\t\t170 WEST TASMAN DRIVE",
+		"",
+		"A4-83-E7   (hex)\t\tApple, Inc.",
+		"12-34-56   (hex)\t\t",
+	}, "\n")), 0644)
+	ouiOnce = sync.Once{}
+	gOUIVendors = map[string]string{}
+
+	tests := []struct {
+		mac    string
+		vendor string
+	}{
+		{"00:00:0c:12:34:56", "Cisco Systems, Inc"},
+		{"A4:83:E7:00:00:01", "Apple, Inc."},
+		{"a4-83-e7-00-00-01", "Apple, Inc."},
+		{"00:11:22:33:44:55", ""},
+		//locally administered
+		{"a6:83:e7:00:00:01", ""},
+		{"12:34:56:00:00:01", ""},
+		{"invalid", ""},
+	}
+
+	for _, test := range tests {
+		if vendor := lookupVendor(test.mac); vendor != test.vendor {
+			t.Errorf("lookupVendor(%q) = %q, expected %q", test.mac, vendor, test.vendor)
+		}
+	}
+}
+
+func TestValidateDeviceMetadata(t *testing.T) {
+	tooMany := []string{}
+	for i := 0; i <= MaxDeviceTags; i++ {
+		tooMany = append(tooMany, "tag"+strings.Repeat("x", i))
+	}
+
+	tests := []struct {
+		name     string
+		metadata DeviceMetadata
+		expected DeviceMetadata
+		valid    bool
+	}{
+		{"trimmed", DeviceMetadata{" Laptop ", " Alice ", nil}, DeviceMetadata{"Laptop", "Alice", []string{}}, true},
+		{"tags", DeviceMetadata{"", "", []string{"Work", " iot", "work", ""}}, DeviceMetadata{"", "", []string{"iot", "work"}}, true},
+		{"long name", DeviceMetadata{strings.Repeat("a", MaxDeviceFieldLength+1), "", nil}, DeviceMetadata{}, false},
+		{"long owner", DeviceMetadata{"", strings.Repeat("a", MaxDeviceFieldLength+1), nil}, DeviceMetadata{}, false},
+		{"long tag", DeviceMetadata{"", "", []string{strings.Repeat("a", MaxDeviceFieldLength+1)}}, DeviceMetadata{}, false},
+		{"too many tags", DeviceMetadata{"", "", tooMany}, DeviceMetadata{}, false},
+	}
+
+	for _, test := range tests {
+		metadata, err := validateDeviceMetadata(test.metadata)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(metadata, test.expected) {
+			t.Errorf("%s: got %+v, expected %+v", test.name, metadata, test.expected)
+		}
+	}
+}
+
+func TestRecordDeviceSeen(t *testing.T) {
+	InventoryPath = t.TempDir() + "/devices.json"
+	OUIPath = t.TempDir() + "/oui.txt"
+	ioutil.WriteFile(OUIPath, []byte("A4-83-E7   (hex)\t\tApple, Inc.\n"), 0644)
+	ouiOnce = sync.Once{}
+	gOUIVendors = map[string]string{}
+
+	recordDeviceSeen("A4:83:E7:00:00:01", "192.168.2.10", "wlan0", "laptop")
+	first := loadInventory()["a4:83:e7:00:00:01"]
+	if first.FirstSeen.IsZero() || first.Vendor != "Apple, Inc." || first.LastIP != "192.168.2.10" {
+		t.Fatalf("unexpected record %+v", first)
+	}
+
+	//an update without an address or hostname keeps them
+	recordDeviceSeen("a4:83:e7:00:00:01", "", "wlan1", DHCPMissingName)
+	record := loadInventory()["a4:83:e7:00:00:01"]
+	if !record.FirstSeen.Equal(first.FirstSeen) || record.LastSeen.Before(first.LastSeen) {
+		t.Errorf("seen times %v %v, expected first %v", record.FirstSeen, record.LastSeen, first.FirstSeen)
+	}
+	if record.LastIP != "192.168.2.10" || record.Hostname != "laptop" || record.Interface != "wlan1" {
+		t.Errorf("unexpected record %+v", record)
+	}
+
+	//invalid addresses are not recorded
+	recordDeviceSeen("aa:bb", "192.168.2.11", "wlan0", "")
+	if records := loadInventory(); len(records) != 1 {
+		t.Errorf("%d records, expected 1", len(records))
+	}
+}
+
+func TestMergeInventory(t *testing.T) {
+	InventoryPath = t.TempDir() + "/devices.json"
+	saveInventory(map[string]DeviceRecord{
+		"aa:bb:cc:dd:ee:ff": {Mac: "aa:bb:cc:dd:ee:ff", LastIP: "192.168.2.10", Name: "laptop", Tags: []string{"work"}},
+		"11:22:33:44:55:66": {Mac: "11:22:33:44:55:66", Hostname: "printer"},
+	})
+
+	devices := map[string]Device{
+		"aa:bb:cc:dd:ee:ff": {Mac: "aa:bb:cc:dd:ee:ff", PskType: "sae", Zones: []string{"lan"}},
+	}
+	mergeInventory(devices)
+
+	known := devices["aa:bb:cc:dd:ee:ff"]
+	if known.PskType != "sae" || known.Name != "laptop" || known.LastIP != "192.168.2.10" || !reflect.DeepEqual(known.Zones, []string{"lan"}) {
+		t.Errorf("unexpected device %+v", known)
+	}
+	seen, exists := devices["11:22:33:44:55:66"]
+	if !exists || seen.Hostname != "printer" || seen.Zones == nil {
+		t.Errorf("unexpected inventory only device %+v", seen)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Failed logins are counted per source address and per username, so that
+// guessing the password of a user from many addresses locks the user out as
+// well. Past LockoutThreshold failures every further failure locks the key
+// out for twice as long as the one before, up to LockoutMaxDelay.
+
+type LoginLockout struct {
+	//ip:{address} or user:{name}
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time `json:",omitempty"`
+}
+
+var Lockoutmtx sync.Mutex
+
+var LockoutThreshold = 5
+var LockoutBaseDelay = 2 * time.Second
+var LockoutMaxDelay = 15 * time.Minute
+
+// counters are forgotten this long after the last failure
+var LockoutResetAfter = time.Hour
+
+// guarded by Lockoutmtx
+var gLoginFailures = map[string]*LoginLockout{}
+
+func lockoutKeys(source string, username string) []string {
+	keys := []string{"ip:" + source}
+	if username != "" {
+		keys = append(keys, "user:"+username)
+	}
+	return keys
+}
+
+func lockoutDelay(failures int) time.Duration {
+	delay := LockoutBaseDelay
+	for i := LockoutThreshold; i < failures && delay < LockoutMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > LockoutMaxDelay {
+		delay = LockoutMaxDelay
+	}
+	return delay
+}
+
+// pruneLoginFailures drops counters that expired, the caller holds Lockoutmtx
+func pruneLoginFailures(now time.Time) {
+	for key, entry := range gLoginFailures {
+		if now.Sub(entry.LastFailure) > LockoutResetAfter && now.After(entry.LockedUntil) {
+			delete(gLoginFailures, key)
+		}
+	}
+}
+
+// loginLocked returns how long a login from the source or for the username
+// has to wait
+func loginLocked(source string, username string) (time.Duration, bool) {
+	Lockoutmtx.Lock()
+	defer Lockoutmtx.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(0)
+	for _, key := range lockoutKeys(source, username) {
+		entry, exists := gLoginFailures[key]
+		if exists && now.Before(entry.LockedUntil) && entry.LockedUntil.Sub(now) > wait {
+			wait = entry.LockedUntil.Sub(now)
+		}
+	}
+	return wait, wait > 0
+}
+
+func recordLoginFailure(source string, username string) {
+	Lockoutmtx.Lock()
+	now := time.Now()
+	pruneLoginFailures(now)
+
+	locked := []LoginLockout{}
+	for _, key := range lockoutKeys(source, username) {
+		entry, exists := gLoginFailures[key]
+		if !exists {
+			entry = &LoginLockout{Key: key}
+			gLoginFailures[key] = entry
+		}
+		entry.Failures++
+		entry.LastFailure = now
+		if entry.Failures >= LockoutThreshold {
+			entry.LockedUntil = now.Add(lockoutDelay(entry.Failures))
+			locked = append(locked, *entry)
+		}
+	}
+	Lockoutmtx.Unlock()
+
+	for _, entry := range locked {
+		reportLockout(source, entry)
+	}
+}
+
+func clearLoginFailures(source string, username string) {
+	Lockoutmtx.Lock()
+	defer Lockoutmtx.Unlock()
+
+	for _, key := range lockoutKeys(source, username) {
+		delete(gLoginFailures, key)
+	}
+}
+
+func reportLockout(source string, entry LoginLockout) {
+	fmt.Println("login locked out", entry.Key, "until", entry.LockedUntil)
+
+	err := appendAudit(AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  "api",
+		Source: source,
+		Action: "LOCKOUT",
+		Path:   entry.Key,
+		After:  auditValue(entry),
+		Status: http.StatusTooManyRequests,
+		Result: "locked out until " + entry.LockedUntil.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		fmt.Println("failed to write audit log", err)
+	}
+	WSNotifyValue("LoginLockout", entry)
+}
+
+func lockedOut(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(wait.Seconds()) + 1
+	w.Header().Set("Retry-After", fmt.Sprint(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed logins, retry in %d seconds", seconds), http.StatusTooManyRequests)
+}
+
+func getLockouts(w http.ResponseWriter, r *http.Request) {
+	Lockoutmtx.Lock()
+	pruneLoginFailures(time.Now())
+	entries := []LoginLockout{}
+	for _, entry := range gLoginFailures {
+		entries = append(entries, *entry)
+	}
+	Lockoutmtx.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// deleteLockouts clears every counter, or the counter of one ip or user
+func deleteLockouts(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	Lockoutmtx.Lock()
+	defer Lockoutmtx.Unlock()
+
+	if vars["kind"] == "" {
+		gLoginFailures = map[string]*LoginLockout{}
+		json.NewEncoder(w).Encode(true)
+		return
+	}
+
+	if vars["kind"] != "ip" && vars["kind"] != "user" {
+		http.Error(w, "expected ip or user", 400)
+		return
+	}
+
+	key := vars["kind"] + ":" + strings.TrimSpace(vars["name"])
+	if _, exists := gLoginFailures[key]; !exists {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	delete(gLoginFailures, key)
+	json.NewEncoder(w).Encode(true)
+}
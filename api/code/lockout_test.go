@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{1, 2 * time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{13, 512 * time.Second},
+		{14, 15 * time.Minute},
+		{100, 15 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if delay := lockoutDelay(test.failures); delay != test.delay {
+			t.Errorf("lockoutDelay(%d) = %v, expected %v", test.failures, delay, test.delay)
+		}
+	}
+}
+
+func TestLoginLocked(t *testing.T) {
+	AuditLogPath = t.TempDir() + "/audit.log"
+	AuditAnchorPath = t.TempDir() + "/audit.anchor"
+
+	tests := []struct {
+		name     string
+		source   string
+		username string
+		locked   bool
+	}{
+		{"attacker", "10.0.0.66", "admin", true},
+		{"attacker as another user", "10.0.0.66", "alice", true},
+		{"attacker without a user", "10.0.0.66", "", true},
+		{"user from another address", "10.0.0.2", "admin", true},
+		{"another address", "10.0.0.2", "", false},
+	}
+
+	gLoginFailures = map[string]*LoginLockout{}
+	for i := 0; i < LockoutThreshold; i++ {
+		recordLoginFailure("10.0.0.66", "admin")
+	}
+
+	for _, test := range tests {
+		if _, locked := loginLocked(test.source, test.username); locked != test.locked {
+			t.Errorf("%s: expected locked %v", test.name, test.locked)
+		}
+	}
+
+	clearLoginFailures("10.0.0.66", "admin")
+	if _, locked := loginLocked("10.0.0.66", "admin"); locked {
+		t.Errorf("still locked after a successful login")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics served on /metrics. Counters that live in the kernel
+// or in hostapd are read when the endpoint is scraped, the api's own events
+// are counted as they happen.
+
+var (
+	metricDHCPUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spr_dhcp_updates_total",
+		Help: "DHCP updates processed by the api",
+	}, []string{"family", "status"})
+
+	metricDHCPUpdateSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spr_dhcp_update_duration_seconds",
+		Help:    "Time taken to apply a DHCP update",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"family"})
+
+	metricPSKAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spr_psk_auth_failures_total",
+		Help: "PSK authentication failures reported by hostapd",
+	}, []string{"type", "reason"})
+
+	metricWSClients = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "spr_websocket_clients",
+		Help: "Connected websocket clients",
+	}, func() float64 {
+		WSMtx.Lock()
+		defer WSMtx.Unlock()
+		return float64(len(WSClients))
+	})
+
+	metricWSConnections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "spr_websocket_connections_total",
+		Help: "Websocket clients that authenticated",
+	})
+
+	metricWSClientsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spr_websocket_clients_dropped_total",
+		Help: "Websocket clients dropped for a full queue or a failed write",
+	}, []string{"reason"})
+
+	metricWSEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "spr_websocket_events_total",
+		Help: "Events published to the websocket broadcaster",
+	})
+
+	metricWSEventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "spr_websocket_events_dropped_total",
+		Help: "Events dropped because the websocket broadcaster fell behind",
+	})
+)
+
+func observeDHCPUpdate(family string, status string, started time.Time) {
+	metricDHCPUpdates.WithLabelValues(family, status).Inc()
+	metricDHCPUpdateSeconds.WithLabelValues(family).Observe(time.Since(started).Seconds())
+}
+
+type sprCollector struct {
+	deviceBytes    *prometheus.Desc
+	devicePackets  *prometheus.Desc
+	stationSignal  *prometheus.Desc
+	stationRxBytes *prometheus.Desc
+	stationTxBytes *prometheus.Desc
+	vmapElements   *prometheus.Desc
+}
+
+func newSPRCollector() *sprCollector {
+	deviceLabels := []string{"mac", "comment", "scope", "direction"}
+	stationLabels := []string{"mac", "comment"}
+	return &sprCollector{
+		deviceBytes:    prometheus.NewDesc("spr_device_bytes_total", "Bytes counted by the accounting sets", deviceLabels, nil),
+		devicePackets:  prometheus.NewDesc("spr_device_packets_total", "Packets counted by the accounting sets", deviceLabels, nil),
+		stationSignal:  prometheus.NewDesc("spr_station_signal_dbm", "Signal of a wireless station", stationLabels, nil),
+		stationRxBytes: prometheus.NewDesc("spr_station_rx_bytes_total", "Bytes received from a wireless station", stationLabels, nil),
+		stationTxBytes: prometheus.NewDesc("spr_station_tx_bytes_total", "Bytes sent to a wireless station", stationLabels, nil),
+		vmapElements:   prometheus.NewDesc("spr_verdict_map_elements", "Elements in a verdict map", []string{"map"}, nil),
+	}
+}
+
+func (c *sprCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.deviceBytes
+	ch <- c.devicePackets
+	ch <- c.stationSignal
+	ch <- c.stationRxBytes
+	ch <- c.stationTxBytes
+	ch <- c.vmapElements
+}
+
+func (c *sprCollector) Collect(ch chan<- prometheus.Metric) {
+	comments := getClientComments()
+	c.collectDevices(ch, comments)
+	c.collectStations(ch, comments)
+	c.collectVerdictMaps(ch)
+}
+
+// getClientComments returns the comment of every client in zones.json
+func getClientComments() map[string]string {
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	comments := map[string]string{}
+	for _, zone := range getZonesJson() {
+		for _, client := range zone.Clients {
+			mac := trimLower(client.Mac)
+			if comments[mac] == "" {
+				comments[mac] = client.Comment
+			}
+		}
+	}
+	return comments
+}
+
+// getAddressMACs maps the addresses of the clients to their mac, from the
+// saved bindings and the arp table
+func getAddressMACs() map[string]string {
+	macs := map[string]string{}
+	for mac, binding := range loadBindings() {
+		for _, addr := range binding.addrs() {
+			macs[addr] = mac
+		}
+	}
+
+	entries, err := GetArpEntries()
+	if err == nil {
+		for _, entry := range entries {
+			if entry.Mac != "00:00:00:00:00:00" {
+				macs[entry.IP] = trimLower(entry.Mac)
+			}
+		}
+	}
+	return macs
+}
+
+func (c *sprCollector) collectDevices(ch chan<- prometheus.Metric, comments map[string]string) {
+	macs := getAddressMACs()
+
+	sets := []struct {
+		name      string
+		scope     string
+		direction string
+	}{
+		{"incoming_traffic_lan", "lan", "in"},
+		{"outgoing_traffic_lan", "lan", "out"},
+		{"incoming_traffic_wan", "wan", "in"},
+		{"outgoing_traffic_wan", "wan", "out"},
+	}
+
+	for _, set := range sets {
+		bytes := map[string]uint64{}
+		packets := map[string]uint64{}
+		for _, entry := range getDeviceTrafficSet(set.name) {
+			//addresses of unknown devices are labeled by themselves
+			mac, exists := macs[entry.IP]
+			if !exists {
+				mac = entry.IP
+			}
+			bytes[mac] += entry.Bytes
+			packets[mac] += entry.Packets
+		}
+
+		for mac := range bytes {
+			ch <- prometheus.MustNewConstMetric(c.deviceBytes, prometheus.CounterValue, float64(bytes[mac]), mac, comments[mac], set.scope, set.direction)
+			ch <- prometheus.MustNewConstMetric(c.devicePackets, prometheus.CounterValue, float64(packets[mac]), mac, comments[mac], set.scope, set.direction)
+		}
+	}
+}
+
+func (c *sprCollector) collectStations(ch chan<- prometheus.Metric, comments map[string]string) {
+	stations, err := RunHostapdAllStations()
+	if err != nil {
+		return
+	}
+
+	for station, values := range stations {
+		mac := trimLower(station)
+		metrics := []struct {
+			desc      *prometheus.Desc
+			valueType prometheus.ValueType
+			key       string
+		}{
+			{c.stationSignal, prometheus.GaugeValue, "signal"},
+			{c.stationRxBytes, prometheus.CounterValue, "rx_bytes"},
+			{c.stationTxBytes, prometheus.CounterValue, "tx_bytes"},
+		}
+		for _, metric := range metrics {
+			value, err := strconv.ParseFloat(strings.TrimSpace(values[metric.key]), 64)
+			if err == nil {
+				ch <- prometheus.MustNewConstMetric(metric.desc, metric.valueType, value, mac, comments[mac])
+			}
+		}
+	}
+}
+
+func (c *sprCollector) collectVerdictMaps(ch chan<- prometheus.Metric) {
+	batch, err := NewNFTBatch()
+	if err != nil {
+		return
+	}
+
+	Zonesmtx.Lock()
+	names := getVerdictMapNames()
+	Zonesmtx.Unlock()
+
+	for _, name := range append([]string{"dhcp_access"}, names...) {
+		entries, err := batch.ListVerdictMap(name)
+		if err != nil {
+			if !errors.Is(err, ErrNFTMapNotFound) {
+				ch <- prometheus.NewInvalidMetric(c.vmapElements, err)
+			}
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.vmapElements, prometheus.GaugeValue, float64(len(entries)), name)
+	}
+}
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func initMetrics() {
+	metricsRegistry.MustRegister(
+		metricDHCPUpdates,
+		metricDHCPUpdateSeconds,
+		metricPSKAuthFailures,
+		metricWSClients,
+		metricWSConnections,
+		metricWSClientsDropped,
+		metricWSEvents,
+		metricWSEventsDropped,
+		newSPRCollector(),
+	)
+}
+
+var metricsHandler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
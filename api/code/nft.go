@@ -0,0 +1,704 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Verdict maps in the inet filter table are managed over netlink.
+// Changes are queued on an NFTBatch and sent to the kernel as a single
+// transaction by Commit, so a failure never leaves a client half updated.
+
+var (
+	ErrNFTMapNotFound    = errors.New("map not found")
+	ErrNFTInvalidElement = errors.New("invalid map element")
+)
+
+type NFTError struct {
+	Op  string
+	Map string
+	Err error
+}
+
+func (e *NFTError) Error() string {
+	if e.Map == "" {
+		return "nftables " + e.Op + ": " + e.Err.Error()
+	}
+	return "nftables " + e.Op + " " + e.Map + ": " + e.Err.Error()
+}
+
+func (e *NFTError) Unwrap() error {
+	return e.Err
+}
+
+var nftFilterTable = &nftables.Table{Family: nftables.TableFamilyINet, Name: "filter"}
+
+// key layouts of the verdict maps created by nft_rules.sh and addCustomVerdict
+var (
+	dhcpAccessKey = []nftables.SetDatatype{nftables.TypeIFName, nftables.TypeEtherAddr}
+	dstAccessKey  = []nftables.SetDatatype{nftables.TypeIPAddr, nftables.TypeIFName}
+	macAccessKey  = []nftables.SetDatatype{nftables.TypeIPAddr, nftables.TypeIFName, nftables.TypeEtherAddr}
+	portAccessKey = []nftables.SetDatatype{nftables.TypeIPAddr, nftables.TypeIFName, nftables.TypeInetProto, nftables.TypeInetService}
+)
+
+// the ipv6 counterpart of every address keyed map carries a 6 suffix,
+// internet_access6, {zone}_dst_access6 and so on
+func isIPv6Map(map_name string) bool {
+	return strings.HasSuffix(map_name, "_access6")
+}
+
+func ipv4MapName(map_name string) string {
+	if isIPv6Map(map_name) {
+		return strings.TrimSuffix(map_name, "6")
+	}
+	return map_name
+}
+
+func verdictMapKey(map_name string) []nftables.SetDatatype {
+	layout := macAccessKey
+	name := ipv4MapName(map_name)
+	if name == "dhcp_access" {
+		return dhcpAccessKey
+	} else if strings.HasSuffix(name, "_port_dst_access") {
+		layout = portAccessKey
+	} else if strings.HasSuffix(name, "_dst_access") {
+		layout = dstAccessKey
+	}
+
+	if !isIPv6Map(map_name) {
+		return layout
+	}
+
+	layout6 := []nftables.SetDatatype{}
+	for _, t := range layout {
+		if t.Name == nftables.TypeIPAddr.Name {
+			t = nftables.TypeIP6Addr
+		}
+		layout6 = append(layout6, t)
+	}
+	return layout6
+}
+
+// nftFamily describes where the addresses of a family are found in the
+// network header and how they line up with the registers of a concatenated key
+type nftFamily struct {
+	suffix   string
+	nfproto  byte
+	addrLen  uint32
+	saddrOff uint32
+	daddrOff uint32
+}
+
+var (
+	nftIPv4 = nftFamily{"", unix.NFPROTO_IPV4, 4, 12, 16}
+	nftIPv6 = nftFamily{"6", unix.NFPROTO_IPV6, 16, 8, 24}
+)
+
+// reg returns the 32 bit register of a key field that starts at offset
+func (f nftFamily) reg(offset uint32) uint32 {
+	return unix.NFT_REG32_00 + offset/4
+}
+
+// concatenated key fields are padded to the 4 byte register size
+func nftPad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func encodeVerdictKey(layout []nftables.SetDatatype, entry verdictEntry) ([]byte, error) {
+	key := []byte{}
+	for _, t := range layout {
+		switch t.Name {
+		case nftables.TypeIPAddr.Name:
+			ip := net.ParseIP(entry.ip).To4()
+			if ip == nil {
+				return nil, ErrNFTInvalidElement
+			}
+			key = append(key, ip...)
+		case nftables.TypeIP6Addr.Name:
+			ip := net.ParseIP(entry.ip)
+			if ip == nil || ip.To4() != nil {
+				return nil, ErrNFTInvalidElement
+			}
+			key = append(key, ip.To16()...)
+		case nftables.TypeIFName.Name:
+			if entry.ifname == "" || len(entry.ifname) >= int(t.Bytes) {
+				return nil, ErrNFTInvalidElement
+			}
+			name := make([]byte, t.Bytes)
+			copy(name, entry.ifname)
+			key = append(key, name...)
+		case nftables.TypeEtherAddr.Name:
+			mac, err := net.ParseMAC(entry.mac)
+			if err != nil || len(mac) != int(t.Bytes) {
+				return nil, ErrNFTInvalidElement
+			}
+			key = append(key, mac...)
+		case nftables.TypeInetProto.Name:
+			if entry.proto == 0 {
+				return nil, ErrNFTInvalidElement
+			}
+			key = append(key, entry.proto)
+		case nftables.TypeInetService.Name:
+			if entry.port == 0 {
+				return nil, ErrNFTInvalidElement
+			}
+			key = append(key, binaryutil.BigEndian.PutUint16(entry.port)...)
+		}
+		key = nftPad(key)
+	}
+	return key, nil
+}
+
+func decodeVerdictKey(layout []nftables.SetDatatype, key []byte) (verdictEntry, error) {
+	entry := verdictEntry{}
+	offset := 0
+	for _, t := range layout {
+		size := len(nftPad(make([]byte, t.Bytes)))
+		if offset+size > len(key) {
+			return entry, ErrNFTInvalidElement
+		}
+		field := key[offset : offset+int(t.Bytes)]
+		switch t.Name {
+		case nftables.TypeIPAddr.Name, nftables.TypeIP6Addr.Name:
+			entry.ip = net.IP(field).String()
+		case nftables.TypeIFName.Name:
+			entry.ifname = strings.TrimRight(string(field), "\x00")
+		case nftables.TypeEtherAddr.Name:
+			entry.mac = net.HardwareAddr(field).String()
+		case nftables.TypeInetProto.Name:
+			entry.proto = field[0]
+		case nftables.TypeInetService.Name:
+			entry.port = binaryutil.BigEndian.Uint16(field)
+		}
+		offset += size
+	}
+	return entry, nil
+}
+
+type nftElement struct {
+	Map     string
+	Entry   verdictEntry
+	Verdict expr.VerdictKind
+}
+
+// nftChange records an element touched by a batch, with whether it was in
+// its map before the batch and whether it is after the batch
+type nftChange struct {
+	element nftElement
+	existed bool
+	present bool
+}
+
+type nftElementKey struct {
+	Map   string
+	Entry verdictEntry
+}
+
+type NFTBatch struct {
+	conn *nftables.Conn
+	sets map[string]*nftables.Set
+
+	//journal of element changes, used by Revert
+	changes []*nftChange
+	changed map[nftElementKey]*nftChange
+	//entries of the touched maps before the batch
+	before map[string]map[verdictEntry]bool
+}
+
+func NewNFTBatch() (*NFTBatch, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, &NFTError{Op: "connect", Err: err}
+	}
+	return &NFTBatch{
+		conn:    conn,
+		sets:    map[string]*nftables.Set{},
+		changed: map[nftElementKey]*nftChange{},
+		before:  map[string]map[verdictEntry]bool{},
+	}, nil
+}
+
+func (b *NFTBatch) getSet(map_name string) (*nftables.Set, error) {
+	set, exists := b.sets[map_name]
+	if exists {
+		return set, nil
+	}
+
+	set, err := b.conn.GetSetByName(nftFilterTable, map_name)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			err = ErrNFTMapNotFound
+		}
+		return nil, &NFTError{Op: "get map", Map: map_name, Err: err}
+	}
+
+	b.sets[map_name] = set
+	return set, nil
+}
+
+func (b *NFTBatch) HasSet(name string) (bool, error) {
+	_, err := b.getSet(name)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, ErrNFTMapNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// AddMarkerSet adds an empty set that only serves to detect a recreated table
+func (b *NFTBatch) AddMarkerSet(name string) error {
+	set := &nftables.Set{
+		Table:   nftFilterTable,
+		Name:    name,
+		KeyType: nftables.TypeInteger,
+	}
+
+	err := b.conn.AddSet(set, nil)
+	if err != nil {
+		return &NFTError{Op: "add set", Map: name, Err: err}
+	}
+	b.sets[name] = set
+	return nil
+}
+
+func (b *NFTBatch) ListVerdictMap(map_name string) ([]verdictEntry, error) {
+	set, err := b.getSet(map_name)
+	if err != nil {
+		return nil, err
+	}
+
+	elements, err := b.conn.GetSetElements(set)
+	if err != nil {
+		return nil, &NFTError{Op: "list map", Map: map_name, Err: err}
+	}
+
+	layout := verdictMapKey(map_name)
+	entries := []verdictEntry{}
+	for _, element := range elements {
+		entry, err := decodeVerdictKey(layout, element.Key)
+		if err != nil {
+			return nil, &NFTError{Op: "list map", Map: map_name, Err: err}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (b *NFTBatch) AddElement(map_name string, entry verdictEntry, verdict expr.VerdictKind) error {
+	set, err := b.getSet(map_name)
+	if err != nil {
+		return err
+	}
+
+	key, err := encodeVerdictKey(verdictMapKey(map_name), entry)
+	if err != nil {
+		return &NFTError{Op: "add element", Map: map_name, Err: err}
+	}
+
+	change, err := b.journal(map_name, entry)
+	if err != nil {
+		return err
+	}
+
+	element := nftables.SetElement{Key: key, VerdictData: &expr.Verdict{Kind: verdict}}
+	err = b.conn.SetAddElements(set, []nftables.SetElement{element})
+	if err != nil {
+		return &NFTError{Op: "add element", Map: map_name, Err: err}
+	}
+	change.present = true
+	return nil
+}
+
+func (b *NFTBatch) DeleteElement(map_name string, entry verdictEntry) error {
+	set, err := b.getSet(map_name)
+	if err != nil {
+		return err
+	}
+
+	key, err := encodeVerdictKey(verdictMapKey(map_name), entry)
+	if err != nil {
+		return &NFTError{Op: "delete element", Map: map_name, Err: err}
+	}
+
+	change, err := b.journal(map_name, entry)
+	if err != nil {
+		return err
+	}
+
+	err = b.conn.SetDeleteElements(set, []nftables.SetElement{{Key: key}})
+	if err != nil {
+		return &NFTError{Op: "delete element", Map: map_name, Err: err}
+	}
+	change.present = false
+	return nil
+}
+
+// journal returns the change record of an element, noting on the first
+// change whether the element was in its map before the batch
+func (b *NFTBatch) journal(map_name string, entry verdictEntry) (*nftChange, error) {
+	id := nftElementKey{map_name, entry}
+	change, exists := b.changed[id]
+	if exists {
+		return change, nil
+	}
+
+	entries, loaded := b.before[map_name]
+	if !loaded {
+		current, err := b.ListVerdictMap(map_name)
+		if err != nil {
+			return nil, err
+		}
+		entries = map[verdictEntry]bool{}
+		for _, e := range current {
+			entries[e] = true
+		}
+		b.before[map_name] = entries
+	}
+
+	existed := entries[entry]
+	change = &nftChange{nftElement{map_name, entry, getMapVerdict(map_name)}, existed, existed}
+	b.changes = append(b.changes, change)
+	b.changed[id] = change
+	return change, nil
+}
+
+func (b *NFTBatch) addVerdictMap(map_name string) (*nftables.Set, error) {
+	keyType, err := nftables.ConcatSetType(verdictMapKey(map_name)...)
+	if err != nil {
+		return nil, &NFTError{Op: "add map", Map: map_name, Err: err}
+	}
+
+	//the keys are concatenations, the kernel needs the size of each field
+	set := &nftables.Set{
+		Table:         nftFilterTable,
+		Name:          map_name,
+		IsMap:         true,
+		Concatenation: true,
+		KeyType:       keyType,
+		DataType:      nftables.TypeVerdict,
+	}
+
+	err = b.conn.AddSet(set, nil)
+	if err != nil {
+		return nil, &NFTError{Op: "add map", Map: map_name, Err: err}
+	}
+
+	b.sets[map_name] = set
+	//a map created by the batch starts out empty
+	b.before[map_name] = map[verdictEntry]bool{}
+	return set, nil
+}
+
+// EnsureZoneMaps creates the verdict maps and FORWARD rules for a custom zone
+//
+//	ip daddr . oifname vmap @{zone}_dst_access ip saddr . iifname . ether saddr vmap @{zone}_mac_src_access
+//	ip daddr . oifname . meta l4proto . th dport vmap @{zone}_port_dst_access ip saddr . iifname . ether saddr vmap @{zone}_mac_src_access
+//
+// along with the same rules over ip6 for the {zone}_dst_access6 maps
+func (b *NFTBatch) EnsureZoneMaps(zone string) error {
+	for _, family := range []nftFamily{nftIPv4, nftIPv6} {
+		err := b.ensureZoneMaps(zone, family)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *NFTBatch) ensureZoneMaps(zone string, family nftFamily) error {
+	suffix := family.suffix
+
+	hasDst, err := b.HasSet(zone + "_dst_access" + suffix)
+	if err != nil {
+		return err
+	}
+	hasPort, err := b.HasSet(zone + "_port_dst_access" + suffix)
+	if err != nil || (hasDst && hasPort) {
+		return err
+	}
+
+	//two verdict maps are used for establishing custom groups.
+	// the {name}_dst_access map allows Inet packets to a certain IP/interface pair
+	//the {name}_mac_src_access part allows Inet packets from a IP/IFace/MAC set
+	//the {name}_port_dst_access map narrows the first half down to a protocol and port
+	var src *nftables.Set
+	if hasDst {
+		src, err = b.getSet(zone + "_mac_src_access" + suffix)
+	} else {
+		src, err = b.addVerdictMap(zone + "_mac_src_access" + suffix)
+	}
+	if err != nil {
+		return err
+	}
+
+	ifnameReg := family.reg(family.addrLen)
+	l4Reg := family.reg(family.addrLen + 16)
+
+	if !hasDst {
+		dst, err := b.addVerdictMap(zone + "_dst_access" + suffix)
+		if err != nil {
+			return err
+		}
+
+		// ip daddr . oifname
+		exprs := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: family.daddrOff, Len: family.addrLen},
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: ifnameReg},
+			&expr.Lookup{SourceRegister: 1, DestRegister: 0, IsDestRegSet: true, SetName: dst.Name, SetID: dst.ID},
+		}
+		err = b.insertForwardRule(append(exprs, srcLookupExprs(family, src)...))
+		if err != nil {
+			return err
+		}
+	}
+
+	if !hasPort {
+		port, err := b.addVerdictMap(zone + "_port_dst_access" + suffix)
+		if err != nil {
+			return err
+		}
+
+		// ip daddr . oifname . meta l4proto . th dport
+		exprs := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: family.daddrOff, Len: family.addrLen},
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: ifnameReg},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: l4Reg},
+			&expr.Payload{DestRegister: l4Reg + 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, DestRegister: 0, IsDestRegSet: true, SetName: port.Name, SetID: port.ID},
+		}
+		err = b.insertForwardRule(append(exprs, srcLookupExprs(family, src)...))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// srcLookupExprs matches ip saddr . iifname . ether saddr against the source half of a zone
+func srcLookupExprs(family nftFamily, src *nftables.Set) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFTYPE, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint16(unix.ARPHRD_ETHER)},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: family.saddrOff, Len: family.addrLen},
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: family.reg(family.addrLen)},
+		&expr.Payload{DestRegister: family.reg(family.addrLen + 16), Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+		&expr.Lookup{SourceRegister: 1, DestRegister: 0, IsDestRegSet: true, SetName: src.Name, SetID: src.ID},
+	}
+}
+
+// insertForwardRule adds a zone rule right after the jump to QUOTA_THROTTLE,
+// so that rate limits also apply to the traffic the zones accept
+func (b *NFTBatch) insertForwardRule(exprs []expr.Any) error {
+	forward := &nftables.Chain{Name: "FORWARD", Table: nftFilterTable}
+	rules, err := b.conn.GetRules(nftFilterTable, forward)
+	if err != nil {
+		return &NFTError{Op: "list rules", Map: forward.Name, Err: err}
+	}
+
+	rule := &nftables.Rule{Table: nftFilterTable, Chain: forward, Exprs: exprs}
+	for _, existing := range rules {
+		if ruleJumpsTo(existing, nftThrottleChain.Name) {
+			rule.Position = existing.Handle
+			b.conn.AddRule(rule)
+			return nil
+		}
+	}
+
+	//rulesets without rate limits have no jump
+	b.conn.InsertRule(rule)
+	return nil
+}
+
+func ruleJumpsTo(rule *nftables.Rule, chain string) bool {
+	for _, e := range rule.Exprs {
+		verdict, ok := e.(*expr.Verdict)
+		if ok && verdict.Kind == expr.VerdictJump && verdict.Chain == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteZoneMaps removes the verdict maps of a custom zone along with
+// the FORWARD rules that EnsureZoneMaps inserted for it
+func (b *NFTBatch) DeleteZoneMaps(zone string) error {
+	names := []string{}
+	for _, family := range []nftFamily{nftIPv4, nftIPv6} {
+		for _, name := range []string{"_dst_access", "_port_dst_access", "_mac_src_access"} {
+			names = append(names, zone+name+family.suffix)
+		}
+	}
+
+	forward := &nftables.Chain{Name: "FORWARD", Table: nftFilterTable}
+	rules, err := b.conn.GetRules(nftFilterTable, forward)
+	if err != nil {
+		return &NFTError{Op: "list rules", Map: forward.Name, Err: err}
+	}
+
+	for _, rule := range rules {
+		if ruleLooksUp(rule, names) {
+			err = b.conn.DelRule(rule)
+			if err != nil {
+				return &NFTError{Op: "delete rule", Map: forward.Name, Err: err}
+			}
+		}
+	}
+
+	for _, name := range names {
+		set, err := b.getSet(name)
+		if err != nil {
+			if errors.Is(err, ErrNFTMapNotFound) {
+				continue
+			}
+			return err
+		}
+		b.conn.DelSet(set)
+		delete(b.sets, name)
+	}
+
+	return nil
+}
+
+func ruleLooksUp(rule *nftables.Rule, names []string) bool {
+	for _, e := range rule.Exprs {
+		lookup, ok := e.(*expr.Lookup)
+		if !ok {
+			continue
+		}
+		for _, name := range names {
+			if lookup.SetName == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// type of rule comments in the userdata TLVs of libnftnl
+const nftUserDataComment = 0
+
+// nftComment encodes a rule comment the way nft does, so that it shows up in
+// nft list ruleset. The nftables version in use has no userdata package yet
+func nftComment(comment string) []byte {
+	data := append([]byte(comment), 0)
+	return append([]byte{nftUserDataComment, byte(len(data))}, data...)
+}
+
+// RateLimit drops the traffic of an address beyond Rate bytes per second,
+// in each direction
+type RateLimit struct {
+	MAC  string
+	IP   string
+	Rate uint64
+}
+
+var nftThrottleChain = &nftables.Chain{Name: "QUOTA_THROTTLE", Table: nftFilterTable}
+
+// CountRateLimits returns the number of rules in the QUOTA_THROTTLE chain
+func (b *NFTBatch) CountRateLimits() (int, error) {
+	rules, err := b.conn.GetRules(nftFilterTable, nftThrottleChain)
+	if err != nil {
+		return 0, &NFTError{Op: "list rules", Map: nftThrottleChain.Name, Err: err}
+	}
+	return len(rules), nil
+}
+
+// SetRateLimits replaces the rules of the QUOTA_THROTTLE chain, two per limit
+//
+//	ip saddr {IP} limit rate over {Rate} bytes/second drop
+//	ip daddr {IP} limit rate over {Rate} bytes/second drop
+func (b *NFTBatch) SetRateLimits(limits []RateLimit) error {
+	b.conn.FlushChain(nftThrottleChain)
+
+	for _, limit := range limits {
+		ip := net.ParseIP(limit.IP)
+		if ip == nil {
+			return &NFTError{Op: "add rule", Map: nftThrottleChain.Name, Err: ErrNFTInvalidElement}
+		}
+		family, addr := nftIPv4, []byte(ip.To4())
+		if addr == nil {
+			family, addr = nftIPv6, []byte(ip.To16())
+		}
+
+		for _, offset := range []uint32{family.saddrOff, family.daddrOff} {
+			b.conn.AddRule(&nftables.Rule{
+				Table: nftFilterTable,
+				Chain: nftThrottleChain,
+				Exprs: []expr.Any{
+					&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: family.addrLen},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+					&expr.Limit{Type: expr.LimitTypePktBytes, Rate: limit.Rate, Over: true, Unit: expr.LimitTimeSecond, Burst: uint32(limit.Rate)},
+					&expr.Verdict{Kind: expr.VerdictDrop},
+				},
+				UserData: nftComment(limit.MAC),
+			})
+		}
+	}
+
+	return nil
+}
+
+func (b *NFTBatch) Commit() error {
+	err := b.conn.Flush()
+	//cached sets may have been created by this batch
+	b.sets = map[string]*nftables.Set{}
+	if err != nil {
+		return &NFTError{Op: "commit", Err: err}
+	}
+	return nil
+}
+
+// Revert undoes the element changes of a committed batch in a new transaction,
+// deleting only the elements the batch added and adding back the ones it deleted
+func (b *NFTBatch) Revert() error {
+	changes := b.changes
+	b.changes, b.changed = nil, map[nftElementKey]*nftChange{}
+	b.before = map[string]map[verdictEntry]bool{}
+
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if change.existed == change.present {
+			continue
+		}
+		set, err := b.getSet(change.element.Map)
+		if err != nil {
+			return err
+		}
+		key, err := encodeVerdictKey(verdictMapKey(change.element.Map), change.element.Entry)
+		if err != nil {
+			return &NFTError{Op: "revert element", Map: change.element.Map, Err: err}
+		}
+
+		if change.existed {
+			element := nftables.SetElement{Key: key, VerdictData: &expr.Verdict{Kind: change.element.Verdict}}
+			err = b.conn.SetAddElements(set, []nftables.SetElement{element})
+		} else {
+			err = b.conn.SetDeleteElements(set, []nftables.SetElement{{Key: key}})
+		}
+		if err != nil {
+			return &NFTError{Op: "revert element", Map: change.element.Map, Err: err}
+		}
+	}
+
+	return b.Commit()
+}
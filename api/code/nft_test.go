@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVerdictKeyRoundTrip(t *testing.T) {
+	tests := []struct {
+		map_name string
+		entry    verdictEntry
+		size     int
+	}{
+		{"dhcp_access", verdictEntry{ifname: "wlan0", mac: "aa:bb:cc:dd:ee:ff"}, 16 + 8},
+		{"internet_access", verdictEntry{ip: "192.168.2.10", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:ff"}, 4 + 16 + 8},
+		{"lan_access", verdictEntry{ip: "192.168.2.10", ifname: "eth1", mac: "00:11:22:33:44:55"}, 4 + 16 + 8},
+		{"guests_dst_access", verdictEntry{ip: "10.0.0.1", ifname: "wlan1"}, 4 + 16},
+		{"guests_port_dst_access", verdictEntry{ip: "10.0.0.1", ifname: "wlan1", proto: 6, port: 443}, 4 + 16 + 4 + 4},
+		{"internet_access6", verdictEntry{ip: "fd00:2::10", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:ff"}, 16 + 16 + 8},
+		{"guests_dst_access6", verdictEntry{ip: "2001:db8::1", ifname: "wlan1"}, 16 + 16},
+		{"guests_port_dst_access6", verdictEntry{ip: "fd00:2::1", ifname: "wlan1", proto: 17, port: 53}, 16 + 16 + 4 + 4},
+	}
+
+	for _, test := range tests {
+		layout := verdictMapKey(test.map_name)
+		key, err := encodeVerdictKey(layout, test.entry)
+		if err != nil {
+			t.Errorf("%s: encode failed: %v", test.map_name, err)
+			continue
+		}
+		if len(key) != test.size {
+			t.Errorf("%s: key is %d bytes, expected %d", test.map_name, len(key), test.size)
+		}
+		decoded, err := decodeVerdictKey(layout, key)
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", test.map_name, err)
+			continue
+		}
+		if decoded != test.entry {
+			t.Errorf("%s: decoded %+v, expected %+v", test.map_name, decoded, test.entry)
+		}
+	}
+}
+
+func TestEncodeVerdictKeyInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		map_name string
+		entry    verdictEntry
+	}{
+		{"no interface", "dhcp_access", verdictEntry{mac: "aa:bb:cc:dd:ee:ff"}},
+		{"long interface", "dhcp_access", verdictEntry{ifname: "abcdefghijklmnop", mac: "aa:bb:cc:dd:ee:ff"}},
+		{"bad mac", "dhcp_access", verdictEntry{ifname: "wlan0", mac: "aa:bb"}},
+		{"bad ip", "internet_access", verdictEntry{ip: "192.168.2", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:ff"}},
+		{"ipv6 in ipv4 map", "internet_access", verdictEntry{ip: "fd00::1", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:ff"}},
+		{"ipv4 in ipv6 map", "internet_access6", verdictEntry{ip: "192.168.2.10", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:ff"}},
+		{"no port", "lan_port_dst_access", verdictEntry{ip: "10.0.0.1", ifname: "wlan1", proto: 6}},
+		{"no protocol", "lan_port_dst_access", verdictEntry{ip: "10.0.0.1", ifname: "wlan1", port: 80}},
+	}
+
+	for _, test := range tests {
+		_, err := encodeVerdictKey(verdictMapKey(test.map_name), test.entry)
+		if err != ErrNFTInvalidElement {
+			t.Errorf("%s: expected ErrNFTInvalidElement, got %v", test.name, err)
+		}
+	}
+}
+
+func TestNFTComment(t *testing.T) {
+	tests := []struct {
+		comment string
+		udata   []byte
+	}{
+		{"", []byte{0, 1, 0}},
+		{"aa:bb", []byte{0, 6, 'a', 'a', ':', 'b', 'b', 0}},
+	}
+
+	for _, test := range tests {
+		udata := nftComment(test.comment)
+		if !bytes.Equal(udata, test.udata) {
+			t.Errorf("nftComment(%q) = %v, expected %v", test.comment, udata, test.udata)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Every plugin gets a unix socket of its own to call back into the api, at
+// PluginCallbackDir/{Name}/apisock. It serves a subset of the api, and each
+// call has to be covered by the Capabilities of the plugin. Calls that change
+// state are audited as plugin:{Name}.
+//
+// Anyone who reaches a socket holds the capabilities of its plugin, so a
+// plugin container mounts its own PluginCallbackDir/{Name}/ and never the
+// whole of PluginCallbackDir. The directory is private to its owner.
+
+var PluginCallbackDir = TEST_PREFIX + "/state/api/plugins"
+
+func pluginCallbackPath(name string) string {
+	return PluginCallbackDir + "/" + name + "/apisock"
+}
+
+// authorizePlugin checks calls against the capabilities of the plugin, in
+// the same way as the scopes of an api token
+func authorizePlugin(config PluginConfig) mux.MiddlewareFunc {
+	grant := APIToken{Scopes: config.Capabilities}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			match := mux.RouteMatch{Route: mux.CurrentRoute(r)}
+			if !authorizeToken(grant, r, &match) {
+				http.Error(w, "Forbidden, the plugin lacks the capability", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// pluginEvents streams the websocket events the capabilities of the plugin
+// cover. The plugin is authenticated by its socket, so the stream starts
+// without a login
+func pluginEvents(config PluginConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		}
+
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		//the capabilities are checked like the scopes of a token
+		addWSClient(c, PluginCaller{User: config.Name, Role: RoleToken, Scopes: config.Capabilities})
+	}
+}
+
+func pluginCallbackRouter(config PluginConfig) *mux.Router {
+	router := mux.NewRouter().StrictSlash(true)
+	router.Use(auditInternal("plugin:" + config.Name))
+	router.Use(authorizePlugin(config))
+
+	router.HandleFunc("/devices", getDevices).Methods("GET")
+	router.HandleFunc("/devices/{mac}", getDevice).Methods("GET")
+	router.HandleFunc("/zones", getZones).Methods("GET")
+	router.HandleFunc("/zones/{name}", getZone).Methods("GET")
+	router.HandleFunc("/zone/{name}", addZoneMember).Methods("PUT")
+	router.HandleFunc("/zone/{name}", delZoneMember).Methods("DELETE")
+	router.HandleFunc("/traffic/{name}", getDeviceTraffic).Methods("GET")
+	router.HandleFunc("/iptraffic", getIPTraffic).Methods("GET")
+	router.HandleFunc("/events", pluginEvents(config)).Methods("GET")
+	return router
+}
+
+func startPluginCallback(config PluginConfig) (*http.Server, error) {
+	path := pluginCallbackPath(config.Name)
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	//directories made before are tightened as well
+	err = os.Chmod(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           logRequest(pluginCallbackRouter(config)),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	return server, nil
+}
+
+func stopPluginCallback(name string, server *http.Server) {
+	if server == nil {
+		return
+	}
+	server.Close()
+	os.Remove(pluginCallbackPath(name))
+}
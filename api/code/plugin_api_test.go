@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPluginCallbackRouter(t *testing.T) {
+	dir := t.TempDir()
+	AuditLogPath = dir + "/audit.log"
+	AuditKeyPath = dir + "/audit.key"
+	AuditAnchorPath = dir + "/audit.anchor"
+	initAudit()
+	ZonesConfigPath = dir + "/zones.json"
+	ioutil.WriteFile(ZonesConfigPath, []byte(`[{"Name":"lan","Clients":[]}]`), 0644)
+
+	tests := []struct {
+		name         string
+		capabilities []string
+		method       string
+		path         string
+		status       int
+	}{
+		{"read", []string{"zones:read"}, "GET", "/zones", 200},
+		{"write covers read", []string{"zones:write"}, "GET", "/zones/lan", 200},
+		{"all", []string{ScopeAll}, "GET", "/zones", 200},
+		{"other resource", []string{"devices:read"}, "GET", "/zones", 403},
+		{"no capabilities", []string{}, "GET", "/zones", 403},
+		{"read only", []string{"zones:read"}, "PUT", "/zone/lan", 403},
+		{"delete read only", []string{"zones:read"}, "DELETE", "/zone/lan", 403},
+		{"events", []string{"devices:read"}, "GET", "/events", 403},
+		{"not served", []string{ScopeAll}, "GET", "/users", 404},
+	}
+
+	for _, test := range tests {
+		router := pluginCallbackRouter(PluginConfig{Name: "sample", Capabilities: test.capabilities})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(`{"Mac":"aa:bb:cc:dd:ee:ff"}`)))
+		if w.Code != test.status {
+			t.Errorf("%s: %s %s returned %d, expected %d", test.name, test.method, test.path, w.Code, test.status)
+		}
+	}
+
+	//denied changes are audited as the plugin
+	entries, err := readAuditLog(AuditLogPath)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("read %d audit entries: %v", len(entries), err)
+	}
+	for _, entry := range entries {
+		if entry.Actor != "plugin:sample" || entry.Status != 403 {
+			t.Errorf("unexpected audit entry %+v", entry)
+		}
+	}
+}
+
+func TestStartPluginCallback(t *testing.T) {
+	PluginCallbackDir = t.TempDir()
+	//a directory left with a wider mode is tightened
+	os.Mkdir(PluginCallbackDir+"/sample", 0755)
+
+	server, err := startPluginCallback(PluginConfig{Name: "sample"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopPluginCallback("sample", server)
+
+	info, err := os.Stat(PluginCallbackDir + "/sample")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("callback directory mode %v, expected 0700", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Plugins are api extensions served on a unix socket and proxied under
+// /plugins/{URI}/. They are managed at runtime through /plugins and saved
+// to the api config. Every plugin socket is probed by pluginTimer.
+
+type PluginStatus struct {
+	PluginConfig
+	//socket of the plugin to call the api on
+	CallbackPath string `json:",omitempty"`
+	//up, down or unknown before the first probe
+	Status    string
+	LastCheck time.Time `json:",omitempty"`
+	LastUp    time.Time `json:",omitempty"`
+	LastError string    `json:",omitempty"`
+}
+
+type PluginError struct {
+	Error  string
+	Plugin string
+	Detail string
+}
+
+type plugin struct {
+	config   PluginConfig
+	proxy    *httputil.ReverseProxy
+	callback *http.Server
+	status   PluginStatus
+}
+
+var Pluginsmtx sync.Mutex
+var ConfigPath = TEST_PREFIX + "/state/api/config"
+var PluginProbeInterval = 30 * time.Second
+var PluginProbeTimeout = 2 * time.Second
+
+var pluginNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// plugins by URI, guarded by Pluginsmtx
+var gPlugins = map[string]*plugin{}
+
+// saveConfig writes the api config, the caller holds Pluginsmtx
+func saveConfig() error {
+	file, _ := json.MarshalIndent(config, "", " ")
+	return ioutil.WriteFile(ConfigPath, file, 0600)
+}
+
+func pluginTransport(config PluginConfig) *http.Transport {
+	return &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", config.UnixPath)
+		},
+	}
+}
+
+func PluginProxy(config PluginConfig) (*httputil.ReverseProxy, error) {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = config.Name
+
+			//Empty headers from the request
+			//SECURITY benefit: API extensions do not receive credentials
+			req.Header = http.Header{}
+
+			//instead the plugin gets a signed assertion of the caller
+			caller, ok := pluginCaller(req)
+			if !ok {
+				return
+			}
+			assertion, err := signPluginIdentity(config, caller)
+			if err != nil {
+				fmt.Println("failed to sign plugin identity", err)
+				return
+			}
+			req.Header.Set(PluginIdentityHeader, assertion)
+		},
+		Transport: pluginTransport(config),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			setPluginStatus(config.URI, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(PluginError{"plugin unavailable", config.Name, err.Error()})
+		},
+	}, nil
+}
+
+func ProxyRequestHandler(w http.ResponseWriter, r *http.Request) {
+	uri := mux.Vars(r)["uri"]
+
+	Pluginsmtx.Lock()
+	entry, exists := gPlugins[uri]
+	Pluginsmtx.Unlock()
+	if !exists {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	rest := mux.Vars(r)["rest"]
+	if rest != "" {
+		r.URL.Path = "/" + rest
+	}
+	entry.proxy.ServeHTTP(w, r)
+}
+
+func validatePlugin(config PluginConfig) error {
+	if !pluginNameRe.MatchString(config.Name) {
+		return fmt.Errorf("invalid plugin name %q", config.Name)
+	}
+	if !pluginNameRe.MatchString(config.URI) {
+		return fmt.Errorf("invalid plugin uri %q", config.URI)
+	}
+	if !filepath.IsAbs(config.UnixPath) || filepath.Clean(config.UnixPath) != config.UnixPath {
+		return fmt.Errorf("the unix path of a plugin has to be an absolute, clean path")
+	}
+	for _, capability := range config.Capabilities {
+		err := validateScope(capability)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerPlugin adds or replaces a plugin, the caller holds Pluginsmtx
+func registerPlugin(config PluginConfig) error {
+	proxy, err := PluginProxy(config)
+	if err != nil {
+		return err
+	}
+	entry := &plugin{
+		config: config,
+		proxy:  proxy,
+		status: PluginStatus{PluginConfig: config, Status: "unknown"},
+	}
+
+	//the plugin is still proxied without its callback socket
+	entry.callback, err = startPluginCallback(config)
+	if err != nil {
+		fmt.Println("failed to start the callback socket of plugin", config.Name, err)
+	} else {
+		entry.status.CallbackPath = pluginCallbackPath(config.Name)
+	}
+
+	gPlugins[config.URI] = entry
+	return nil
+}
+
+// unregisterPlugin removes a plugin, the caller holds Pluginsmtx
+func unregisterPlugin(uri string) {
+	entry, exists := gPlugins[uri]
+	if !exists {
+		return
+	}
+	stopPluginCallback(entry.config.Name, entry.callback)
+	delete(gPlugins, uri)
+}
+
+func initPlugins() {
+	Pluginsmtx.Lock()
+	defer Pluginsmtx.Unlock()
+
+	for _, entry := range config.Plugins {
+		err := validatePlugin(entry)
+		if err == nil {
+			err = registerPlugin(entry)
+		}
+		if err != nil {
+			fmt.Println("failed to register plugin", entry.Name, err)
+		}
+	}
+}
+
+func setPluginStatus(uri string, err error) {
+	Pluginsmtx.Lock()
+	defer Pluginsmtx.Unlock()
+
+	entry, exists := gPlugins[uri]
+	if !exists {
+		return
+	}
+	now := time.Now()
+	entry.status.LastCheck = now
+	if err != nil {
+		entry.status.Status = "down"
+		entry.status.LastError = err.Error()
+		return
+	}
+	entry.status.Status = "up"
+	entry.status.LastUp = now
+	entry.status.LastError = ""
+}
+
+// probePlugin checks that the plugin socket answers http requests. Any
+// reply counts, plugins do not have to implement /health
+func probePlugin(config PluginConfig) error {
+	client := http.Client{Transport: pluginTransport(config), Timeout: PluginProbeTimeout}
+	defer client.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), PluginProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+config.Name+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+func probePlugins() {
+	Pluginsmtx.Lock()
+	configs := []PluginConfig{}
+	for _, entry := range gPlugins {
+		configs = append(configs, entry.config)
+	}
+	Pluginsmtx.Unlock()
+
+	for _, entry := range configs {
+		Pluginsmtx.Lock()
+		previous := ""
+		if current, exists := gPlugins[entry.URI]; exists {
+			previous = current.status.Status
+		}
+		Pluginsmtx.Unlock()
+
+		err := probePlugin(entry)
+		setPluginStatus(entry.URI, err)
+
+		status := "up"
+		if err != nil {
+			status = "down"
+		}
+		if previous != status {
+			WSNotifyValue("PluginStatus", PluginStatus{PluginConfig: entry, Status: status})
+		}
+	}
+}
+
+func pluginTimer() {
+	runTimer := func() {
+		probePlugins()
+
+		ticker := time.NewTicker(PluginProbeInterval)
+		for {
+			select {
+			case <-ticker.C:
+				probePlugins()
+			}
+		}
+	}
+
+	go runTimer()
+}
+
+func getPlugins(w http.ResponseWriter, r *http.Request) {
+	Pluginsmtx.Lock()
+	plugins := []PluginStatus{}
+	for _, entry := range gPlugins {
+		plugins = append(plugins, entry.status)
+	}
+	Pluginsmtx.Unlock()
+
+	sort.Slice(plugins, func(i, j int) bool {
+		return plugins[i].Name < plugins[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plugins)
+}
+
+// modifyPlugins adds or updates (PUT) or removes (DELETE) a plugin by name
+func modifyPlugins(w http.ResponseWriter, r *http.Request) {
+	entry := PluginConfig{}
+	err := json.NewDecoder(r.Body).Decode(&entry)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		err = validatePlugin(entry)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	Pluginsmtx.Lock()
+	defer Pluginsmtx.Unlock()
+
+	plugins := []PluginConfig{}
+	var previous *PluginConfig
+	for _, current := range config.Plugins {
+		if current.Name == entry.Name {
+			found := current
+			previous = &found
+			continue
+		}
+		if r.Method == http.MethodPut && current.URI == entry.URI {
+			http.Error(w, "uri "+entry.URI+" is used by plugin "+current.Name, 400)
+			return
+		}
+		plugins = append(plugins, current)
+	}
+
+	if r.Method == http.MethodDelete {
+		if previous == nil {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		auditChange(r, previous, nil)
+	} else {
+		auditChange(r, previous, entry)
+		plugins = append(plugins, entry)
+	}
+
+	config.Plugins = plugins
+	err = saveConfig()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if previous != nil {
+		unregisterPlugin(previous.URI)
+	}
+	if r.Method == http.MethodPut {
+		err = registerPlugin(entry)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodDelete {
+		json.NewEncoder(w).Encode(true)
+		return
+	}
+	json.NewEncoder(w).Encode(gPlugins[entry.URI].status)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestProbePlugin(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		listen bool
+		up     bool
+	}{
+		{"ok", 200, true, true},
+		{"no health route", 404, true, true},
+		{"failing", 503, true, false},
+		{"no socket", 0, false, false},
+	}
+
+	for _, test := range tests {
+		config := PluginConfig{Name: "plugin", URI: "plugin", UnixPath: t.TempDir() + "/socket"}
+		if test.listen {
+			listener, err := net.Listen("unix", config.UnixPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := test.status
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			})}
+			go server.Serve(listener)
+			defer server.Close()
+		}
+
+		if err := probePlugin(config); (err == nil) != test.up {
+			t.Errorf("%s: expected up %v, got %v", test.name, test.up, err)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Quotas cap the wan traffic of a device per day or month. The usage is
+// computed from the deltas of the accounting counters collected by the
+// traffic timer. A device over its quota is dropped from internet_access
+// or throttled until the next period starts.
+
+type DeviceQuota struct {
+	MAC string
+	//daily or monthly
+	Period string
+	//wan bytes in both directions per period, no quota when zero
+	Bytes uint64
+	//block or throttle
+	Action string
+	//bytes per second applied when the quota is exceeded with the throttle action
+	ThrottleRate uint64 `json:",omitempty"`
+	//bytes per second applied at all times, no limit when zero
+	RateLimit uint64 `json:",omitempty"`
+}
+
+type QuotaUsage struct {
+	MAC         string
+	PeriodStart time.Time
+	Bytes       uint64
+	Exceeded    bool
+	//last counter reading of each address of the device
+	Counters map[string]uint64
+}
+
+type QuotaStatus struct {
+	Quota DeviceQuota
+	Usage QuotaUsage
+}
+
+var Quotamtx sync.Mutex
+var QuotasConfigPath = TEST_PREFIX + "/state/api/quotas.json"
+var QuotaUsagePath = TEST_PREFIX + "/state/api/quota_usage.json"
+
+// devices dropped from internet_access, guarded by Quotamtx
+var gQuotaBlocked = map[string]bool{}
+
+// rate limits applied at the last check
+var gAppliedRateLimits = []RateLimit{}
+
+func loadQuotas() map[string]DeviceQuota {
+	quotas := map[string]DeviceQuota{}
+	data, err := ioutil.ReadFile(QuotasConfigPath)
+	if err != nil {
+		return quotas
+	}
+	err = json.Unmarshal(data, &quotas)
+	if err != nil {
+		fmt.Println("failed to load quotas", err)
+	}
+	return quotas
+}
+
+func saveQuotas(quotas map[string]DeviceQuota) error {
+	file, _ := json.MarshalIndent(quotas, "", " ")
+	return ioutil.WriteFile(QuotasConfigPath, file, 0644)
+}
+
+func loadQuotaUsage() map[string]QuotaUsage {
+	usage := map[string]QuotaUsage{}
+	data, err := ioutil.ReadFile(QuotaUsagePath)
+	if err != nil {
+		return usage
+	}
+	err = json.Unmarshal(data, &usage)
+	if err != nil {
+		fmt.Println("failed to load quota usage", err)
+	}
+	return usage
+}
+
+func saveQuotaUsage(usage map[string]QuotaUsage) error {
+	file, _ := json.MarshalIndent(usage, "", " ")
+	return ioutil.WriteFile(QuotaUsagePath, file, 0644)
+}
+
+func quotaPeriodStart(period string, now time.Time) time.Time {
+	if period == "monthly" {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+}
+
+func validateQuota(quota DeviceQuota) error {
+	_, err := net.ParseMAC(quota.MAC)
+	if err != nil {
+		return fmt.Errorf("invalid mac %q", quota.MAC)
+	}
+	if quota.Period != "daily" && quota.Period != "monthly" {
+		return fmt.Errorf("invalid period %q", quota.Period)
+	}
+	if quota.Action != "block" && quota.Action != "throttle" {
+		return fmt.Errorf("invalid action %q", quota.Action)
+	}
+	if quota.Action == "throttle" && quota.ThrottleRate == 0 {
+		return fmt.Errorf("the throttle action requires a ThrottleRate")
+	}
+	return nil
+}
+
+// isQuotaBlocked reports whether a device lost internet access to its quota
+func isQuotaBlocked(MAC string) bool {
+	Quotamtx.Lock()
+	defer Quotamtx.Unlock()
+	return gQuotaBlocked[trimLower(MAC)]
+}
+
+func quotaRate(quota DeviceQuota, usage QuotaUsage) uint64 {
+	if usage.Exceeded && quota.Action == "throttle" {
+		return quota.ThrottleRate
+	}
+	return quota.RateLimit
+}
+
+// getRateLimits returns the limits for every address of the throttled devices
+func getRateLimits(quotas map[string]DeviceQuota, usage map[string]QuotaUsage, bindings map[string]clientBinding) []RateLimit {
+	limits := []RateLimit{}
+	for mac, quota := range quotas {
+		rate := quotaRate(quota, usage[mac])
+		if rate == 0 {
+			continue
+		}
+		for _, addr := range bindings[mac].addrs() {
+			limits = append(limits, RateLimit{mac, addr, rate})
+		}
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		if limits[i].MAC != limits[j].MAC {
+			return limits[i].MAC < limits[j].MAC
+		}
+		return limits[i].IP < limits[j].IP
+	})
+	return limits
+}
+
+func equalRateLimits(a []RateLimit, b []RateLimit) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRateLimits rewrites the QUOTA_THROTTLE chain when the limits changed
+// or the chain lost its rules to a ruleset reload
+func applyRateLimits(limits []RateLimit) error {
+	batch, err := NewNFTBatch()
+	if err != nil {
+		return err
+	}
+
+	count, err := batch.CountRateLimits()
+	if err != nil {
+		return err
+	}
+	if count == 2*len(limits) && equalRateLimits(limits, gAppliedRateLimits) {
+		return nil
+	}
+
+	err = batch.SetRateLimits(limits)
+	if err == nil {
+		err = batch.Commit()
+	}
+	if err != nil {
+		return err
+	}
+	gAppliedRateLimits = limits
+	return nil
+}
+
+// updateQuotaUsage adds the wan traffic of the latest readings to the usage
+// of every device with a quota, and returns the devices that crossed into or
+// out of the exceeded state
+func updateQuotaUsage(readings map[string]*NetCount, now time.Time) ([]QuotaStatus, error) {
+	Quotamtx.Lock()
+	defer Quotamtx.Unlock()
+
+	quotas := loadQuotas()
+	usage := loadQuotaUsage()
+	bindings := loadBindings()
+
+	transitions := []QuotaStatus{}
+	for mac, quota := range quotas {
+		entry, exists := usage[mac]
+		start := quotaPeriodStart(quota.Period, now)
+		if !exists || !entry.PeriodStart.Equal(start) {
+			if entry.Exceeded {
+				entry.Exceeded = false
+				transitions = append(transitions, QuotaStatus{quota, entry})
+			}
+			entry = QuotaUsage{MAC: mac, PeriodStart: start, Counters: entry.Counters}
+		}
+		if entry.Counters == nil {
+			entry.Counters = map[string]uint64{}
+		}
+
+		for _, addr := range bindings[mac].addrs() {
+			reading, exists := readings[addr]
+			if !exists {
+				continue
+			}
+			total := reading.WanIn + reading.WanOut
+			//the first reading of an address only sets the baseline
+			previous, known := entry.Counters[addr]
+			if known && total >= previous {
+				entry.Bytes += total - previous
+			} else if known {
+				//the accounting set entry timed out and started over
+				entry.Bytes += total
+			}
+			entry.Counters[addr] = total
+		}
+
+		exceeded := quota.Bytes > 0 && entry.Bytes >= quota.Bytes
+		if exceeded != entry.Exceeded {
+			//the quota may also have been raised or removed
+			entry.Exceeded = exceeded
+			transitions = append(transitions, QuotaStatus{quota, entry})
+		}
+		usage[mac] = entry
+	}
+
+	//usage of removed quotas is dropped
+	for mac := range usage {
+		if _, exists := quotas[mac]; !exists {
+			delete(usage, mac)
+		}
+	}
+
+	updateQuotaBlocked(quotas, usage)
+
+	err := applyRateLimits(getRateLimits(quotas, usage, bindings))
+	if err != nil {
+		fmt.Println("failed to apply rate limits", err)
+	}
+
+	return transitions, saveQuotaUsage(usage)
+}
+
+func updateQuotaBlocked(quotas map[string]DeviceQuota, usage map[string]QuotaUsage) {
+	blocked := map[string]bool{}
+	for mac, quota := range quotas {
+		if quota.Action == "block" && usage[mac].Exceeded {
+			blocked[mac] = true
+		}
+	}
+	gQuotaBlocked = blocked
+}
+
+func checkQuotas(readings map[string]*NetCount) {
+	transitions, err := updateQuotaUsage(readings, time.Now())
+	if err != nil {
+		fmt.Println("failed to update quota usage", err)
+	}
+
+	refresh := []string{}
+	blocked := []string{}
+	for _, transition := range transitions {
+		if transition.Quota.Action == "block" {
+			refresh = append(refresh, transition.Quota.MAC)
+			if transition.Usage.Exceeded {
+				blocked = append(blocked, transition.Quota.MAC)
+			}
+		}
+	}
+	if len(refresh) > 0 {
+		DHCPmtx.Lock()
+		Zonesmtx.Lock()
+		refreshScheduledClients(refresh)
+		//open connections are accepted by F_EST_RELATED otherwise
+		flushClientConntrack(blocked)
+		Zonesmtx.Unlock()
+		DHCPmtx.Unlock()
+	}
+
+	for _, transition := range transitions {
+		if transition.Usage.Exceeded {
+			WSNotifyValue("QuotaExceeded", transition)
+		} else {
+			WSNotifyValue("QuotaRestored", transition)
+		}
+	}
+}
+
+func initQuotas() {
+	Quotamtx.Lock()
+	defer Quotamtx.Unlock()
+	updateQuotaBlocked(loadQuotas(), loadQuotaUsage())
+}
+
+func getQuotas(w http.ResponseWriter, r *http.Request) {
+	Quotamtx.Lock()
+	defer Quotamtx.Unlock()
+
+	usage := loadQuotaUsage()
+	statuses := []QuotaStatus{}
+	for mac, quota := range loadQuotas() {
+		statuses = append(statuses, QuotaStatus{quota, usage[mac]})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Quota.MAC < statuses[j].Quota.MAC
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func modifyQuota(w http.ResponseWriter, r *http.Request) {
+	mac := trimLower(mux.Vars(r)["mac"])
+
+	quota := DeviceQuota{}
+	if r.Method == http.MethodPut {
+		err := json.NewDecoder(r.Body).Decode(&quota)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		quota.MAC = mac
+		quota.Period = strings.ToLower(quota.Period)
+		quota.Action = strings.ToLower(quota.Action)
+		err = validateQuota(quota)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	Quotamtx.Lock()
+	quotas := loadQuotas()
+	_, exists := quotas[mac]
+	if r.Method == http.MethodDelete {
+		if !exists {
+			Quotamtx.Unlock()
+			http.Error(w, "Not found", 404)
+			return
+		}
+		delete(quotas, mac)
+	} else {
+		quotas[mac] = quota
+	}
+	err := saveQuotas(quotas)
+	Quotamtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	//the usage and limits are brought up to date right away
+	checkQuotas(map[string]*NetCount{})
+	DHCPmtx.Lock()
+	Zonesmtx.Lock()
+	refreshScheduledClients([]string{mac})
+	Zonesmtx.Unlock()
+	DHCPmtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodDelete {
+		json.NewEncoder(w).Encode(true)
+		return
+	}
+	json.NewEncoder(w).Encode(quota)
+}
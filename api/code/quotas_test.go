@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriodStart(t *testing.T) {
+	now := time.Date(2026, 10, 17, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		period string
+		start  time.Time
+	}{
+		{"daily", time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)},
+		{"monthly", time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		start := quotaPeriodStart(test.period, now)
+		if !start.Equal(test.start) {
+			t.Errorf("%s: start %v, expected %v", test.period, start, test.start)
+		}
+	}
+}
+
+func TestGetRateLimits(t *testing.T) {
+	quotas := map[string]DeviceQuota{
+		"aa:bb:cc:dd:ee:01": {MAC: "aa:bb:cc:dd:ee:01", Action: "throttle", ThrottleRate: 1000},
+		"aa:bb:cc:dd:ee:02": {MAC: "aa:bb:cc:dd:ee:02", Action: "block", RateLimit: 5000},
+		"aa:bb:cc:dd:ee:03": {MAC: "aa:bb:cc:dd:ee:03", Action: "block"},
+		"aa:bb:cc:dd:ee:04": {MAC: "aa:bb:cc:dd:ee:04", Action: "throttle", ThrottleRate: 1000, RateLimit: 5000},
+	}
+	bindings := map[string]clientBinding{
+		"aa:bb:cc:dd:ee:01": {IP: "192.168.2.10", IPv6: []string{"fd00::10"}},
+		"aa:bb:cc:dd:ee:02": {IP: "192.168.2.11"},
+		"aa:bb:cc:dd:ee:03": {IP: "192.168.2.12"},
+		"aa:bb:cc:dd:ee:04": {IP: "192.168.2.13"},
+	}
+
+	tests := []struct {
+		name   string
+		usage  map[string]QuotaUsage
+		limits []RateLimit
+	}{
+		{"within quota", map[string]QuotaUsage{}, []RateLimit{
+			{"aa:bb:cc:dd:ee:02", "192.168.2.11", 5000},
+			{"aa:bb:cc:dd:ee:04", "192.168.2.13", 5000},
+		}},
+		{"exceeded", map[string]QuotaUsage{
+			"aa:bb:cc:dd:ee:01": {Exceeded: true},
+			"aa:bb:cc:dd:ee:02": {Exceeded: true},
+			"aa:bb:cc:dd:ee:03": {Exceeded: true},
+			"aa:bb:cc:dd:ee:04": {Exceeded: true},
+		}, []RateLimit{
+			{"aa:bb:cc:dd:ee:01", "192.168.2.10", 1000},
+			{"aa:bb:cc:dd:ee:01", "fd00::10", 1000},
+			{"aa:bb:cc:dd:ee:02", "192.168.2.11", 5000},
+			{"aa:bb:cc:dd:ee:04", "192.168.2.13", 1000},
+		}},
+	}
+
+	for _, test := range tests {
+		limits := getRateLimits(quotas, test.usage, bindings)
+		if !reflect.DeepEqual(limits, test.limits) {
+			t.Errorf("%s: limits %v, expected %v", test.name, limits, test.limits)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The reconciler periodically rebuilds the verdict maps that zones.json,
+// the ARP table and dhcp_access call for, and repairs any drift in the
+// live maps left by restarts, manual nft edits or failed updates.
+
+var ReconcileInterval = 1 * time.Minute
+
+type ReconcileFix struct {
+	Action string
+	Map    string
+	IP     string
+	Iface  string
+	MAC    string
+
+	Protocol string `json:",omitempty"`
+	Port     uint16 `json:",omitempty"`
+}
+
+func newReconcileFix(action string, map_name string, entry verdictEntry) ReconcileFix {
+	return ReconcileFix{action, map_name, entry.ip, entry.ifname, entry.mac, zonePortProtocolName(entry.proto), entry.port}
+}
+
+type ReconcileStatus struct {
+	Started  time.Time
+	Finished time.Time
+	Devices  int
+	Fixes    []ReconcileFix
+	Error    string `json:",omitempty"`
+}
+
+var Reconcilemtx sync.Mutex
+var gReconcileStatus = ReconcileStatus{Fixes: []ReconcileFix{}}
+
+// getClientBindings resolves the ip and interface of zone members from the
+// static arp entries and the dhcp_access verdict map, falling back to the
+// bindings last learned from dhcpUpdate. ipv6 addresses only come from the
+// saved bindings
+func getClientBindings(batch *NFTBatch, zones []ClientZone) (map[string]clientBinding, error) {
+	bindings := map[string]clientBinding{}
+	saved := loadBindings()
+
+	arpEntries, err := GetArpEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	dhcpEntries, err := batch.ListVerdictMap("dhcp_access")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, zone := range zones {
+		for _, client := range zone.Clients {
+			mac := trimLower(client.Mac)
+			if _, exists := bindings[mac]; exists {
+				continue
+			}
+
+			binding := saved[mac]
+			binding.MAC = mac
+			for _, entry := range arpEntries {
+				if equalMAC(entry.Mac, mac) {
+					binding.IP = entry.IP
+				}
+			}
+			for _, entry := range dhcpEntries {
+				if equalMAC(entry.mac, mac) {
+					binding.Iface = entry.ifname
+				}
+			}
+
+			if len(binding.addrs()) > 0 && binding.Iface != "" {
+				bindings[mac] = binding
+			}
+		}
+	}
+
+	return bindings, nil
+}
+
+func reconcileVerdictMaps() ReconcileStatus {
+	DHCPmtx.Lock()
+	defer DHCPmtx.Unlock()
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	status := ReconcileStatus{Started: time.Now(), Fixes: []ReconcileFix{}}
+	err := doReconcile(&status)
+	if err != nil {
+		status.Error = err.Error()
+	}
+	status.Finished = time.Now()
+	return status
+}
+
+func doReconcile(status *ReconcileStatus) error {
+	//bindings are resolved for every member, the entries only for the
+	// members whose schedules are active
+	zones := getActiveZones()
+
+	batch, err := NewNFTBatch()
+	if err != nil {
+		return err
+	}
+
+	bindings, err := getClientBindings(batch, getZonesJson())
+	if err != nil {
+		return err
+	}
+	status.Devices = len(bindings)
+
+	knownIPs := map[string]bool{}
+	desired := map[string]map[verdictEntry]nftElement{}
+	for _, name := range getVerdictMapNames() {
+		desired[name] = map[verdictEntry]nftElement{}
+	}
+	for _, binding := range bindings {
+		for _, addr := range binding.addrs() {
+			knownIPs[addr] = true
+			for _, element := range getVmapElements(zones, addr, binding.MAC, binding.Iface) {
+				desired[element.Map][element.Entry] = element
+			}
+		}
+	}
+
+	for _, name := range getVerdictMapNames() {
+		live, err := batch.ListVerdictMap(name)
+		if err != nil {
+			if !errors.Is(err, ErrNFTMapNotFound) {
+				return err
+			}
+			live = []verdictEntry{}
+		}
+
+		for _, entry := range live {
+			if _, exists := desired[name][entry]; exists {
+				delete(desired[name], entry)
+				continue
+			}
+
+			//entries of clients without a known binding are left alone,
+			// their ip and interface can not be verified
+			if entry.mac != "" {
+				_, known := bindings[trimLower(entry.mac)]
+				if !known && isZoneMember(zones, name, entry.mac) {
+					continue
+				}
+			} else if !knownIPs[entry.ip] {
+				continue
+			}
+
+			err = batch.DeleteElement(name, entry)
+			if err != nil {
+				return err
+			}
+			status.Fixes = append(status.Fixes, newReconcileFix("delete", name, entry))
+		}
+
+		for _, element := range desired[name] {
+			zoneName := customZoneOfMap(name)
+			if zoneName != "" {
+				err = batch.EnsureZoneMaps(zoneName)
+				if err != nil {
+					return err
+				}
+			}
+			err = batch.AddElement(name, element.Entry, element.Verdict)
+			if err != nil {
+				return err
+			}
+			status.Fixes = append(status.Fixes, newReconcileFix("add", name, element.Entry))
+		}
+	}
+
+	if len(status.Fixes) == 0 {
+		return nil
+	}
+	return batch.Commit()
+}
+
+func isZoneMember(zones []ClientZone, map_name string, MAC string) bool {
+	for _, zone := range zones {
+		for _, name := range zoneVerdictMaps(zone) {
+			if name == ipv4MapName(map_name) && isZoneClient(zone, MAC) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func reconcileTimer() {
+	runTimer := func() {
+		ticker := time.NewTicker(ReconcileInterval)
+		for {
+			select {
+			case <-ticker.C:
+				status := reconcileVerdictMaps()
+
+				Reconcilemtx.Lock()
+				gReconcileStatus = status
+				Reconcilemtx.Unlock()
+
+				if status.Error != "" {
+					fmt.Println("reconcile failed", status.Error)
+				}
+				if len(status.Fixes) > 0 {
+					WSNotifyValue("ReconcileFixed", status)
+				}
+			}
+		}
+	}
+
+	go runTimer()
+}
+
+func getReconcileStatus(w http.ResponseWriter, r *http.Request) {
+	Reconcilemtx.Lock()
+	defer Reconcilemtx.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gReconcileStatus)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsZoneMember(t *testing.T) {
+	zones := []ClientZone{
+		{Name: "lan", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}}},
+		{Name: "wan", Clients: []Client{{Mac: "AA:BB:CC:DD:EE:02"}}},
+		{Name: "guests", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:03"}}},
+		{Name: "isolated", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:04"}}},
+	}
+
+	tests := []struct {
+		map_name string
+		mac      string
+		member   bool
+	}{
+		{"lan_access", "aa:bb:cc:dd:ee:01", true},
+		{"lan_access", "aa:bb:cc:dd:ee:02", false},
+		{"internet_access", "aa:bb:cc:dd:ee:02", true},
+		{"internet_access6", "aa:bb:cc:dd:ee:02", true},
+		{"guests_dst_access", "aa:bb:cc:dd:ee:03", true},
+		{"guests_mac_src_access", "AA:BB:CC:DD:EE:03", true},
+		{"guests_dst_access", "aa:bb:cc:dd:ee:01", false},
+		{"dns_access", "aa:bb:cc:dd:ee:04", false},
+		{"lan_access", "aa:bb:cc:dd:ee:ff", false},
+	}
+
+	for _, test := range tests {
+		if isZoneMember(zones, test.map_name, test.mac) != test.member {
+			t.Errorf("isZoneMember(%s, %s) expected %v", test.map_name, test.mac, test.member)
+		}
+	}
+}
+
+func TestNewReconcileFix(t *testing.T) {
+	tests := []struct {
+		entry verdictEntry
+		fix   ReconcileFix
+	}{
+		{verdictEntry{ip: "192.168.2.10", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:ff"},
+			ReconcileFix{"add", "lan_access", "192.168.2.10", "wlan0", "aa:bb:cc:dd:ee:ff", "", 0}},
+		{verdictEntry{ip: "10.0.0.1", ifname: "wlan1", proto: 6, port: 443},
+			ReconcileFix{"add", "lan_access", "10.0.0.1", "wlan1", "", "tcp", 443}},
+		{verdictEntry{ip: "10.0.0.1", ifname: "wlan1", proto: 17, port: 53},
+			ReconcileFix{"add", "lan_access", "10.0.0.1", "wlan1", "", "udp", 53}},
+	}
+
+	for _, test := range tests {
+		fix := newReconcileFix("add", "lan_access", test.entry)
+		if fix != test.fix {
+			t.Errorf("fix %+v, expected %+v", fix, test.fix)
+		}
+	}
+}
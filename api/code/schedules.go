@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Schedules restrict zone membership to time windows. Outside of every
+// window that covers it, a client is treated as if it was not a member of
+// the zone, so its verdict map entries for the zone are removed.
+
+type Schedule struct {
+	Name string
+	Zone string
+	//client macs, all members of the zone when empty
+	Clients []string `json:",omitempty"`
+	//mon..sun, every day when empty. A window that ends past midnight
+	// belongs to the day it starts on
+	Days  []string `json:",omitempty"`
+	Start string
+	End   string
+}
+
+type ScheduleTransition struct {
+	Name    string
+	Zone    string
+	Active  bool
+	Clients []string
+}
+
+var Schedulesmtx sync.Mutex
+var SchedulesConfigPath = TEST_PREFIX + "/configs/zones/schedules.json"
+var ScheduleInterval = 30 * time.Second
+
+var scheduleDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func getSchedulesJson() []Schedule {
+	Schedulesmtx.Lock()
+	defer Schedulesmtx.Unlock()
+
+	schedules := []Schedule{}
+	data, err := ioutil.ReadFile(SchedulesConfigPath)
+	if err != nil {
+		return schedules
+	}
+	err = json.Unmarshal(data, &schedules)
+	if err != nil {
+		fmt.Println("failed to load schedules", err)
+	}
+	return schedules
+}
+
+func saveSchedules(schedules []Schedule) error {
+	Schedulesmtx.Lock()
+	defer Schedulesmtx.Unlock()
+
+	file, _ := json.MarshalIndent(schedules, "", " ")
+	return ioutil.WriteFile(SchedulesConfigPath, file, 0644)
+}
+
+func parseScheduleTime(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s Schedule) onDay(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, entry := range s.Days {
+		if entry == scheduleDays[day] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Schedule) activeAt(now time.Time) bool {
+	start, err := parseScheduleTime(s.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseScheduleTime(s.End)
+	if err != nil {
+		return false
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	if start < end {
+		return s.onDay(now.Weekday()) && minute >= start && minute < end
+	}
+
+	//the window spans midnight
+	if minute >= start {
+		return s.onDay(now.Weekday())
+	}
+	if minute < end {
+		return s.onDay((now.Weekday() + 6) % 7)
+	}
+	return false
+}
+
+func (s Schedule) covers(zone string, MAC string) bool {
+	if s.Zone != zone {
+		return false
+	}
+	if len(s.Clients) == 0 {
+		return true
+	}
+	for _, client := range s.Clients {
+		if equalMAC(client, MAC) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledZones returns the zones with the clients removed whose schedules
+// are all inactive at the given time
+func scheduledZones(zones []ClientZone, schedules []Schedule, now time.Time) []ClientZone {
+	if len(schedules) == 0 {
+		return zones
+	}
+
+	result := []ClientZone{}
+	for _, zone := range zones {
+		clients := []Client{}
+		for _, client := range zone.Clients {
+			covered, active := false, false
+			for _, schedule := range schedules {
+				if schedule.covers(zone.Name, client.Mac) {
+					covered = true
+					active = active || schedule.activeAt(now)
+				}
+			}
+			if !covered || active {
+				clients = append(clients, client)
+			}
+		}
+		zone.Clients = clients
+		result = append(result, zone)
+	}
+	return result
+}
+
+// getActiveZones returns the zones with the membership currently in effect
+func getActiveZones() []ClientZone {
+	return scheduledZones(getZonesJson(), getSchedulesJson(), time.Now())
+}
+
+func validateSchedule(zones []ClientZone, schedule Schedule) error {
+	if !zoneNameRe.MatchString(schedule.Name) {
+		return fmt.Errorf("invalid schedule name %q", schedule.Name)
+	}
+
+	idx := findZone(zones, schedule.Zone)
+	if idx < 0 {
+		return fmt.Errorf("zone %s does not exist", schedule.Zone)
+	}
+	for _, client := range schedule.Clients {
+		if !isZoneClient(zones[idx], client) {
+			return fmt.Errorf("%s is not a member of zone %s", client, schedule.Zone)
+		}
+	}
+
+	for _, day := range schedule.Days {
+		known := false
+		for _, entry := range scheduleDays {
+			known = known || day == entry
+		}
+		if !known {
+			return fmt.Errorf("invalid day %q", day)
+		}
+	}
+
+	start, err := parseScheduleTime(schedule.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseScheduleTime(schedule.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("schedule start and end are equal")
+	}
+
+	return nil
+}
+
+func scheduleClients(zones []ClientZone, schedule Schedule) []string {
+	if len(schedule.Clients) > 0 {
+		return schedule.Clients
+	}
+	clients := []string{}
+	idx := findZone(zones, schedule.Zone)
+	if idx >= 0 {
+		for _, client := range zones[idx].Clients {
+			clients = append(clients, trimLower(client.Mac))
+		}
+	}
+	return clients
+}
+
+// refreshScheduledClients rebuilds the verdict map entries of clients from
+// the bindings learned in dhcpUpdate
+func refreshScheduledClients(MACs []string) {
+	bindings := loadBindings()
+	for _, MAC := range MACs {
+		binding, exists := bindings[trimLower(MAC)]
+		if !exists {
+			refreshClientZones(MAC)
+			continue
+		}
+
+		batch, err := NewNFTBatch()
+		if err == nil {
+			err = flushVmaps(batch, binding.IP, binding.MAC, binding.Iface, getVerdictMapNames4(), shouldFlushByInterface(binding.Iface))
+		}
+		if err == nil {
+			err = populateVmapEntries(batch, binding.IP, binding.MAC, binding.Iface)
+		}
+		if err == nil {
+			err = batch.Commit()
+		}
+		if err != nil {
+			fmt.Println("failed to apply schedule", MAC, err)
+		}
+	}
+}
+
+// flushClientConntrack drops the open connections of clients that lost access
+func flushClientConntrack(MACs []string) {
+	bindings := loadBindings()
+	for _, MAC := range MACs {
+		binding, exists := bindings[trimLower(MAC)]
+		if !exists {
+			continue
+		}
+		for _, IP := range append([]string{binding.IP}, binding.IPv6...) {
+			if IP == "" {
+				continue
+			}
+			err := flushConntrack(IP)
+			if err != nil {
+				fmt.Println("failed to flush connections", MAC, err)
+			}
+		}
+	}
+}
+
+// renameScheduleZone moves the schedules of a zone to a new name, or removes
+// them when the new name is empty
+func renameScheduleZone(name string, newName string) error {
+	schedules := []Schedule{}
+	changed := false
+	for _, schedule := range getSchedulesJson() {
+		if schedule.Zone == name {
+			changed = true
+			if newName == "" {
+				continue
+			}
+			schedule.Zone = newName
+		}
+		schedules = append(schedules, schedule)
+	}
+	if !changed {
+		return nil
+	}
+	return saveSchedules(schedules)
+}
+
+// state of every schedule at the last run, guarded by Zonesmtx
+var gScheduleActive = map[string]bool{}
+
+// applySchedules refreshes the clients of schedules that changed state since
+// the last run and reports the transitions
+func applySchedules(notify bool) {
+	DHCPmtx.Lock()
+	defer DHCPmtx.Unlock()
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	zones := getZonesJson()
+	now := time.Now()
+
+	transitions := []ScheduleTransition{}
+	refresh := []string{}
+	revoked := []string{}
+	current := map[string]bool{}
+	for _, schedule := range getSchedulesJson() {
+		active := schedule.activeAt(now)
+		current[schedule.Name] = active
+
+		previous, known := gScheduleActive[schedule.Name]
+		if known && previous == active {
+			continue
+		}
+
+		clients := scheduleClients(zones, schedule)
+		refresh = append(refresh, clients...)
+		if !active {
+			revoked = append(revoked, clients...)
+		}
+		transitions = append(transitions, ScheduleTransition{schedule.Name, schedule.Zone, active, clients})
+	}
+	gScheduleActive = current
+
+	refreshScheduledClients(refresh)
+	flushClientConntrack(revoked)
+
+	if notify {
+		for _, transition := range transitions {
+			WSNotifyValue("ScheduleTransition", transition)
+		}
+	}
+}
+
+func scheduleTimer() {
+	runTimer := func() {
+		//bring the verdict maps in line with the schedules on startup
+		applySchedules(false)
+
+		ticker := time.NewTicker(ScheduleInterval)
+		for {
+			select {
+			case <-ticker.C:
+				applySchedules(true)
+			}
+		}
+	}
+
+	go runTimer()
+}
+
+func getSchedules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getSchedulesJson())
+}
+
+func putSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule := Schedule{}
+	err := json.NewDecoder(r.Body).Decode(&schedule)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	schedule.Name = trimLower(mux.Vars(r)["name"])
+	schedule.Zone = trimLower(schedule.Zone)
+	for i := range schedule.Days {
+		schedule.Days[i] = trimLower(schedule.Days[i])
+	}
+
+	Zonesmtx.Lock()
+	err = validateSchedule(getZonesJson(), schedule)
+	Zonesmtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	schedules := getSchedulesJson()
+	replaced := false
+	for i := range schedules {
+		if schedules[i].Name == schedule.Name {
+			schedules[i] = schedule
+			replaced = true
+		}
+	}
+	if !replaced {
+		schedules = append(schedules, schedule)
+	}
+
+	err = saveSchedules(schedules)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	//force the clients of the schedule to be refreshed
+	Zonesmtx.Lock()
+	delete(gScheduleActive, schedule.Name)
+	Zonesmtx.Unlock()
+	applySchedules(true)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+func deleteSchedule(w http.ResponseWriter, r *http.Request) {
+	name := trimLower(mux.Vars(r)["name"])
+
+	schedules := []Schedule{}
+	var deleted *Schedule
+	for _, schedule := range getSchedulesJson() {
+		if schedule.Name == name {
+			entry := schedule
+			deleted = &entry
+			continue
+		}
+		schedules = append(schedules, schedule)
+	}
+	if deleted == nil {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	err := saveSchedules(schedules)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	//the clients regain their membership unless another schedule applies
+	DHCPmtx.Lock()
+	Zonesmtx.Lock()
+	delete(gScheduleActive, name)
+	refreshScheduledClients(scheduleClients(getZonesJson(), *deleted))
+	Zonesmtx.Unlock()
+	DHCPmtx.Unlock()
+
+	json.NewEncoder(w).Encode(true)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScheduleActiveAt(t *testing.T) {
+	//2026-10-12 is a monday
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2026, 10, 11+day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		now      time.Time
+		active   bool
+	}{
+		{"inside", Schedule{Start: "08:00", End: "17:00"}, at(1, 12, 0), true},
+		{"at start", Schedule{Start: "08:00", End: "17:00"}, at(1, 8, 0), true},
+		{"at end", Schedule{Start: "08:00", End: "17:00"}, at(1, 17, 0), false},
+		{"before", Schedule{Start: "08:00", End: "17:00"}, at(1, 7, 59), false},
+		{"weekday", Schedule{Days: []string{"mon"}, Start: "08:00", End: "17:00"}, at(1, 12, 0), true},
+		{"other day", Schedule{Days: []string{"tue"}, Start: "08:00", End: "17:00"}, at(1, 12, 0), false},
+		{"before midnight", Schedule{Start: "22:00", End: "06:00"}, at(1, 23, 30), true},
+		{"after midnight", Schedule{Start: "22:00", End: "06:00"}, at(2, 1, 0), true},
+		{"past the window", Schedule{Start: "22:00", End: "06:00"}, at(2, 6, 0), false},
+		{"midday", Schedule{Start: "22:00", End: "06:00"}, at(2, 12, 0), false},
+		//the part after midnight belongs to the day the window starts on
+		{"after midnight of the day", Schedule{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at(2, 1, 0), true},
+		{"after midnight of another day", Schedule{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at(1, 1, 0), false},
+		{"sunday into monday", Schedule{Days: []string{"sun"}, Start: "22:00", End: "06:00"}, at(1, 1, 0), true},
+		{"invalid start", Schedule{Start: "8am", End: "17:00"}, at(1, 12, 0), false},
+		{"invalid end", Schedule{Start: "08:00", End: "25:00"}, at(1, 12, 0), false},
+	}
+
+	for _, test := range tests {
+		if test.schedule.activeAt(test.now) != test.active {
+			t.Errorf("%s: expected active %v", test.name, test.active)
+		}
+	}
+}
+
+func TestScheduledZones(t *testing.T) {
+	zones := []ClientZone{
+		{Name: "kids", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}, {Mac: "aa:bb:cc:dd:ee:02"}}},
+		{Name: "lan", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}}},
+	}
+	night := Schedule{Name: "night", Zone: "kids", Start: "22:00", End: "06:00"}
+	one := Schedule{Name: "one", Zone: "kids", Clients: []string{"AA:BB:CC:DD:EE:02"}, Start: "08:00", End: "09:00"}
+
+	members := func(zone ClientZone) []string {
+		macs := []string{}
+		for _, client := range zone.Clients {
+			macs = append(macs, client.Mac)
+		}
+		return macs
+	}
+
+	tests := []struct {
+		name      string
+		schedules []Schedule
+		now       time.Time
+		kids      []string
+	}{
+		{"no schedules", []Schedule{}, time.Date(2026, 10, 12, 12, 0, 0, 0, time.Local),
+			[]string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"}},
+		{"inactive", []Schedule{night}, time.Date(2026, 10, 12, 12, 0, 0, 0, time.Local),
+			[]string{}},
+		{"across midnight", []Schedule{night}, time.Date(2026, 10, 13, 0, 30, 0, 0, time.Local),
+			[]string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"}},
+		{"single client", []Schedule{one}, time.Date(2026, 10, 12, 12, 0, 0, 0, time.Local),
+			[]string{"aa:bb:cc:dd:ee:01"}},
+		{"any schedule active", []Schedule{night, one}, time.Date(2026, 10, 12, 8, 30, 0, 0, time.Local),
+			[]string{"aa:bb:cc:dd:ee:02"}},
+	}
+
+	for _, test := range tests {
+		result := scheduledZones(zones, test.schedules, test.now)
+		if len(result) != 2 {
+			t.Errorf("%s: %d zones, expected 2", test.name, len(result))
+			continue
+		}
+		if !reflect.DeepEqual(members(result[0]), test.kids) {
+			t.Errorf("%s: kids %v, expected %v", test.name, members(result[0]), test.kids)
+		}
+		//zones without schedules keep their members
+		if !reflect.DeepEqual(members(result[1]), []string{"aa:bb:cc:dd:ee:01"}) {
+			t.Errorf("%s: lan %v", test.name, members(result[1]))
+		}
+	}
+}
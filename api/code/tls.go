@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPS for the api. Unless a certificate is configured, a local CA is
+// generated and signs a server certificate for the addresses and hostname
+// of the router. Both are renewed by tlsTimer ahead of their expiry, the
+// server certificate also when the addresses change.
+
+type TLSConfig struct {
+	//https is served unless Disabled is set
+	Disabled bool
+	//":443" by default
+	Listen string
+	//user supplied certificate and key, in PEM
+	CertFile string
+	KeyFile  string
+	//redirect http requests to https
+	RedirectHTTP bool
+	//names to add to the generated certificate
+	Hostnames []string
+}
+
+type TLSStatus struct {
+	Enabled      bool
+	UserSupplied bool
+	//of the local CA, or of the last certificate of a user supplied chain
+	CAFingerprint string
+	CANotAfter    time.Time
+	NotAfter      time.Time
+	Names         []string `json:",omitempty"`
+}
+
+var TLSDir = TEST_PREFIX + "/state/api/tls"
+var TLSCheckInterval = 12 * time.Hour
+
+var TLSCALifetime = 10 * 365 * 24 * time.Hour
+var TLSCARenewBefore = 365 * 24 * time.Hour
+var TLSCertLifetime = 90 * 24 * time.Hour
+var TLSCertRenewBefore = 30 * 24 * time.Hour
+
+var TLSmtx sync.Mutex
+
+// guarded by TLSmtx
+var gTLSCert *tls.Certificate
+var gTLSCA *x509.Certificate
+var gTLSUserSupplied bool
+
+func tlsPath(name string) string {
+	return TLSDir + "/" + name
+}
+
+// tlsNames returns the hostname and the global addresses of the router
+func tlsNames(config TLSConfig) ([]string, []net.IP) {
+	names := []string{"localhost"}
+	hostname, err := os.Hostname()
+	if err == nil && hostname != "" {
+		names = append(names, hostname)
+	}
+	names = append(names, config.Hostnames...)
+
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if ok && ipnet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	return names, ips
+}
+
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sameNames(cert *x509.Certificate, names []string, ips []net.IP) bool {
+	expected := append([]string{}, names...)
+	for _, ip := range ips {
+		expected = append(expected, ip.String())
+	}
+	sort.Strings(expected)
+	return strings.Join(expected, ",") == strings.Join(certNames(cert), ",")
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func serialNumber() (*big.Int, error) {
+	return crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEM(path string, blockType string, data []byte, mode os.FileMode) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), mode)
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	data, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(path, "EC PRIVATE KEY", data, 0600)
+}
+
+func loadKeyPair(certPath string, keyPath string) (*tls.Certificate, *x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	pair.Leaf = leaf
+	return &pair, leaf, nil
+}
+
+func generateCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "SPR Local CA " + now.Format("2006-01-02")},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(TLSCALifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	err = writeKey(tlsPath("ca.key"), key)
+	if err != nil {
+		return err
+	}
+	return writePEM(tlsPath("ca.crt"), "CERTIFICATE", der, 0644)
+}
+
+func generateServerCert(ca *tls.Certificate, names []string, ips []net.IP) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "SPR api"},
+		DNSNames:     names,
+		IPAddresses:  ips,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(TLSCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return err
+	}
+	err = writeKey(tlsPath("server.key"), key)
+	if err != nil {
+		return err
+	}
+	return writePEM(tlsPath("server.crt"), "CERTIFICATE", der, 0644)
+}
+
+// ensureCertificates loads the configured certificate, or renews the
+// generated ones as needed. The caller holds TLSmtx
+func ensureCertificates(config TLSConfig) error {
+	if config.CertFile != "" {
+		cert, _, err := loadKeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+		//the last certificate of the chain is the one to pin
+		root, err := x509.ParseCertificate(cert.Certificate[len(cert.Certificate)-1])
+		if err != nil {
+			return err
+		}
+		gTLSCert = cert
+		gTLSCA = root
+		gTLSUserSupplied = true
+		return nil
+	}
+
+	err := os.MkdirAll(TLSDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	ca, caLeaf, err := loadKeyPair(tlsPath("ca.crt"), tlsPath("ca.key"))
+	renewCA := err != nil || now.Add(TLSCARenewBefore).After(caLeaf.NotAfter)
+	if renewCA {
+		fmt.Println("generating the local certificate authority")
+		err = generateCA()
+		if err != nil {
+			return err
+		}
+		ca, caLeaf, err = loadKeyPair(tlsPath("ca.crt"), tlsPath("ca.key"))
+		if err != nil {
+			return err
+		}
+	}
+
+	names, ips := tlsNames(config)
+	cert, leaf, err := loadKeyPair(tlsPath("server.crt"), tlsPath("server.key"))
+	renew := renewCA || err != nil ||
+		now.Add(TLSCertRenewBefore).After(leaf.NotAfter) ||
+		!sameNames(leaf, names, ips) ||
+		leaf.CheckSignatureFrom(caLeaf) != nil
+	if renew {
+		fmt.Println("generating the server certificate for", names, ips)
+		err = generateServerCert(ca, names, ips)
+		if err != nil {
+			return err
+		}
+		cert, _, err = loadKeyPair(tlsPath("server.crt"), tlsPath("server.key"))
+		if err != nil {
+			return err
+		}
+	}
+
+	//clients get the chain up to the local CA
+	cert.Certificate = append(cert.Certificate, caLeaf.Raw)
+
+	gTLSCert = cert
+	gTLSCA = caLeaf
+	gTLSUserSupplied = false
+	return nil
+}
+
+func getTLSCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	TLSmtx.Lock()
+	defer TLSmtx.Unlock()
+	if gTLSCert == nil {
+		return nil, fmt.Errorf("no certificate")
+	}
+	return gTLSCert, nil
+}
+
+func getTLSStatus() TLSStatus {
+	TLSmtx.Lock()
+	defer TLSmtx.Unlock()
+
+	status := TLSStatus{Enabled: gTLSCert != nil, UserSupplied: gTLSUserSupplied}
+	if gTLSCert != nil && gTLSCert.Leaf != nil {
+		status.NotAfter = gTLSCert.Leaf.NotAfter
+		status.Names = certNames(gTLSCert.Leaf)
+	}
+	if gTLSCA != nil {
+		status.CAFingerprint = certFingerprint(gTLSCA)
+		status.CANotAfter = gTLSCA.NotAfter
+	}
+	return status
+}
+
+func tlsTimer(config TLSConfig) {
+	runTimer := func() {
+		ticker := time.NewTicker(TLSCheckInterval)
+		for {
+			select {
+			case <-ticker.C:
+				TLSmtx.Lock()
+				err := ensureCertificates(config)
+				TLSmtx.Unlock()
+				if err != nil {
+					fmt.Println("failed to renew certificates", err)
+				}
+			}
+		}
+	}
+
+	go runTimer()
+}
+
+// redirectHTTPS sends http requests to the https listener
+func redirectHTTPS(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// serveTLS starts the https listener and returns the handler for plain http
+func serveTLS(config TLSConfig, handler http.Handler) http.Handler {
+	if config.Disabled {
+		return handler
+	}
+
+	listen := config.Listen
+	if listen == "" {
+		listen = ":443"
+	}
+
+	TLSmtx.Lock()
+	err := ensureCertificates(config)
+	TLSmtx.Unlock()
+	if err != nil {
+		fmt.Println("https disabled, failed to set up certificates", err)
+		return handler
+	}
+	tlsTimer(config)
+
+	server := &http.Server{
+		Addr:    listen,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: getTLSCertificate,
+		},
+	}
+	go func() {
+		err := server.ListenAndServeTLS("", "")
+		if err != nil {
+			fmt.Println("https listener failed", err)
+		}
+	}()
+
+	if config.RedirectHTTP {
+		return redirectHTTPS(listen)
+	}
+	return handler
+}
+
+// getTLSCA serves the local CA so that clients can install it
+func getTLSCA(w http.ResponseWriter, r *http.Request) {
+	TLSmtx.Lock()
+	ca := gTLSCA
+	TLSmtx.Unlock()
+	if ca == nil {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSameNames(t *testing.T) {
+	cert := &x509.Certificate{
+		DNSNames:    []string{"localhost", "spr"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("192.168.2.1")},
+	}
+
+	tests := []struct {
+		name  string
+		names []string
+		ips   []string
+		same  bool
+	}{
+		{"same", []string{"localhost", "spr"}, []string{"127.0.0.1", "192.168.2.1"}, true},
+		{"other order", []string{"spr", "localhost"}, []string{"192.168.2.1", "127.0.0.1"}, true},
+		{"new address", []string{"localhost", "spr"}, []string{"127.0.0.1", "192.168.3.1"}, false},
+		{"added name", []string{"localhost", "spr", "spr.lan"}, []string{"127.0.0.1", "192.168.2.1"}, false},
+		{"removed address", []string{"localhost", "spr"}, []string{"127.0.0.1"}, false},
+	}
+
+	for _, test := range tests {
+		ips := []net.IP{}
+		for _, ip := range test.ips {
+			ips = append(ips, net.ParseIP(ip))
+		}
+		if same := sameNames(cert, test.names, ips); same != test.same {
+			t.Errorf("%s: expected %v", test.name, test.same)
+		}
+	}
+}
+
+func TestEnsureCertificates(t *testing.T) {
+	TLSDir = t.TempDir()
+	TLSmtx.Lock()
+	err := ensureCertificates(TLSConfig{Hostnames: []string{"spr.lan"}})
+	TLSmtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := getTLSStatus()
+	if !status.Enabled || status.UserSupplied {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if status.CAFingerprint != certFingerprint(gTLSCA) || len(status.CAFingerprint) != 64 {
+		t.Errorf("CA fingerprint %q", status.CAFingerprint)
+	}
+	if status.CANotAfter.Before(time.Now().Add(TLSCALifetime - 2*time.Hour)) {
+		t.Errorf("CA expires %v", status.CANotAfter)
+	}
+	if status.NotAfter.Before(time.Now().Add(TLSCertLifetime - 2*time.Hour)) {
+		t.Errorf("certificate expires %v", status.NotAfter)
+	}
+
+	//a second run keeps the certificates
+	fingerprint := status.CAFingerprint
+	leaf := gTLSCert.Leaf.Raw
+	TLSmtx.Lock()
+	err = ensureCertificates(TLSConfig{Hostnames: []string{"spr.lan"}})
+	TLSmtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getTLSStatus().CAFingerprint != fingerprint || string(gTLSCert.Leaf.Raw) != string(leaf) {
+		t.Errorf("certificates were renewed")
+	}
+
+	//a user supplied certificate is pinned by the last certificate of its chain
+	TLSmtx.Lock()
+	err = ensureCertificates(TLSConfig{CertFile: tlsPath("server.crt"), KeyFile: tlsPath("server.key")})
+	TLSmtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = getTLSStatus()
+	if !status.UserSupplied || status.CAFingerprint != certFingerprint(gTLSCert.Leaf) {
+		t.Errorf("unexpected user supplied status %+v", status)
+	}
+}
+
+func TestGetStatus(t *testing.T) {
+	TLSDir = t.TempDir()
+	TLSmtx.Lock()
+	err := ensureCertificates(TLSConfig{})
+	TLSmtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/status", "/status?detail=1"} {
+		w := httptest.NewRecorder()
+		getStatus(w, httptest.NewRequest("GET", target, nil))
+
+		status := StatusDetail{}
+		err = json.NewDecoder(w.Body).Decode(&status)
+		if err != nil {
+			t.Errorf("%s: %v", target, err)
+			continue
+		}
+		if status.Status != "Online" || status.TLS.CAFingerprint != certFingerprint(gTLSCA) || status.TLS.NotAfter.IsZero() {
+			t.Errorf("%s: unexpected status %+v", target, status)
+		}
+	}
+}
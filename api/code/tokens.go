@@ -0,0 +1,468 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// API tokens for bearer authentication. Only the sha256 of a token is
+// stored, the token itself is returned once when it is minted. Every token
+// carries scopes of the form {resource}:read or {resource}:write, where
+// write includes read, or "*" for every route.
+
+type APIToken struct {
+	ID       string
+	Label    string
+	Hash     string
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time `json:",omitempty"`
+	LastUsed time.Time `json:",omitempty"`
+}
+
+// APITokenInfo is the view of a token returned by the api
+type APITokenInfo struct {
+	ID       string
+	Label    string
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time `json:",omitempty"`
+	LastUsed time.Time `json:",omitempty"`
+	Expired  bool
+	//only set in the reply that mints the token
+	Token string `json:",omitempty"`
+}
+
+type APITokenRequest struct {
+	Label  string
+	Scopes []string
+	//RFC3339, the token does not expire when empty
+	Expires string
+}
+
+var Tokensmtx sync.Mutex
+var TokensPath = TEST_PREFIX + "/state/api/tokens.json"
+
+// cleartext tokens of earlier versions, hashed into TokensPath on startup
+var LegacyTokensPath = TEST_PREFIX + "/state/api/auth_tokens"
+
+// LastUsed is only written back to disk at this resolution
+var TokenLastUsedResolution = time.Minute
+
+const ScopeAll = "*"
+
+// resource of every route, for the scope check. Users, tokens and lockouts
+// are left out so that only tokens with "*" can manage credentials
+var routeScopes = map[string]string{
+	"/status":               "status",
+	"/devices":              "devices",
+	"/devices/{mac}":        "devices",
+	"/pendingPSK":           "psk",
+	"/setPSK":               "psk",
+	"/reloadPSKFiles":       "psk",
+	"/traffic/{name}":       "traffic",
+	"/traffic_history":      "traffic",
+	"/iptraffic":            "traffic",
+	"/quotas":               "quotas",
+	"/quotas/{mac}":         "quotas",
+	"/metrics":              "metrics",
+	"/arp":                  "network",
+	"/ip/addr":              "network",
+	"/nfmap/{name}":         "network",
+	"/reconcile/status":     "network",
+	"/zones":                "zones",
+	"/zone/{name}":          "zones",
+	"/zones/{name}":         "zones",
+	"/zones/{name}/rename":  "zones",
+	"/zones/{name}/ports":   "zones",
+	"/schedules":            "zones",
+	"/schedules/{name}":     "zones",
+	"/hostapd/status":       "hostapd",
+	"/hostapd/all_stations": "hostapd",
+	"/hostapd/config":       "hostapd",
+	//event stream on the callback socket of plugins
+	"/events": "events",
+}
+
+// tokens by hash, reloaded when the file changes on disk. Guarded by Tokensmtx
+var gTokens = map[string]APIToken{}
+var gTokensModTime time.Time
+var gTokensSize int64 = -1
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func genTokenID() string {
+	id := make([]byte, 8)
+	crand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func loadTokens() map[string]APIToken {
+	tokens := map[string]APIToken{}
+	data, err := ioutil.ReadFile(TokensPath)
+	if err != nil {
+		return tokens
+	}
+	entries := []APIToken{}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		fmt.Println("failed to load tokens", err)
+	}
+	for _, entry := range entries {
+		tokens[entry.Hash] = entry
+	}
+	return tokens
+}
+
+func saveTokens(tokens map[string]APIToken) error {
+	entries := []APIToken{}
+	for _, entry := range tokens {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+
+	file, _ := json.MarshalIndent(entries, "", " ")
+	err := ioutil.WriteFile(TokensPath, file, 0600)
+	if err != nil {
+		return err
+	}
+	gTokens = tokens
+	recordTokensStat()
+	return nil
+}
+
+func recordTokensStat() {
+	info, err := os.Stat(TokensPath)
+	if err != nil {
+		gTokensModTime = time.Time{}
+		gTokensSize = -1
+		return
+	}
+	gTokensModTime = info.ModTime()
+	gTokensSize = info.Size()
+}
+
+// getTokens returns the cached tokens, reloading them when the file changed
+func getTokens() map[string]APIToken {
+	info, err := os.Stat(TokensPath)
+	if err != nil {
+		if gTokensSize != -1 {
+			gTokens = map[string]APIToken{}
+			gTokensSize = -1
+		}
+		return gTokens
+	}
+	if !info.ModTime().Equal(gTokensModTime) || info.Size() != gTokensSize {
+		gTokens = loadTokens()
+		gTokensModTime = info.ModTime()
+		gTokensSize = info.Size()
+	}
+	return gTokens
+}
+
+func copyTokens(tokens map[string]APIToken) map[string]APIToken {
+	result := map[string]APIToken{}
+	for hash, entry := range tokens {
+		result[hash] = entry
+	}
+	return result
+}
+
+// migrateLegacyTokens hashes the cleartext tokens into the token store with
+// full access and removes the cleartext file
+func migrateLegacyTokens() error {
+	data, err := ioutil.ReadFile(LegacyTokensPath)
+	if err != nil {
+		return nil
+	}
+
+	legacy := []string{}
+	err = json.Unmarshal(data, &legacy)
+	if err != nil {
+		return err
+	}
+
+	tokens := loadTokens()
+	for _, token := range legacy {
+		hash := hashToken(token)
+		if _, exists := tokens[hash]; !exists {
+			tokens[hash] = APIToken{
+				ID:      genTokenID(),
+				Label:   "migrated",
+				Hash:    hash,
+				Scopes:  []string{ScopeAll},
+				Created: time.Now(),
+			}
+		}
+	}
+
+	err = saveTokens(tokens)
+	if err != nil {
+		return err
+	}
+	return os.Remove(LegacyTokensPath)
+}
+
+func initTokens() {
+	Tokensmtx.Lock()
+	defer Tokensmtx.Unlock()
+
+	err := migrateLegacyTokens()
+	if err != nil {
+		fmt.Println("failed to migrate tokens", err)
+	}
+}
+
+func (t APIToken) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+func (t APIToken) info() APITokenInfo {
+	return APITokenInfo{
+		ID:       t.ID,
+		Label:    t.Label,
+		Scopes:   t.Scopes,
+		Created:  t.Created,
+		Expires:  t.Expires,
+		LastUsed: t.LastUsed,
+		Expired:  t.expired(time.Now()),
+	}
+}
+
+// actorName identifies the token in the audit log
+func (t APIToken) actorName() string {
+	if t.Label != "" {
+		return t.Label
+	}
+	return t.ID
+}
+
+// verifyToken returns the stored token for a bearer token that is valid and
+// records its use
+func verifyToken(token string) (APIToken, bool) {
+	Tokensmtx.Lock()
+	defer Tokensmtx.Unlock()
+
+	hash := hashToken(token)
+	entry, exists := getTokens()[hash]
+	now := time.Now()
+	if !exists || entry.expired(now) {
+		return APIToken{}, false
+	}
+
+	if now.Sub(entry.LastUsed) >= TokenLastUsedResolution {
+		entry.LastUsed = now
+		tokens := copyTokens(getTokens())
+		tokens[hash] = entry
+		err := saveTokens(tokens)
+		if err != nil {
+			fmt.Println("failed to save token use", err)
+		}
+	}
+	return entry, true
+}
+
+func validateScope(scope string) error {
+	if scope == ScopeAll {
+		return nil
+	}
+	pieces := strings.Split(scope, ":")
+	if len(pieces) != 2 || (pieces[1] != "read" && pieces[1] != "write") {
+		return fmt.Errorf("invalid scope %q, expected {resource}:read or {resource}:write", scope)
+	}
+	if pieces[0] == "plugins" {
+		return nil
+	}
+	for _, resource := range routeScopes {
+		if resource == pieces[0] {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown scope resource %q", pieces[0])
+}
+
+// routeScope returns the resource and access a request needs
+func routeScope(template string, method string) (string, string) {
+	access := "write"
+	if method == http.MethodGet || method == http.MethodOptions {
+		access = "read"
+	}
+	if strings.HasPrefix(template, "/plugins/") {
+		return "plugins", access
+	}
+	return routeScopes[template], access
+}
+
+// authorizeToken reports whether the scopes of a token permit the matched route
+func authorizeToken(token APIToken, r *http.Request, match *mux.RouteMatch) bool {
+	for _, scope := range token.Scopes {
+		if scope == ScopeAll {
+			return true
+		}
+	}
+
+	if match.Route == nil {
+		return false
+	}
+	template, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return false
+	}
+
+	resource, access := routeScope(template, r.Method)
+	if resource == "" {
+		return false
+	}
+	for _, scope := range token.Scopes {
+		if scope == resource+":"+access || scope == resource+":write" {
+			return true
+		}
+	}
+	return false
+}
+
+func getAPITokens(w http.ResponseWriter, r *http.Request) {
+	Tokensmtx.Lock()
+	defer Tokensmtx.Unlock()
+
+	tokens := []APITokenInfo{}
+	for _, entry := range getTokens() {
+		tokens = append(tokens, entry.info())
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func mintAPIToken(w http.ResponseWriter, r *http.Request) {
+	request := APITokenRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if len(request.Scopes) == 0 {
+		http.Error(w, "a token needs at least one scope", 400)
+		return
+	}
+	for _, scope := range request.Scopes {
+		err = validateScope(scope)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	token := genBearerToken()
+	entry := APIToken{
+		ID:      genTokenID(),
+		Label:   request.Label,
+		Hash:    hashToken(token),
+		Scopes:  request.Scopes,
+		Created: time.Now(),
+	}
+
+	if request.Expires != "" {
+		entry.Expires, err = time.Parse(time.RFC3339, request.Expires)
+		if err != nil {
+			http.Error(w, "invalid expiry, expected RFC3339", 400)
+			return
+		}
+		if !entry.Expires.After(entry.Created) {
+			http.Error(w, "the expiry has to be in the future", 400)
+			return
+		}
+	}
+
+	Tokensmtx.Lock()
+	tokens := copyTokens(getTokens())
+	tokens[entry.Hash] = entry
+	err = saveTokens(tokens)
+	Tokensmtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	info := entry.info()
+	info.Token = token
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func findTokenHash(tokens map[string]APIToken, id string) string {
+	for hash, entry := range tokens {
+		if entry.ID == id {
+			return hash
+		}
+	}
+	return ""
+}
+
+// modifyAPIToken relabels (PUT) or revokes (DELETE) a token
+func modifyAPIToken(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	request := APITokenRequest{}
+	if r.Method == http.MethodPut {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	Tokensmtx.Lock()
+	defer Tokensmtx.Unlock()
+
+	tokens := copyTokens(getTokens())
+	hash := findTokenHash(tokens, id)
+	if hash == "" {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	entry := tokens[hash]
+	if r.Method == http.MethodDelete {
+		delete(tokens, hash)
+	} else {
+		entry.Label = request.Label
+		tokens[hash] = entry
+	}
+
+	err := saveTokens(tokens)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodDelete {
+		json.NewEncoder(w).Encode(true)
+		return
+	}
+	json.NewEncoder(w).Encode(entry.info())
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAuthorizeToken(t *testing.T) {
+	router := testRouter("/zones", "/zones/{name}", "/devices", "/users", "/tokens", "/plugins/{uri}/{rest:.*}")
+
+	tests := []struct {
+		name    string
+		scopes  []string
+		method  string
+		path    string
+		allowed bool
+	}{
+		{"all", []string{"*"}, "PUT", "/users", true},
+		{"read", []string{"zones:read"}, "GET", "/zones/lan", true},
+		{"read preflight", []string{"zones:read"}, "OPTIONS", "/zones/lan", true},
+		{"read denies write", []string{"zones:read"}, "PUT", "/zones/lan", false},
+		{"write includes read", []string{"zones:write"}, "GET", "/zones", true},
+		{"write", []string{"zones:write"}, "DELETE", "/zones/lan", true},
+		{"other resource", []string{"zones:write"}, "GET", "/devices", false},
+		{"several scopes", []string{"zones:read", "devices:read"}, "GET", "/devices", true},
+		{"unscoped route", []string{"zones:write"}, "GET", "/users", false},
+		{"tokens need all", []string{"zones:write", "devices:write"}, "PUT", "/tokens", false},
+		{"plugin", []string{"plugins:read"}, "GET", "/plugins/sample/test", true},
+		{"no scopes", []string{}, "GET", "/zones", false},
+		{"unknown route", []string{"zones:read"}, "GET", "/nowhere", false},
+	}
+
+	for _, test := range tests {
+		r, match := matchRequest(router, test.method, test.path)
+		if authorizeToken(APIToken{Scopes: test.scopes}, r, match) != test.allowed {
+			t.Errorf("%s: expected allowed %v", test.name, test.allowed)
+		}
+	}
+}
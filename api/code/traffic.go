@@ -14,10 +14,9 @@ import (
 import (
   "github.com/gorilla/mux"
   "github.com/influxdata/influxdb-client-go/v2"
+  "github.com/influxdata/influxdb-client-go/v2/api/write"
 )
 
-var IFDB influxdb2.Client = nil
-
 type TrafficElement struct {
 	IP      string
 	Packets uint64
@@ -85,12 +84,21 @@ func parseIPTrafficElements(elements []interface{}) []IPTrafficElement {
 	return traffic
 }
 
+// traffic is accounted for in the ip and ip6 accounting tables
 func getDeviceTrafficSet(setName string) []TrafficElement {
-	cmd := exec.Command("nft", "-j", "list", "set", "ip", "accounting", setName)
+	traffic := getDeviceTrafficSetFamily("ip", setName)
+	if traffic == nil {
+		return nil
+	}
+	return append(traffic, getDeviceTrafficSetFamily("ip6", setName)...)
+}
+
+func getDeviceTrafficSetFamily(family string, setName string) []TrafficElement {
+	cmd := exec.Command("nft", "-j", "list", "set", family, "accounting", setName)
 	stdout, err := cmd.Output()
 
 	if err != nil {
-		fmt.Println("getDeviceTrafficSet failed to list ip accounting",setName,"->",err)
+		fmt.Println("getDeviceTrafficSet failed to list",family,"accounting",setName,"->",err)
 		return nil
 	}
 
@@ -112,6 +120,8 @@ func getDeviceTrafficSet(setName string) []TrafficElement {
 					if ok {
 						return parseTrafficElements(elements)
 					}
+					//the set exists but has no entries yet
+					return []TrafficElement{}
 				}
 			}
 		}
@@ -136,12 +146,20 @@ func getDeviceTraffic(w http.ResponseWriter, r *http.Request) {
 }
 
 func getIPTrafficSet() []IPTrafficElement {
+	traffic := getIPTrafficSetFamily("ip")
+	if traffic == nil {
+		return nil
+	}
+	return append(traffic, getIPTrafficSetFamily("ip6")...)
+}
+
+func getIPTrafficSetFamily(family string) []IPTrafficElement {
 	setName := "all_ip"
-	cmd := exec.Command("nft", "-j", "list", "set", "ip", "accounting", setName)
+	cmd := exec.Command("nft", "-j", "list", "set", family, "accounting", setName)
 	stdout, err := cmd.Output()
 
 	if err != nil {
-		fmt.Println("getIPTrafficSet failed to list ip accounting", setName, err)
+		fmt.Println("getIPTrafficSet failed to list", family, "accounting", setName, err)
 		return nil
 	}
 
@@ -197,14 +215,22 @@ type DeviceHistory struct {
 	Days    [30]NetCount
 }
 
+// index 0 of each rollup holds the current minute, hour and day
 type TrafficHistory struct {
 	Devices map[string]DeviceHistory
+	//counter readings of the last collection, to compute the deltas
+	Counters map[string]NetCount
+	Updated  time.Time
 }
 
 var Trafficmtx sync.Mutex
 var TrafficStatePath = "/state/api/traffic.json"
 var gTrafficHistory = []map[string]*NetCount{}
 
+var TrafficSaveInterval = 10 * time.Minute
+var Rollupmtx sync.Mutex
+var gTrafficRollups = TrafficHistory{Devices: map[string]DeviceHistory{}, Counters: map[string]NetCount{}}
+
 func loadTrafficHistory() (TrafficHistory, error) {
 	Trafficmtx.Lock()
 	defer Trafficmtx.Unlock()
@@ -230,12 +256,207 @@ func saveTrafficHistory(t TrafficHistory) {
 	file, _ := json.MarshalIndent(t, "", " ")
 	err := ioutil.WriteFile(TrafficStatePath, file, 0644)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("failed to save traffic history", err)
 	}
 	return
 }
 
-func collectBandwithStats() {
+func (c *NetCount) add(delta NetCount) {
+	c.LanIn += delta.LanIn
+	c.LanOut += delta.LanOut
+	c.WanIn += delta.WanIn
+	c.WanOut += delta.WanOut
+}
+
+func counterDelta(last uint64, current uint64) uint64 {
+	if current < last {
+		//the accounting set entry timed out and counts from zero again
+		return current
+	}
+	return current - last
+}
+
+// shiftCounts moves the rollup n periods into the past
+func shiftCounts(counts []NetCount, n int) {
+	if n <= 0 {
+		return
+	}
+	if n > len(counts) {
+		n = len(counts)
+	}
+	copy(counts[n:], counts[:len(counts)-n])
+	for i := 0; i < n; i++ {
+		counts[i] = NetCount{}
+	}
+}
+
+func dayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func trafficPeriods(from time.Time, to time.Time) (int, int, int) {
+	minutes := int(to.Truncate(time.Minute).Sub(from.Truncate(time.Minute)) / time.Minute)
+	hours := int(to.Truncate(time.Hour).Sub(from.Truncate(time.Hour)) / time.Hour)
+	days := int((dayStart(to).Sub(dayStart(from)) + 12*time.Hour) / (24 * time.Hour))
+	return minutes, hours, days
+}
+
+// rollupTraffic adds the deltas of a collection to the minute, hour and day
+// rollups of every device. The last counters of addresses missing from the
+// collection are kept, so that their traffic is not counted twice when they
+// show up again
+func rollupTraffic(history *TrafficHistory, readings map[string]*NetCount, now time.Time) {
+	if len(readings) == 0 {
+		//the accounting sets could not be read
+		return
+	}
+
+	firstRun := history.Updated.IsZero()
+	minutes, hours, days := trafficPeriods(history.Updated, now)
+
+	for ip, device := range history.Devices {
+		if !firstRun {
+			shiftCounts(device.Minutes[:], minutes)
+			shiftCounts(device.Hours[:], hours)
+			shiftCounts(device.Days[:], days)
+		}
+		history.Devices[ip] = device
+	}
+
+	counters := map[string]NetCount{}
+	for ip, counter := range history.Counters {
+		counters[ip] = counter
+	}
+
+	for ip, reading := range readings {
+		counters[ip] = *reading
+
+		last, known := history.Counters[ip]
+		if !known && firstRun {
+			//nothing to compare the very first readings to
+			continue
+		}
+
+		//an address without a previous counter has a new set entry
+		delta := NetCount{
+			LanIn:  counterDelta(last.LanIn, reading.LanIn),
+			LanOut: counterDelta(last.LanOut, reading.LanOut),
+			WanIn:  counterDelta(last.WanIn, reading.WanIn),
+			WanOut: counterDelta(last.WanOut, reading.WanOut),
+		}
+
+		device := history.Devices[ip]
+		device.Minutes[0].add(delta)
+		device.Hours[0].add(delta)
+		device.Days[0].add(delta)
+		history.Devices[ip] = device
+	}
+
+	//devices without traffic in the last 30 days are dropped, along with
+	// the counters of addresses that are gone
+	for ip, device := range history.Devices {
+		if device.Days == [30]NetCount{} {
+			if _, exists := readings[ip]; !exists {
+				delete(history.Devices, ip)
+			}
+		}
+	}
+	for ip := range counters {
+		_, read := readings[ip]
+		_, tracked := history.Devices[ip]
+		if !read && !tracked {
+			delete(counters, ip)
+		}
+	}
+
+	history.Counters = counters
+	history.Updated = now
+}
+
+type TrafficSample struct {
+	Time    time.Time
+	Devices map[string]NetCount
+}
+
+// trafficSamples returns the rollups of a resolution within a time range,
+// most recent first
+func trafficSamples(history TrafficHistory, resolution string, start time.Time, end time.Time) ([]TrafficSample, error) {
+	var count int
+	var bucket func(i int) time.Time
+	var value func(device DeviceHistory, i int) NetCount
+
+	switch resolution {
+	case "minute":
+		count = 60
+		bucket = func(i int) time.Time { return history.Updated.Truncate(time.Minute).Add(-time.Duration(i) * time.Minute) }
+		value = func(device DeviceHistory, i int) NetCount { return device.Minutes[i] }
+	case "hour":
+		count = 24
+		bucket = func(i int) time.Time { return history.Updated.Truncate(time.Hour).Add(-time.Duration(i) * time.Hour) }
+		value = func(device DeviceHistory, i int) NetCount { return device.Hours[i] }
+	case "day":
+		count = 30
+		bucket = func(i int) time.Time { return dayStart(history.Updated).AddDate(0, 0, -i) }
+		value = func(device DeviceHistory, i int) NetCount { return device.Days[i] }
+	default:
+		return nil, fmt.Errorf("invalid resolution %q", resolution)
+	}
+
+	samples := []TrafficSample{}
+	if history.Updated.IsZero() {
+		return samples, nil
+	}
+
+	for i := 0; i < count; i++ {
+		t := bucket(i)
+		if t.After(end) || t.Before(start) {
+			continue
+		}
+		sample := TrafficSample{Time: t, Devices: map[string]NetCount{}}
+		for ip, device := range history.Devices {
+			if v := value(device, i); v != (NetCount{}) {
+				sample.Devices[ip] = v
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+func collectTrafficRollups() {
+	Rollupmtx.Lock()
+	defer Rollupmtx.Unlock()
+
+	if len(gTrafficHistory) > 0 {
+		rollupTraffic(&gTrafficRollups, gTrafficHistory[0], time.Now())
+	}
+}
+
+func persistTrafficRollups() {
+	Rollupmtx.Lock()
+	defer Rollupmtx.Unlock()
+	saveTrafficHistory(gTrafficRollups)
+}
+
+func restoreTrafficRollups() {
+	history, err := loadTrafficHistory()
+	if err != nil {
+		return
+	}
+	if history.Devices == nil {
+		history.Devices = map[string]DeviceHistory{}
+	}
+	if history.Counters == nil {
+		history.Counters = map[string]NetCount{}
+	}
+
+	Rollupmtx.Lock()
+	gTrafficRollups = history
+	Rollupmtx.Unlock()
+}
+
+// collectBandwithStats returns false when the accounting sets could not be read
+func collectBandwithStats() bool {
 	historyLimit := 60 * 24
 
 	readings := make(map[string]*NetCount)
@@ -245,6 +466,12 @@ func collectBandwithStats() {
 	wan_out := getDeviceTrafficSet("outgoing_traffic_wan")
 	wan_in := getDeviceTrafficSet("incoming_traffic_wan")
 
+	//a partial collection would reset the counters of the missing sets
+	if lan_in == nil || lan_out == nil || wan_out == nil || wan_in == nil {
+		fmt.Println("skipping traffic collection, the accounting sets could not be read")
+		return false
+	}
+
 	for _, entry := range lan_out {
 		_, exists := readings[entry.IP]
 		if !exists {
@@ -287,25 +514,37 @@ func collectBandwithStats() {
 	}
 	//prepend readings
 	gTrafficHistory = append([]map[string]*NetCount{readings}, gTrafficHistory[:end]...)
+	return true
 }
 
 func collectIPTrafficStats() {
 
-	//send IP traffic data to Influx
-	if IFDB != nil {
-		writeAPI := IFDB.WriteAPI(config.InfluxDB.Org, config.InfluxDB.Bucket)
+	//send IP traffic data to Influx, one batch per collection
+	if gInflux != nil {
+		macs := getAddressMACs()
+		zones := getClientZoneNames()
+		now := time.Now()
 
+		points := []*write.Point{}
 		for _, entry := range getIPTrafficSet() {
 			p := influxdb2.NewPointWithMeasurement("IP").
 				AddTag("Src", entry.Src).
 				AddTag("Dst", entry.Dst).
 				AddField("Bytes", entry.Bytes).
-				AddField("Packets", entry.Packets)
+				AddField("Packets", entry.Packets).
+				SetTime(now)
 
-			writeAPI.WritePoint(p)
-			writeAPI.Flush()
+			if mac, exists := macs[entry.Src]; exists {
+				p.AddTag("SrcMAC", mac).AddTag("SrcZone", zones[mac])
+			}
+			if mac, exists := macs[entry.Dst]; exists {
+				p.AddTag("DstMAC", mac).AddTag("DstZone", zones[mac])
+			}
 
+			points = append(points, p)
 		}
+
+		gInflux.Enqueue(points)
 	}
 }
 
@@ -313,11 +552,20 @@ func trafficTimer() {
 
 	runTimer := func() {
 		ticker := time.NewTicker(1 * time.Minute)
+		lastSave := time.Now()
 		for {
 			select {
 			case <-ticker.C:
 
-				collectBandwithStats()
+				if collectBandwithStats() {
+					collectTrafficRollups()
+					if time.Since(lastSave) >= TrafficSaveInterval {
+						persistTrafficRollups()
+						lastSave = time.Now()
+					}
+
+					checkQuotas(gTrafficHistory[0])
+				}
 
 				collectIPTrafficStats()
 			}
@@ -327,13 +575,50 @@ func trafficTimer() {
 	go runTimer()
 }
 
+// without a resolution the raw counter readings of the last day are returned.
+// resolution is minute, hour or day and start, end are RFC3339 times
 func getTrafficHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	resolution := query.Get("resolution")
+	if resolution == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(gTrafficHistory)
+		return
+	}
+
+	start := time.Time{}
+	end := time.Now()
+	var err error
+	if query.Get("start") != "" {
+		start, err = time.Parse(time.RFC3339, query.Get("start"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	if query.Get("end") != "" {
+		end, err = time.Parse(time.RFC3339, query.Get("end"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	Rollupmtx.Lock()
+	samples, err := trafficSamples(gTrafficRollups, resolution, start, end)
+	Rollupmtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(gTrafficHistory)
+	json.NewEncoder(w).Encode(samples)
 }
 
 func initTraffic(config APIConfig) {
+  restoreTrafficRollups()
   if config.InfluxDB.URL != "" && config.InfluxDB.Token != "" {
-		IFDB = influxdb2.NewClient(config.InfluxDB.URL, config.InfluxDB.Token)
+		gInflux = newInfluxExporter(config.InfluxDB)
 	}
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		last    uint64
+		current uint64
+		delta   uint64
+	}{
+		{0, 0, 0},
+		{100, 150, 50},
+		{100, 100, 0},
+		//the set entry timed out and started over
+		{100, 40, 40},
+	}
+
+	for _, test := range tests {
+		if delta := counterDelta(test.last, test.current); delta != test.delta {
+			t.Errorf("counterDelta(%d, %d) = %d, expected %d", test.last, test.current, delta, test.delta)
+		}
+	}
+}
+
+func TestTrafficPeriods(t *testing.T) {
+	from := time.Date(2026, 10, 17, 23, 59, 30, 0, time.UTC)
+
+	tests := []struct {
+		to                   time.Time
+		minutes, hours, days int
+	}{
+		{from.Add(10 * time.Second), 0, 0, 0},
+		{from.Add(40 * time.Second), 1, 1, 1},
+		{from.Add(2 * time.Hour), 120, 2, 1},
+	}
+
+	for _, test := range tests {
+		minutes, hours, days := trafficPeriods(from, test.to)
+		if minutes != test.minutes || hours != test.hours || days != test.days {
+			t.Errorf("trafficPeriods to %v = %d, %d, %d, expected %d, %d, %d", test.to, minutes, hours, days, test.minutes, test.hours, test.days)
+		}
+	}
+}
+
+func TestRollupTraffic(t *testing.T) {
+	start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	reading := func(wanIn uint64) *NetCount {
+		return &NetCount{WanIn: wanIn}
+	}
+
+	tests := []struct {
+		name        string
+		collections []map[string]*NetCount
+		//wan in of the current day of each address
+		days     map[string]uint64
+		counters map[string]uint64
+	}{
+		{"first collection sets the baseline",
+			[]map[string]*NetCount{{"10.0.0.1": reading(100)}},
+			map[string]uint64{},
+			map[string]uint64{"10.0.0.1": 100}},
+		{"deltas are added",
+			[]map[string]*NetCount{{"10.0.0.1": reading(100)}, {"10.0.0.1": reading(150)}, {"10.0.0.1": reading(175)}},
+			map[string]uint64{"10.0.0.1": 75},
+			map[string]uint64{"10.0.0.1": 175}},
+		{"failed read keeps the counters",
+			[]map[string]*NetCount{{"10.0.0.1": reading(100)}, {}, {"10.0.0.1": reading(150)}},
+			map[string]uint64{"10.0.0.1": 50},
+			map[string]uint64{"10.0.0.1": 150}},
+		{"missing address keeps its counter",
+			[]map[string]*NetCount{
+				{"10.0.0.1": reading(100), "10.0.0.2": reading(100)},
+				{"10.0.0.1": reading(110), "10.0.0.2": reading(120)},
+				{"10.0.0.1": reading(120)},
+				{"10.0.0.1": reading(130), "10.0.0.2": reading(125)},
+			},
+			map[string]uint64{"10.0.0.1": 30, "10.0.0.2": 25},
+			map[string]uint64{"10.0.0.1": 130, "10.0.0.2": 125}},
+		{"new address counts from zero",
+			[]map[string]*NetCount{{"10.0.0.1": reading(100)}, {"10.0.0.1": reading(100), "10.0.0.2": reading(30)}},
+			map[string]uint64{"10.0.0.2": 30},
+			map[string]uint64{"10.0.0.1": 100, "10.0.0.2": 30}},
+		{"counters of idle addresses are dropped",
+			[]map[string]*NetCount{{"10.0.0.1": reading(100), "10.0.0.2": reading(100)}, {"10.0.0.1": reading(110)}},
+			map[string]uint64{"10.0.0.1": 10},
+			map[string]uint64{"10.0.0.1": 110}},
+	}
+
+	for _, test := range tests {
+		history := TrafficHistory{Devices: map[string]DeviceHistory{}, Counters: map[string]NetCount{}}
+		for i, readings := range test.collections {
+			rollupTraffic(&history, readings, start.Add(time.Duration(i)*time.Minute))
+		}
+
+		for ip, device := range history.Devices {
+			if device.Days[0].WanIn != test.days[ip] {
+				t.Errorf("%s: %s has %d bytes, expected %d", test.name, ip, device.Days[0].WanIn, test.days[ip])
+			}
+		}
+		for ip, expected := range test.days {
+			if _, exists := history.Devices[ip]; !exists && expected != 0 {
+				t.Errorf("%s: %s is missing", test.name, ip)
+			}
+		}
+
+		if len(history.Counters) != len(test.counters) {
+			t.Errorf("%s: counters %v, expected %v", test.name, history.Counters, test.counters)
+		}
+		for ip, expected := range test.counters {
+			if history.Counters[ip].WanIn != expected {
+				t.Errorf("%s: counter of %s is %d, expected %d", test.name, ip, history.Counters[ip].WanIn, expected)
+			}
+		}
+	}
+}
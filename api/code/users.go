@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+import (
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Accounts for basic authentication. Passwords are stored as bcrypt hashes
+// and every account has a role. Admins may use every route, viewers only
+// the read only routes listed in viewerRoutes.
+
+type UserAccount struct {
+	Name string
+	Role string
+	Hash string
+}
+
+// UserInfo is the view of an account returned by the api
+type UserInfo struct {
+	Name string
+	Role string
+}
+
+type UserUpdate struct {
+	Password string
+	Role     string
+	//required when users change their own password
+	CurrentPassword string `json:",omitempty"`
+}
+
+var Usersmtx sync.Mutex
+var UsersPath = TEST_PREFIX + "/state/api/users.json"
+
+// plaintext passwords of earlier versions, hashed into UsersPath on startup
+var LegacyUsersPath = TEST_PREFIX + "/state/api/auth_users"
+
+var MinPasswordLength = 8
+
+const (
+	RoleAdmin  = "admin"
+	RoleViewer = "viewer"
+)
+
+var userRoles = []string{RoleAdmin, RoleViewer}
+
+// routes open to viewers, by path template
+var viewerRoutes = map[string][]string{
+	"/status":               {"GET"},
+	"/devices":              {"GET"},
+	"/devices/{mac}":        {"GET"},
+	"/traffic/{name}":       {"GET"},
+	"/traffic_history":      {"GET"},
+	"/iptraffic":            {"GET"},
+	"/arp":                  {"GET"},
+	"/ip/addr":              {"GET"},
+	"/reconcile/status":     {"GET"},
+	"/zones":                {"GET"},
+	"/zones/{name}":         {"GET"},
+	"/zones/{name}/ports":   {"GET"},
+	"/schedules":            {"GET"},
+	"/quotas":               {"GET"},
+	"/metrics":              {"GET"},
+	"/hostapd/status":       {"GET"},
+	"/hostapd/all_stations": {"GET"},
+}
+
+// password checks that succeeded, so that bcrypt only runs once per
+// password instead of on every request. Guarded by Usersmtx
+var gVerifiedPasswords = map[string][32]byte{}
+
+// a hash compared against for unknown users, to not reveal which names exist
+var gDummyHash, _ = bcrypt.GenerateFromPassword([]byte("spr-dummy-password"), bcrypt.DefaultCost)
+
+func loadUsers() map[string]UserAccount {
+	users := map[string]UserAccount{}
+	data, err := ioutil.ReadFile(UsersPath)
+	if err != nil {
+		return users
+	}
+	err = json.Unmarshal(data, &users)
+	if err != nil {
+		fmt.Println("failed to load users", err)
+	}
+	return users
+}
+
+func saveUsers(users map[string]UserAccount) error {
+	file, _ := json.MarshalIndent(users, "", " ")
+	return ioutil.WriteFile(UsersPath, file, 0600)
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// migrateLegacyUsers hashes the plaintext accounts into the user store as
+// admins and removes the plaintext file
+func migrateLegacyUsers() error {
+	data, err := ioutil.ReadFile(LegacyUsersPath)
+	if err != nil {
+		return nil
+	}
+
+	legacy := map[string]string{}
+	err = json.Unmarshal(data, &legacy)
+	if err != nil {
+		return err
+	}
+
+	users := loadUsers()
+	for name, password := range legacy {
+		if _, exists := users[name]; exists {
+			continue
+		}
+		hash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+		users[name] = UserAccount{name, RoleAdmin, hash}
+	}
+
+	err = saveUsers(users)
+	if err != nil {
+		return err
+	}
+	return os.Remove(LegacyUsersPath)
+}
+
+func initUsers() {
+	Usersmtx.Lock()
+	defer Usersmtx.Unlock()
+
+	err := migrateLegacyUsers()
+	if err != nil {
+		fmt.Println("failed to migrate users", err)
+	}
+}
+
+func passwordDigest(account UserAccount, password string) [32]byte {
+	return sha256.Sum256([]byte(account.Hash + "\x00" + password))
+}
+
+// verifyUserPassword returns the account of a user when the password matches
+func verifyUserPassword(name string, password string) (UserAccount, bool) {
+	Usersmtx.Lock()
+	defer Usersmtx.Unlock()
+
+	account, exists := loadUsers()[name]
+	if !exists {
+		bcrypt.CompareHashAndPassword(gDummyHash, []byte(password))
+		return UserAccount{}, false
+	}
+
+	digest := passwordDigest(account, password)
+	verified, cached := gVerifiedPasswords[name]
+	if cached && subtle.ConstantTimeCompare(digest[:], verified[:]) == 1 {
+		return account, true
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(account.Hash), []byte(password))
+	if err != nil {
+		return UserAccount{}, false
+	}
+	gVerifiedPasswords[name] = digest
+	return account, true
+}
+
+// viewerAllowed reports whether viewers may use a method on a route template
+func viewerAllowed(template string, method string) bool {
+	for _, entry := range viewerRoutes[template] {
+		if entry == method {
+			return true
+		}
+	}
+	return false
+}
+
+// accountScopes returns the token scopes that match the role of an account,
+// for the checks that go by scope such as the identity sent to plugins. A
+// viewer holds the read scope of a resource only when viewerRoutes opens
+// every route of that resource
+func accountScopes(account UserAccount) []string {
+	if account.Role == RoleAdmin {
+		return []string{ScopeAll}
+	}
+
+	scopes := []string{}
+	if account.Role == RoleViewer {
+		readable := map[string]bool{}
+		for template, resource := range routeScopes {
+			if _, seen := readable[resource]; !seen {
+				readable[resource] = true
+			}
+			if !viewerAllowed(template, http.MethodGet) {
+				readable[resource] = false
+			}
+		}
+		for resource, allowed := range readable {
+			if allowed {
+				scopes = append(scopes, resource+":read")
+			}
+		}
+		sort.Strings(scopes)
+	}
+	return scopes
+}
+
+// authorizeUser reports whether the role of an account permits the matched route
+func authorizeUser(account UserAccount, r *http.Request, match *mux.RouteMatch) bool {
+	if account.Role == RoleAdmin {
+		return true
+	}
+
+	if r.Method == http.MethodOptions {
+		return true
+	}
+
+	if match.Route == nil {
+		return false
+	}
+	template, err := match.Route.GetPathTemplate()
+	if err != nil {
+		return false
+	}
+
+	//every user may change their own password
+	if template == "/users/{name}/password" && match.Vars["name"] == account.Name {
+		return true
+	}
+
+	return account.Role == RoleViewer && viewerAllowed(template, r.Method)
+}
+
+func validateUserRole(role string) error {
+	for _, entry := range userRoles {
+		if entry == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid role %q", role)
+}
+
+func validatePassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("passwords must have at least %d characters", MinPasswordLength)
+	}
+	return nil
+}
+
+func countAdmins(users map[string]UserAccount) int {
+	count := 0
+	for _, account := range users {
+		if account.Role == RoleAdmin {
+			count++
+		}
+	}
+	return count
+}
+
+func getUsers(w http.ResponseWriter, r *http.Request) {
+	Usersmtx.Lock()
+	defer Usersmtx.Unlock()
+
+	users := []UserInfo{}
+	for _, account := range loadUsers() {
+		users = append(users, UserInfo{account.Name, account.Role})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// putUser creates an account or updates the role and password of an account
+func putUser(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	update := UserUpdate{}
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if !zoneNameRe.MatchString(name) {
+		http.Error(w, "invalid user name", 400)
+		return
+	}
+
+	Usersmtx.Lock()
+	defer Usersmtx.Unlock()
+
+	users := loadUsers()
+	account, exists := users[name]
+	if !exists {
+		account = UserAccount{Name: name}
+		if update.Password == "" {
+			http.Error(w, "a password is required for new users", 400)
+			return
+		}
+	}
+
+	if update.Role != "" {
+		err = validateUserRole(update.Role)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if account.Role == RoleAdmin && update.Role != RoleAdmin && countAdmins(users) == 1 {
+			http.Error(w, "the last admin can not be demoted", 400)
+			return
+		}
+		account.Role = update.Role
+	} else if !exists {
+		account.Role = RoleViewer
+	}
+
+	if update.Password != "" {
+		err = validatePassword(update.Password)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		account.Hash, err = hashPassword(update.Password)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		delete(gVerifiedPasswords, name)
+	}
+
+	users[name] = account
+	err = saveUsers(users)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserInfo{account.Name, account.Role})
+}
+
+func putUserPassword(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	update := UserUpdate{}
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	err = validatePassword(update.Password)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	Usersmtx.Lock()
+	defer Usersmtx.Unlock()
+
+	users := loadUsers()
+	account, exists := users[name]
+	if !exists {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	//admins and tokens with the users scope may reset any password, everyone
+	//else has to prove the current one
+	caller, _ := pluginCaller(r)
+	if caller.Role != RoleAdmin && caller.Role != RoleToken {
+		source := auditSource(r)
+		if wait, locked := loginLocked(source, name); locked {
+			lockedOut(w, wait)
+			return
+		}
+		err = bcrypt.CompareHashAndPassword([]byte(account.Hash), []byte(update.CurrentPassword))
+		if err != nil {
+			recordLoginFailure(source, name)
+			http.Error(w, "the current password does not match", http.StatusForbidden)
+			return
+		}
+	}
+
+	account.Hash, err = hashPassword(update.Password)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	users[name] = account
+	delete(gVerifiedPasswords, name)
+
+	err = saveUsers(users)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(true)
+}
+
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	Usersmtx.Lock()
+	defer Usersmtx.Unlock()
+
+	users := loadUsers()
+	account, exists := users[name]
+	if !exists {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if account.Role == RoleAdmin && countAdmins(users) == 1 {
+		http.Error(w, "the last admin can not be deleted", 400)
+		return
+	}
+
+	delete(users, name)
+	delete(gVerifiedPasswords, name)
+
+	err := saveUsers(users)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(true)
+}
@@ -6,19 +6,140 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 import (
 	"github.com/gorilla/websocket"
 )
 
-var WSClients []*websocket.Conn
+type wsClient struct {
+	conn *websocket.Conn
+	//account, token or plugin, limiting the events sent
+	caller PluginCaller
+	//messages waiting for the writer, a client that falls this far behind
+	// is dropped
+	queue chan wsOutgoing
+	done  chan struct{}
+	once  sync.Once
+
+	//guards the fields below
+	mtx sync.Mutex
+	//set once the client subscribed, until then every event is sent in
+	// the original {Type, Data} form
+	subscribed bool
+	types      map[string]bool
+	macs       map[string]bool
+	//last sequence number handled by the writer
+	lastSeq uint64
+	//bumped by a replay, messages queued before it are dropped
+	gen uint64
+}
+
+type wsOutgoing struct {
+	message WSMessage
+	//written as is when set
+	raw []byte
+	gen uint64
+}
+
+var WSClients []*wsClient
 var WSMtx sync.Mutex
 
-var WSNotify = make(chan WSMessage)
+// events waiting for the broadcaster. Publishing never blocks, events are
+// dropped when the broadcaster falls this far behind
+var WSNotifyQueueSize = 1024
+var WSNotify = make(chan WSMessage, WSNotifyQueueSize)
+
+// events kept for clients that resume from a sequence number
+var WSReplaySize = 512
+
+// larger than WSReplaySize so that a replay fits
+var WSClientQueueSize = 1024
+
+var WSWriteTimeout = 10 * time.Second
+var WSPingInterval = 30 * time.Second
+var WSPongTimeout = 2 * WSPingInterval
+var WSAuthTimeout = 30 * time.Second
+
+// guarded by WSMtx
+var gWSSeq uint64
+var gWSReplay = []WSMessage{}
 
 type WSMessage struct {
 	Type string
 	Data string
+	Seq  uint64
+	Time time.Time
+
+	value json.RawMessage
+	mac   string
+}
+
+// WSEvent is the form of a message sent to subscribed clients, with the
+// data as json instead of a string
+type WSEvent struct {
+	Seq  uint64
+	Time time.Time
+	Type string
+	MAC  string `json:",omitempty"`
+	Data json.RawMessage
+}
+
+// WSSubscription is sent by a client after authenticating. Empty lists
+// subscribe to every type or device
+type WSSubscription struct {
+	Types []string
+	MACs  []string
+	//replay the buffered events after this sequence number
+	Since *uint64
+}
+
+// route of every event type, clients need read access to it. Types not
+// listed, such as audit entries, lockouts and plugin status, are only sent
+// to clients with "*"
+var wsEventRoutes = map[string]string{
+	"StatusCalled":        "/status",
+	"InfluxWriteFailed":   "/status",
+	"DHCPUpdateRequest":   "/devices",
+	"DHCPUpdateProcessed": "/devices",
+	"DHCPUpdateFailed":    "/devices",
+	"DeviceDiscovered":    "/devices",
+	"PSKAuthFailure":      "/pendingPSK",
+	"PSKAuthSuccess":      "/pendingPSK",
+	"QuotaExceeded":       "/quotas",
+	"QuotaRestored":       "/quotas",
+	"ReconcileFixed":      "/reconcile/status",
+	"VerdictMapsRestored": "/reconcile/status",
+	"ScheduleTransition":  "/schedules",
+}
+
+type WSReplayGap struct {
+	Since  uint64
+	Oldest uint64
+}
+
+// findMAC returns the first MAC or Mac field in a json document
+func findMAC(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range []string{"MAC", "Mac"} {
+			if mac, ok := v[key].(string); ok && mac != "" {
+				return trimLower(mac)
+			}
+		}
+		for _, entry := range v {
+			if mac := findMAC(entry); mac != "" {
+				return mac
+			}
+		}
+	case []interface{}:
+		for _, entry := range v {
+			if mac := findMAC(entry); mac != "" {
+				return mac
+			}
+		}
+	}
+	return ""
 }
 
 func WSNotifyValue(msg_type string, data interface{}) {
@@ -26,29 +147,153 @@ func WSNotifyValue(msg_type string, data interface{}) {
 	if err != nil {
 		panic(err)
 	}
-	WSNotify <- WSMessage{msg_type, string(bytes)}
+
+	var decoded interface{}
+	json.Unmarshal(bytes, &decoded)
+
+	wsPublish(WSMessage{Type: msg_type, Data: string(bytes), value: bytes, mac: findMAC(decoded)})
 }
 
 func WSNotifyString(msg_type string, data string) {
-	WSNotify <- WSMessage{msg_type, data}
+	bytes, _ := json.Marshal(data)
+	wsPublish(WSMessage{Type: msg_type, Data: data, value: bytes})
+}
+
+func wsPublish(message WSMessage) {
+	select {
+	case WSNotify <- message:
+		metricWSEvents.Inc()
+	default:
+		metricWSEventsDropped.Inc()
+	}
+}
+
+// allowed reports whether the caller of a client may read an event type
+func (c *wsClient) allowed(msg_type string) bool {
+	if hasScope(c.caller.Scopes, ScopeAll) {
+		return true
+	}
+	template, exists := wsEventRoutes[msg_type]
+	return exists && c.caller.mayRead(template)
+}
+
+// wants reports whether a message passes the scopes and subscription of the
+// client, the caller holds c.mtx
+func (c *wsClient) wants(message WSMessage) bool {
+	if !c.allowed(message.Type) {
+		return false
+	}
+	if len(c.types) > 0 && !c.types[message.Type] {
+		return false
+	}
+	if len(c.macs) > 0 && !c.macs[message.mac] {
+		return false
+	}
+	return true
+}
+
+// encode returns the message in the form of the client, or nil for messages
+// it does not receive. The caller holds c.mtx
+func (c *wsClient) encode(outgoing wsOutgoing) ([]byte, error) {
+	message := outgoing.message
+	//a replay may repeat messages the client got already
+	if outgoing.gen != c.gen || message.Seq <= c.lastSeq {
+		return nil, nil
+	}
+	c.lastSeq = message.Seq
+
+	if !c.wants(message) {
+		return nil, nil
+	}
+	if !c.subscribed {
+		return json.Marshal(message)
+	}
+	return json.Marshal(WSEvent{message.Seq, message.Time, message.Type, message.mac, message.value})
+}
+
+// enqueue hands a message to the writer, dropping the client when its queue
+// is full. The caller holds WSMtx
+func (c *wsClient) enqueue(outgoing wsOutgoing) bool {
+	select {
+	case c.queue <- outgoing:
+		return true
+	default:
+		metricWSClientsDropped.WithLabelValues("overflow").Inc()
+		c.close()
+		return false
+	}
+}
+
+func (c *wsClient) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *wsClient) write(data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(WSWriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// runWriter writes the queued messages and keepalive pings of a client
+func (c *wsClient) runWriter() {
+	defer removeWSClient(c)
+
+	ticker := time.NewTicker(WSPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case outgoing := <-c.queue:
+			data := outgoing.raw
+			if data == nil {
+				c.mtx.Lock()
+				bytes, err := c.encode(outgoing)
+				c.mtx.Unlock()
+				if err != nil || bytes == nil {
+					continue
+				}
+				data = bytes
+			}
+			if c.write(data) != nil {
+				metricWSClientsDropped.WithLabelValues("write").Inc()
+				return
+			}
+		case <-ticker.C:
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WSWriteTimeout))
+			if err != nil {
+				metricWSClientsDropped.WithLabelValues("write").Inc()
+				return
+			}
+		}
+	}
 }
 
 func WSRunBroadcast() {
-	//output a message from the WSNotify channel for each client
+	//queue a message from the WSNotify channel for each client
 	for {
 		message := <-WSNotify
 
-		bytes, err := json.Marshal(message)
-		if err != nil {
-			panic(err)
+		WSMtx.Lock()
+		gWSSeq++
+		message.Seq = gWSSeq
+		message.Time = time.Now()
+
+		gWSReplay = append(gWSReplay, message)
+		if len(gWSReplay) > WSReplaySize {
+			gWSReplay = gWSReplay[len(gWSReplay)-WSReplaySize:]
 		}
 
-		WSMtx.Lock()
 		//use a tmp array to keep track of active clients to keep
 		tmp := WSClients[:0]
 		for _, client := range WSClients {
-			err := client.WriteMessage(websocket.TextMessage, bytes)
-			if err == nil {
+			client.mtx.Lock()
+			gen := client.gen
+			client.mtx.Unlock()
+			if client.enqueue(wsOutgoing{message: message, gen: gen}) {
 				//keep client around
 				tmp = append(tmp, client)
 			}
@@ -59,6 +304,139 @@ func WSRunBroadcast() {
 	}
 }
 
+// subscribe applies a subscription and queues the buffered events the
+// client missed
+func (c *wsClient) subscribe(subscription WSSubscription) {
+	WSMtx.Lock()
+	defer WSMtx.Unlock()
+
+	c.mtx.Lock()
+	c.subscribed = true
+	c.types = map[string]bool{}
+	for _, entry := range subscription.Types {
+		c.types[entry] = true
+	}
+	c.macs = map[string]bool{}
+	for _, entry := range subscription.MACs {
+		c.macs[trimLower(entry)] = true
+	}
+	c.mtx.Unlock()
+
+	if subscription.Since == nil {
+		return
+	}
+	since := *subscription.Since
+
+	//pending messages are in the replay buffer as well, drop them to keep
+	// the replay in order. The writer takes from the queue at the same time,
+	// so the queue may empty out between a length check and a receive
+drain:
+	for {
+		select {
+		case <-c.queue:
+		default:
+			break drain
+		}
+	}
+
+	oldest := gWSSeq + 1
+	if len(gWSReplay) > 0 {
+		oldest = gWSReplay[0].Seq
+	}
+	if since+1 < oldest {
+		//some of the events were dropped from the buffer already
+		bytes, _ := json.Marshal(WSReplayGap{since, oldest})
+		data, _ := json.Marshal(WSEvent{Time: time.Now(), Type: "ReplayGap", Data: bytes})
+		if !c.enqueue(wsOutgoing{raw: data}) {
+			return
+		}
+	}
+
+	c.mtx.Lock()
+	if c.lastSeq > since {
+		c.lastSeq = since
+	}
+	c.gen++
+	gen := c.gen
+	c.mtx.Unlock()
+
+	for _, message := range gWSReplay {
+		if message.Seq > since && !c.enqueue(wsOutgoing{message: message, gen: gen}) {
+			return
+		}
+	}
+}
+
+func removeWSClient(c *wsClient) {
+	c.close()
+
+	WSMtx.Lock()
+	defer WSMtx.Unlock()
+
+	for i, client := range WSClients {
+		if client == c {
+			WSClients = append(WSClients[:i], WSClients[i+1:]...)
+			break
+		}
+	}
+}
+
+// readSubscriptions handles the subscriptions and pongs of a client until it
+// disconnects
+func (c *wsClient) readSubscriptions() {
+	defer removeWSClient(c)
+
+	c.conn.SetReadDeadline(time.Now().Add(WSPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(WSPongTimeout))
+	})
+
+	for {
+		mt, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(WSPongTimeout))
+		if mt != websocket.TextMessage {
+			continue
+		}
+
+		subscription := WSSubscription{}
+		err = json.Unmarshal(msg, &subscription)
+		if err != nil {
+			fmt.Println("invalid websocket subscription", err)
+			continue
+		}
+		c.subscribe(subscription)
+	}
+}
+
+func addWSClient(conn *websocket.Conn, caller PluginCaller) {
+	client := &wsClient{
+		conn:   conn,
+		caller: caller,
+		queue:  make(chan wsOutgoing, WSClientQueueSize),
+		done:   make(chan struct{}),
+	}
+
+	//the writer is not running yet
+	err := client.write([]byte("success"))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	WSMtx.Lock()
+	//the client receives events from here on
+	client.lastSeq = gWSSeq
+	WSClients = append(WSClients, client)
+	WSMtx.Unlock()
+
+	metricWSConnections.Inc()
+	go client.runWriter()
+	go client.readSubscriptions()
+}
+
 func WSRunNotify() {
 	go WSRunBroadcast()
 }
@@ -78,6 +456,7 @@ func (auth *authnconfig) webSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//wait for authentication information
+	c.SetReadDeadline(time.Now().Add(WSAuthTimeout))
 	mt, msg, err := c.ReadMessage()
 	if err != nil {
 		fmt.Println("Invalid auth packet")
@@ -89,26 +468,35 @@ func (auth *authnconfig) webSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	msgs := string(msg)
+	source := auditSource(r)
 	if strings.Index(msgs, ":") != -1 {
 		pieces := strings.SplitN(msgs, ":", 2)
-		if auth.authenticateUser(pieces[0], pieces[1]) {
-			c.WriteMessage(websocket.TextMessage, []byte("success"))
-			WSMtx.Lock()
-			WSClients = append(WSClients, c)
-			WSMtx.Unlock()
+		if _, locked := loginLocked(source, pieces[0]); locked {
+			c.WriteMessage(websocket.TextMessage, []byte("Too many failed logins"))
+			c.Close()
+			return
+		}
+		if caller, ok := auth.authenticateUser(pieces[0], pieces[1]); ok {
+			clearLoginFailures(source, pieces[0])
+			addWSClient(c, caller)
 			fmt.Println("auth success")
 			return
 		}
+		recordLoginFailure(source, pieces[0])
 	} else {
 		token := msgs
-		if auth.authenticateToken(token) {
-			c.WriteMessage(websocket.TextMessage, []byte("success"))
-			WSMtx.Lock()
-			WSClients = append(WSClients, c)
-			WSMtx.Unlock()
+		if _, locked := loginLocked(source, ""); locked {
+			c.WriteMessage(websocket.TextMessage, []byte("Too many failed logins"))
+			c.Close()
+			return
+		}
+		if caller, ok := auth.authenticateToken(token); ok {
+			clearLoginFailures(source, "")
+			addWSClient(c, caller)
 			fmt.Println("auth success")
 			return
 		}
+		recordLoginFailure(source, "")
 	}
 	c.WriteMessage(websocket.TextMessage, []byte("Authentication failure"))
 	c.Close()
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+func TestWSClientWants(t *testing.T) {
+	token := func(scopes []string) PluginCaller {
+		return PluginCaller{Role: RoleToken, Scopes: scopes}
+	}
+	admin := PluginCaller{Role: RoleAdmin, Scopes: []string{ScopeAll}}
+	viewer := PluginCaller{Role: RoleViewer}
+
+	tests := []struct {
+		name   string
+		caller PluginCaller
+		types  []string
+		macs   []string
+		event  string
+		mac    string
+		wants  bool
+	}{
+		{"admin", admin, nil, nil, "AuditEntry", "", true},
+		{"admin subscribed", admin, []string{"DHCPUpdateRequest"}, nil, "AuditEntry", "", false},
+		{"viewer device event", viewer, nil, nil, "DHCPUpdateRequest", "aa:bb:cc:dd:ee:ff", true},
+		{"viewer audit entry", viewer, nil, nil, "AuditEntry", "", false},
+		{"viewer lockout", viewer, nil, nil, "LoginLockout", "", false},
+		{"viewer plugin status", viewer, nil, nil, "PluginStatus", "", false},
+		{"viewer schedule event", viewer, nil, nil, "ScheduleTransition", "", true},
+		{"viewer psk event", viewer, nil, nil, "PSKAuthSuccess", "", false},
+		{"token device event", token([]string{"devices:read"}), nil, nil, "DHCPUpdateRequest", "", true},
+		{"write scope", token([]string{"quotas:write"}), nil, nil, "QuotaExceeded", "", true},
+		{"other resource", token([]string{"traffic:read"}), nil, nil, "QuotaExceeded", "", false},
+		{"no scopes", token([]string{}), nil, nil, "StatusCalled", "", false},
+		{"unknown type", token([]string{"devices:read", "status:read"}), nil, nil, "SomethingNew", "", false},
+		{"subscribed type", token([]string{"devices:read"}), []string{"DeviceDiscovered"}, nil, "DeviceDiscovered", "", true},
+		{"other type", token([]string{"devices:read"}), []string{"DeviceDiscovered"}, nil, "DHCPUpdateRequest", "", false},
+		{"subscribed mac", token([]string{"devices:read"}), nil, []string{"AA:BB:CC:DD:EE:FF"}, "DHCPUpdateRequest", "aa:bb:cc:dd:ee:ff", true},
+		{"other mac", token([]string{"devices:read"}), nil, []string{"aa:bb:cc:dd:ee:ff"}, "DHCPUpdateRequest", "11:22:33:44:55:66", false},
+		{"mac of unscoped event", token([]string{"psk:read"}), nil, []string{"aa:bb:cc:dd:ee:ff"}, "DHCPUpdateRequest", "aa:bb:cc:dd:ee:ff", false},
+	}
+
+	for _, test := range tests {
+		client := &wsClient{caller: test.caller}
+		if test.types != nil || test.macs != nil {
+			//subscribe without a connection, as in wsClient.subscribe
+			client.subscribed = true
+			client.types = map[string]bool{}
+			for _, entry := range test.types {
+				client.types[entry] = true
+			}
+			client.macs = map[string]bool{}
+			for _, entry := range test.macs {
+				client.macs[trimLower(entry)] = true
+			}
+		}
+		if wants := client.wants(WSMessage{Type: test.event, mac: test.mac}); wants != test.wants {
+			t.Errorf("%s: expected %v", test.name, test.wants)
+		}
+	}
+}
+
+func TestWSClientEncode(t *testing.T) {
+	tests := []struct {
+		name       string
+		subscribed bool
+		seq        uint64
+		lastSeq    uint64
+		event      string
+		sent       bool
+	}{
+		{"original form", false, 5, 4, "DHCPUpdateRequest", true},
+		{"subscribed form", true, 5, 4, "DHCPUpdateRequest", true},
+		{"repeated", true, 4, 4, "DHCPUpdateRequest", false},
+		{"not permitted", false, 5, 4, "AuditEntry", false},
+	}
+
+	for _, test := range tests {
+		client := &wsClient{caller: PluginCaller{Role: RoleToken, Scopes: []string{"devices:read"}}, subscribed: test.subscribed, lastSeq: test.lastSeq}
+		message := WSMessage{Type: test.event, Data: `{"MAC":"aa:bb:cc:dd:ee:ff"}`, Seq: test.seq,
+			value: json.RawMessage(`{"MAC":"aa:bb:cc:dd:ee:ff"}`), mac: "aa:bb:cc:dd:ee:ff"}
+
+		data, err := client.encode(wsOutgoing{message: message})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if (data != nil) != test.sent {
+			t.Errorf("%s: sent %s, expected %v", test.name, data, test.sent)
+			continue
+		}
+		if data == nil {
+			continue
+		}
+
+		if test.subscribed {
+			event := WSEvent{}
+			json.Unmarshal(data, &event)
+			if event.Seq != test.seq || event.MAC != "aa:bb:cc:dd:ee:ff" || string(event.Data) != `{"MAC":"aa:bb:cc:dd:ee:ff"}` {
+				t.Errorf("%s: unexpected event %s", test.name, data)
+			}
+		} else {
+			sent := WSMessage{}
+			json.Unmarshal(data, &sent)
+			if sent.Type != test.event || sent.Data != message.Data {
+				t.Errorf("%s: unexpected message %s", test.name, data)
+			}
+		}
+	}
+}
+
+func TestFindMAC(t *testing.T) {
+	tests := []struct {
+		data string
+		mac  string
+	}{
+		{`{"MAC":"AA:BB:CC:DD:EE:FF"}`, "aa:bb:cc:dd:ee:ff"},
+		{`{"Mac":"aa:bb:cc:dd:ee:ff","Other":{"MAC":"11:22:33:44:55:66"}}`, "aa:bb:cc:dd:ee:ff"},
+		{`{"Lease":{"Client":{"Mac":"aa:bb:cc:dd:ee:ff"}}}`, "aa:bb:cc:dd:ee:ff"},
+		{`[{"IP":"1.2.3.4"},{"MAC":"aa:bb:cc:dd:ee:ff"}]`, "aa:bb:cc:dd:ee:ff"},
+		{`{"MAC":""}`, ""},
+		{`"Online"`, ""},
+	}
+
+	for _, test := range tests {
+		var decoded interface{}
+		json.Unmarshal([]byte(test.data), &decoded)
+		if mac := findMAC(decoded); mac != test.mac {
+			t.Errorf("findMAC(%s) = %q, expected %q", test.data, mac, test.mac)
+		}
+	}
+}
+
+// wsTestConn returns both ends of a websocket connection
+func wsTestConn(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	server := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		server <- conn
+	}))
+	t.Cleanup(ts.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return <-server, conn
+}
+
+func TestWSClientEnqueue(t *testing.T) {
+	conn, _ := wsTestConn(t)
+	client := &wsClient{
+		conn:  conn,
+		queue: make(chan wsOutgoing, 2),
+		done:  make(chan struct{}),
+	}
+
+	for i, expected := range []bool{true, true, false} {
+		if client.enqueue(wsOutgoing{message: WSMessage{Seq: uint64(i + 1)}}) != expected {
+			t.Errorf("enqueue %d: expected %v", i, expected)
+		}
+	}
+
+	select {
+	case <-client.done:
+	default:
+		t.Errorf("overflowing client was not closed")
+	}
+	//closing twice is fine
+	client.close()
+}
+
+var wsBroadcastOnce sync.Once
+
+func TestWSBroadcast(t *testing.T) {
+	wsBroadcastOnce.Do(WSRunNotify)
+
+	conn, remote := wsTestConn(t)
+	addWSClient(conn, PluginCaller{Role: RoleToken, Scopes: []string{"devices:read"}})
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, data, err := remote.ReadMessage()
+	if err != nil || string(data) != "success" {
+		t.Fatalf("expected success, got %q %v", data, err)
+	}
+
+	//events the client lacks the scope for are skipped
+	WSNotifyValue("AuditEntry", map[string]string{"Action": "test"})
+	WSNotifyValue("DHCPUpdateRequest", map[string]string{"MAC": "aa:bb:cc:dd:ee:ff"})
+
+	message := WSMessage{}
+	err = remote.ReadJSON(&message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Type != "DHCPUpdateRequest" || message.Seq == 0 || message.Data != `{"MAC":"aa:bb:cc:dd:ee:ff"}` {
+		t.Fatalf("unexpected message %+v", message)
+	}
+
+	//resuming replays the events after the sequence number, as events
+	since := message.Seq - 1
+	err = remote.WriteJSON(WSSubscription{Types: []string{"DHCPUpdateRequest"}, Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := WSEvent{}
+	err = remote.ReadJSON(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Seq != message.Seq || event.MAC != "aa:bb:cc:dd:ee:ff" || string(event.Data) != message.Data {
+		t.Errorf("unexpected replay %+v", event)
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// Zone resources. Membership is still managed through /zone/{name},
+// these handlers create, describe, update, rename and delete the zones
+// themselves along with their policy.
+
+var zoneNameRe = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+func validateZoneName(name string) error {
+	if !zoneNameRe.MatchString(name) {
+		return fmt.Errorf("invalid zone name %q", name)
+	}
+	//{name}_port_dst_access would collide with the port map of another zone
+	if strings.HasSuffix(name, "_port") {
+		return fmt.Errorf("zone names can not end in _port")
+	}
+	return nil
+}
+
+// normalizeZoneNames lower cases the names of zones and their references,
+// zones written before names were checked could be mixed case. Zones whose
+// names collide are merged into the first one
+func normalizeZoneNames(zones []ClientZone) ([]ClientZone, map[string]string) {
+	renamed := map[string]string{}
+	result := []ClientZone{}
+	for _, zone := range zones {
+		name := trimLower(zone.Name)
+		if name != zone.Name {
+			renamed[zone.Name] = name
+		}
+		zone.Name = name
+		for i, allowed := range zone.AllowedZones {
+			zone.AllowedZones[i] = trimLower(allowed)
+		}
+		for i := range zone.AllowedPorts {
+			zone.AllowedPorts[i].Zone = trimLower(zone.AllowedPorts[i].Zone)
+		}
+
+		idx := findZone(result, name)
+		if idx < 0 {
+			result = append(result, zone)
+			continue
+		}
+		for _, client := range zone.Clients {
+			if !isZoneClient(result[idx], client.Mac) {
+				result[idx].Clients = append(result[idx].Clients, client)
+			}
+		}
+	}
+	return result, renamed
+}
+
+// migrateZoneNames rewrites zones.json and the schedules with lower case
+// zone names, so that every zone is reachable through /zones/{name}
+func migrateZoneNames() {
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	zones, renamed := normalizeZoneNames(getZonesJson())
+	if len(renamed) == 0 {
+		return
+	}
+
+	for name, newName := range renamed {
+		fmt.Println("renaming zone", name, "to", newName)
+		err := renameScheduleZone(name, newName)
+		if err != nil {
+			fmt.Println("failed to rename schedule zone", name, err)
+		}
+		//the maps of the new name are created on the next refresh
+		err = deleteZoneMaps(name)
+		if err != nil {
+			fmt.Println("failed to delete the maps of zone", name, err)
+		}
+	}
+	saveZones(zones)
+}
+
+func validateZonePort(zones []ClientZone, port ZonePort) error {
+	if findZone(zones, port.Zone) < 0 {
+		return fmt.Errorf("zone %s does not exist", port.Zone)
+	}
+	if _, exists := zonePortProtocols[port.Protocol]; !exists {
+		return fmt.Errorf("invalid protocol %q", port.Protocol)
+	}
+	if port.Port == 0 {
+		return fmt.Errorf("invalid port %d", port.Port)
+	}
+	return nil
+}
+
+func zonePortProtocolName(proto uint8) string {
+	for name, value := range zonePortProtocols {
+		if value == proto {
+			return name
+		}
+	}
+	return ""
+}
+
+func validateZone(zones []ClientZone, zone ClientZone) error {
+	err := validateZoneName(zone.Name)
+	if err != nil {
+		return err
+	}
+
+	if isDefaultZone(zone.Name) && (len(zone.AllowedZones) > 0 || len(zone.AllowedPorts) > 0 || zone.WAN || zone.DNS || zone.LAN) {
+		return fmt.Errorf("the policy of builtin zone %s can not be changed", zone.Name)
+	}
+
+	for _, allowed := range zone.AllowedZones {
+		if allowed == zone.Name {
+			return fmt.Errorf("zone %s can not list itself as an allowed zone", zone.Name)
+		}
+		if findZone(zones, allowed) < 0 {
+			return fmt.Errorf("allowed zone %s does not exist", allowed)
+		}
+	}
+
+	for _, port := range zone.AllowedPorts {
+		err = validateZonePort(zones, port)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func findZone(zones []ClientZone, name string) int {
+	for idx, zone := range zones {
+		if zone.Name == name {
+			return idx
+		}
+	}
+	return -1
+}
+
+func findZonePort(ports []ZonePort, port ZonePort) int {
+	for idx, entry := range ports {
+		if entry == port {
+			return idx
+		}
+	}
+	return -1
+}
+
+// policyZoneNames returns the zones whose members are destinations of a zone
+func policyZoneNames(zone ClientZone) []string {
+	names := append([]string{}, zone.AllowedZones...)
+	for _, port := range zone.AllowedPorts {
+		names = append(names, port.Zone)
+	}
+	return names
+}
+
+// refreshZoneMembers updates the verdict maps of every member of the named zones
+func refreshZoneMembers(zones []ClientZone, names []string) {
+	refreshed := map[string]bool{}
+	for _, name := range names {
+		idx := findZone(zones, name)
+		if idx < 0 {
+			continue
+		}
+		for _, client := range zones[idx].Clients {
+			mac := trimLower(client.Mac)
+			if !refreshed[mac] {
+				refreshed[mac] = true
+				refreshClientZones(mac)
+			}
+		}
+	}
+}
+
+func deleteZoneMaps(name string) error {
+	if isDefaultZone(name) {
+		return nil
+	}
+
+	batch, err := NewNFTBatch()
+	if err != nil {
+		return err
+	}
+	err = batch.DeleteZoneMaps(name)
+	if err != nil {
+		return err
+	}
+	return batch.Commit()
+}
+
+func getZone(w http.ResponseWriter, r *http.Request) {
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	name := trimLower(mux.Vars(r)["name"])
+
+	zones := getZonesJson()
+	idx := findZone(zones, name)
+	if idx < 0 {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zones[idx])
+}
+
+func putZone(w http.ResponseWriter, r *http.Request) {
+	DHCPmtx.Lock()
+	defer DHCPmtx.Unlock()
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	zone := ClientZone{}
+	err := json.NewDecoder(r.Body).Decode(&zone)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	zone.Name = trimLower(mux.Vars(r)["name"])
+	for i, allowed := range zone.AllowedZones {
+		zone.AllowedZones[i] = trimLower(allowed)
+	}
+	for i := range zone.AllowedPorts {
+		zone.AllowedPorts[i].Zone = trimLower(zone.AllowedPorts[i].Zone)
+		zone.AllowedPorts[i].Protocol = trimLower(zone.AllowedPorts[i].Protocol)
+	}
+
+	zones := getZonesJson()
+	err = validateZone(zones, zone)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	affected := append([]string{zone.Name}, policyZoneNames(zone)...)
+
+	idx := findZone(zones, zone.Name)
+	if idx < 0 {
+		//membership is managed through /zone/{name}
+		zone.Clients = []Client{}
+		zones = append(zones, zone)
+	} else {
+		affected = append(affected, policyZoneNames(zones[idx])...)
+		zone.Clients = zones[idx].Clients
+		zones[idx] = zone
+	}
+
+	saveZones(zones)
+	refreshZoneMembers(zones, affected)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zone)
+}
+
+func deleteZone(w http.ResponseWriter, r *http.Request) {
+	DHCPmtx.Lock()
+	defer DHCPmtx.Unlock()
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	name := trimLower(mux.Vars(r)["name"])
+	if isDefaultZone(name) {
+		http.Error(w, "builtin zones can not be deleted", 400)
+		return
+	}
+
+	zones := getZonesJson()
+	idx := findZone(zones, name)
+	if idx < 0 {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	deleted := zones[idx]
+
+	err := deleteZoneMaps(name)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	err = renameScheduleZone(name, "")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	zones = append(zones[:idx], zones[idx+1:]...)
+	for i := range zones {
+		zones[i].AllowedZones = removeZoneName(zones[i].AllowedZones, name)
+		zones[i].AllowedPorts = removeZonePorts(zones[i].AllowedPorts, name)
+	}
+	saveZones(zones)
+
+	//members may have held policy access through the deleted zone
+	refreshZoneMembers([]ClientZone{deleted}, []string{name})
+
+	json.NewEncoder(w).Encode(true)
+}
+
+type ZoneRename struct {
+	Name string
+}
+
+func renameZone(w http.ResponseWriter, r *http.Request) {
+	DHCPmtx.Lock()
+	defer DHCPmtx.Unlock()
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	name := trimLower(mux.Vars(r)["name"])
+
+	rename := ZoneRename{}
+	err := json.NewDecoder(r.Body).Decode(&rename)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	newName := trimLower(rename.Name)
+
+	if isDefaultZone(name) || isDefaultZone(newName) {
+		http.Error(w, "builtin zones can not be renamed", 400)
+		return
+	}
+
+	err = validateZoneName(newName)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	zones := getZonesJson()
+	idx := findZone(zones, name)
+	if idx < 0 {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if findZone(zones, newName) >= 0 {
+		http.Error(w, "zone "+newName+" already exists", 400)
+		return
+	}
+
+	//the members are added to maps of the new name by the refresh below
+	err = deleteZoneMaps(name)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	err = renameScheduleZone(name, newName)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	zones[idx].Name = newName
+	referencing := []string{newName}
+	for i := range zones {
+		allowed := removeZoneName(zones[i].AllowedZones, name)
+		if len(allowed) != len(zones[i].AllowedZones) {
+			zones[i].AllowedZones = append(allowed, newName)
+			referencing = append(referencing, zones[i].Name)
+		}
+		for j := range zones[i].AllowedPorts {
+			if zones[i].AllowedPorts[j].Zone == name {
+				zones[i].AllowedPorts[j].Zone = newName
+				referencing = append(referencing, zones[i].Name)
+			}
+		}
+	}
+	saveZones(zones)
+	refreshZoneMembers(zones, append(referencing, policyZoneNames(zones[idx])...))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zones[idx])
+}
+
+func removeZoneName(names []string, name string) []string {
+	result := []string{}
+	for _, entry := range names {
+		if entry != name {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func removeZonePorts(ports []ZonePort, name string) []ZonePort {
+	result := []ZonePort{}
+	for _, port := range ports {
+		if port.Zone != name {
+			result = append(result, port)
+		}
+	}
+	return result
+}
+
+func getZonePorts(w http.ResponseWriter, r *http.Request) {
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	name := trimLower(mux.Vars(r)["name"])
+
+	zones := getZonesJson()
+	idx := findZone(zones, name)
+	if idx < 0 {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	ports := zones[idx].AllowedPorts
+	if ports == nil {
+		ports = []ZonePort{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ports)
+}
+
+// modifyZonePort adds (PUT) or removes (DELETE) a single port rule of a zone
+func modifyZonePort(w http.ResponseWriter, r *http.Request) {
+	DHCPmtx.Lock()
+	defer DHCPmtx.Unlock()
+	Zonesmtx.Lock()
+	defer Zonesmtx.Unlock()
+
+	name := trimLower(mux.Vars(r)["name"])
+
+	port := ZonePort{}
+	err := json.NewDecoder(r.Body).Decode(&port)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	port.Zone = trimLower(port.Zone)
+	port.Protocol = trimLower(port.Protocol)
+
+	zones := getZonesJson()
+	idx := findZone(zones, name)
+	if idx < 0 {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	ports := zones[idx].AllowedPorts
+	p_idx := findZonePort(ports, port)
+	if r.Method == http.MethodDelete {
+		if p_idx < 0 {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		ports = append(ports[:p_idx], ports[p_idx+1:]...)
+	} else if p_idx < 0 {
+		zone := zones[idx]
+		zone.AllowedPorts = append(append([]ZonePort{}, ports...), port)
+		err = validateZone(zones, zone)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		ports = zone.AllowedPorts
+	}
+
+	zones[idx].AllowedPorts = ports
+	saveZones(zones)
+	refreshZoneMembers(zones, []string{port.Zone})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ports)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+import (
+	"github.com/google/nftables/expr"
+)
+
+func TestNormalizeZoneNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		zones   []ClientZone
+		result  []ClientZone
+		renamed map[string]string
+	}{
+		{"lower case",
+			[]ClientZone{{Name: "guests", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}}}},
+			[]ClientZone{{Name: "guests", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}}}},
+			map[string]string{}},
+		{"mixed case",
+			[]ClientZone{
+				{Name: "Guests", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}}},
+				{Name: "iot", AllowedZones: []string{"Guests"}, AllowedPorts: []ZonePort{{"Guests", "tcp", 80}}},
+			},
+			[]ClientZone{
+				{Name: "guests", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}}},
+				{Name: "iot", AllowedZones: []string{"guests"}, AllowedPorts: []ZonePort{{"guests", "tcp", 80}}},
+			},
+			map[string]string{"Guests": "guests"}},
+		{"colliding names are merged",
+			[]ClientZone{
+				{Name: "guests", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}}},
+				{Name: "Guests", Clients: []Client{{Mac: "AA:BB:CC:DD:EE:01"}, {Mac: "aa:bb:cc:dd:ee:02"}}},
+			},
+			[]ClientZone{
+				{Name: "guests", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}, {Mac: "aa:bb:cc:dd:ee:02"}}},
+			},
+			map[string]string{"Guests": "guests"}},
+	}
+
+	for _, test := range tests {
+		result, renamed := normalizeZoneNames(test.zones)
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%s: zones %+v, expected %+v", test.name, result, test.result)
+		}
+		if !reflect.DeepEqual(renamed, test.renamed) {
+			t.Errorf("%s: renamed %v, expected %v", test.name, renamed, test.renamed)
+		}
+	}
+}
+
+func TestValidateZonePort(t *testing.T) {
+	zones := []ClientZone{{Name: "lan"}, {Name: "cameras"}}
+
+	tests := []struct {
+		port  ZonePort
+		valid bool
+	}{
+		{ZonePort{"cameras", "tcp", 554}, true},
+		{ZonePort{"lan", "udp", 53}, true},
+		{ZonePort{"printers", "tcp", 631}, false},
+		{ZonePort{"cameras", "icmp", 1}, false},
+		{ZonePort{"cameras", "tcp", 0}, false},
+	}
+
+	for _, test := range tests {
+		err := validateZonePort(zones, test.port)
+		if (err == nil) != test.valid {
+			t.Errorf("validateZonePort(%+v) = %v, expected valid %v", test.port, err, test.valid)
+		}
+	}
+}
+
+func TestGetVmapElementsPorts(t *testing.T) {
+	zones := []ClientZone{
+		{Name: "cameras", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:01"}}},
+		{Name: "guests", Clients: []Client{{Mac: "aa:bb:cc:dd:ee:02"}},
+			AllowedZones: []string{"cameras"},
+			AllowedPorts: []ZonePort{{"cameras", "tcp", 554}, {"cameras", "udp", 554}}},
+	}
+
+	tests := []struct {
+		name     string
+		ip       string
+		mac      string
+		elements []nftElement
+	}{
+		{"destination", "192.168.2.10", "aa:bb:cc:dd:ee:01", []nftElement{
+			{"cameras_dst_access", verdictEntry{ip: "192.168.2.10", ifname: "wlan0"}, expr.VerdictContinue},
+			{"cameras_mac_src_access", verdictEntry{ip: "192.168.2.10", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:01"}, expr.VerdictAccept},
+			{"guests_dst_access", verdictEntry{ip: "192.168.2.10", ifname: "wlan0"}, expr.VerdictContinue},
+			{"guests_port_dst_access", verdictEntry{ip: "192.168.2.10", ifname: "wlan0", proto: 6, port: 554}, expr.VerdictContinue},
+			{"guests_port_dst_access", verdictEntry{ip: "192.168.2.10", ifname: "wlan0", proto: 17, port: 554}, expr.VerdictContinue},
+		}},
+		{"ipv6 destination", "fd00::10", "aa:bb:cc:dd:ee:01", []nftElement{
+			{"cameras_dst_access6", verdictEntry{ip: "fd00::10", ifname: "wlan0"}, expr.VerdictContinue},
+			{"cameras_mac_src_access6", verdictEntry{ip: "fd00::10", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:01"}, expr.VerdictAccept},
+			{"guests_dst_access6", verdictEntry{ip: "fd00::10", ifname: "wlan0"}, expr.VerdictContinue},
+			{"guests_port_dst_access6", verdictEntry{ip: "fd00::10", ifname: "wlan0", proto: 6, port: 554}, expr.VerdictContinue},
+			{"guests_port_dst_access6", verdictEntry{ip: "fd00::10", ifname: "wlan0", proto: 17, port: 554}, expr.VerdictContinue},
+		}},
+		{"source", "192.168.2.11", "aa:bb:cc:dd:ee:02", []nftElement{
+			{"guests_dst_access", verdictEntry{ip: "192.168.2.11", ifname: "wlan0"}, expr.VerdictContinue},
+			{"guests_mac_src_access", verdictEntry{ip: "192.168.2.11", ifname: "wlan0", mac: "aa:bb:cc:dd:ee:02"}, expr.VerdictAccept},
+		}},
+		{"no zone", "192.168.2.12", "aa:bb:cc:dd:ee:03", []nftElement{}},
+	}
+
+	for _, test := range tests {
+		elements := getVmapElements(zones, test.ip, test.mac, "wlan0")
+		if !reflect.DeepEqual(elements, test.elements) {
+			t.Errorf("%s: elements %v, expected %v", test.name, elements, test.elements)
+		}
+	}
+}
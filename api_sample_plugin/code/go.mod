@@ -2,4 +2,11 @@ module sample_plugin
 
 go 1.17
 
-require github.com/gorilla/mux v1.8.0
+require github.com/spr-networks/plugin_sdk v0.0.0
+
+require (
+	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/gorilla/websocket v1.4.1 // indirect
+)
+
+replace github.com/spr-networks/plugin_sdk => ../../plugin_sdk
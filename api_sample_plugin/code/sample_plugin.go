@@ -1,42 +1,87 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"net"
 	"net/http"
-	"os"
 )
 
 import (
-	"github.com/gorilla/mux"
+	"github.com/spr-networks/plugin_sdk/client"
+	"github.com/spr-networks/plugin_sdk/identity"
+	"github.com/spr-networks/plugin_sdk/plugin"
 )
 
-var UNIX_PLUGIN_LISTENER = "/state/api/sample_plugin"
+// next to the callback socket, in the one directory of /state/api the
+// container mounts
+var UNIX_PLUGIN_LISTENER = "/state/api/plugins/sample_plugin/plugin.sock"
 
+// has to match the Name of the plugin in the api config
+var PLUGIN_NAME = "sample_plugin"
 
-func pluginTest(w http.ResponseWriter, r *http.Request) {
+// samplePlugin calls the api on its callback socket. The calls are limited
+// to the Capabilities in the plugin config, here devices:read and events:read
+type samplePlugin struct {
+	api *client.Client
+}
+
+func (s *samplePlugin) pluginTest(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Not implemented", 400)
 }
 
-func logRequest(handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
-		handler.ServeHTTP(w, r)
-	})
+// pluginWhoami returns the caller the api asserted
+func (s *samplePlugin) pluginWhoami(w http.ResponseWriter, r *http.Request) {
+	caller, _ := identity.FromRequest(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caller)
 }
 
-func main() {
-	unix_plugin_router := mux.NewRouter().StrictSlash(true)
+// pluginDevices lists the devices for callers that may read them
+func (s *samplePlugin) pluginDevices(w http.ResponseWriter, r *http.Request) {
+	caller, _ := identity.FromRequest(r)
+	if !caller.Can("devices", "read") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	devices, err := s.api.Devices()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
 
-	unix_plugin_router.HandleFunc("/test", pluginTest).Methods("GET")
+func (s *samplePlugin) routes(p *plugin.Plugin) {
+	p.Authenticated.HandleFunc("/test", s.pluginTest).Methods("GET")
+	p.Authenticated.HandleFunc("/whoami", s.pluginWhoami).Methods("GET")
+	p.Authenticated.HandleFunc("/devices", s.pluginDevices).Methods("GET")
+}
+
+func printEvent(event client.Event) {
+	fmt.Println("event", event.Type)
+}
 
-	os.Remove(UNIX_PLUGIN_LISTENER)
-	unixPluginListener, err := net.Listen("unix", UNIX_PLUGIN_LISTENER)
+func main() {
+	p, err := plugin.New(plugin.Config{
+		Name:        PLUGIN_NAME,
+		UnixPath:    UNIX_PLUGIN_LISTENER,
+		LogRequests: true,
+	})
 	if err != nil {
 		panic(err)
 	}
 
-	pluginServer := http.Server{Handler: logRequest(unix_plugin_router)}
+	s := &samplePlugin{api: client.New(client.SocketPath(PLUGIN_NAME))}
+	s.routes(p)
 
-	pluginServer.Serve(unixPluginListener)
+	//print the type of every api event
+	go s.api.Watch(context.Background(), client.Subscription{}, printEvent)
+
+	err = p.ListenAndServe()
+	if err != nil {
+		panic(err)
+	}
 }
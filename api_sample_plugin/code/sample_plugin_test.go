@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+import (
+	"github.com/spr-networks/plugin_sdk/client"
+	"github.com/spr-networks/plugin_sdk/identity"
+	"github.com/spr-networks/plugin_sdk/plugin"
+	"github.com/spr-networks/plugin_sdk/plugintest"
+)
+
+func TestPluginDevices(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities []string
+		caller       identity.Identity
+		status       int
+	}{
+		{"admin", []string{"devices:read", "events:read"}, plugintest.Admin, 200},
+		{"viewer", []string{"devices:read", "events:read"}, identity.Identity{User: "viewer", Role: "viewer", Scopes: []string{"devices:read"}}, 200},
+		{"caller without devices", []string{"devices:read", "events:read"}, identity.Identity{User: "ci", Role: "token", Scopes: []string{"zones:read"}}, 403},
+		{"plugin without devices", []string{"events:read"}, plugintest.Admin, 502},
+	}
+
+	for _, test := range tests {
+		api := plugintest.NewFakeAPI(t, test.capabilities...)
+		api.Devices["aa:bb:cc:dd:ee:ff"] = client.Device{Mac: "aa:bb:cc:dd:ee:ff", Comment: "laptop"}
+
+		p, signer := plugintest.NewPlugin(t, plugin.Config{Name: PLUGIN_NAME})
+		s := &samplePlugin{api: api.Client()}
+		s.routes(p)
+
+		w := plugintest.Do(p, signer, "GET", "/devices", nil, test.caller)
+		if w.Code != test.status {
+			t.Errorf("%s: returned %d, expected %d: %s", test.name, w.Code, test.status, w.Body.String())
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+		devices := map[string]client.Device{}
+		json.NewDecoder(w.Body).Decode(&devices)
+		if devices["aa:bb:cc:dd:ee:ff"].Comment != "laptop" {
+			t.Errorf("%s: unexpected devices %v", test.name, devices)
+		}
+	}
+}
+
+func TestPluginWhoami(t *testing.T) {
+	p, signer := plugintest.NewPlugin(t, plugin.Config{Name: PLUGIN_NAME})
+	s := &samplePlugin{}
+	s.routes(p)
+
+	caller := identity.Identity{User: "viewer", Role: "viewer", Scopes: []string{"devices:read"}}
+	w := plugintest.Do(p, signer, "GET", "/whoami", nil, caller)
+	if w.Code != 200 {
+		t.Fatalf("returned %d: %s", w.Code, w.Body.String())
+	}
+	asserted := identity.Identity{}
+	json.NewDecoder(w.Body).Decode(&asserted)
+	if asserted.User != "viewer" || asserted.Plugin != PLUGIN_NAME {
+		t.Errorf("unexpected identity %+v", asserted)
+	}
+
+	//an assertion for another plugin is rejected
+	other := plugintest.NewSigner(t, "other_plugin")
+	if w := plugintest.Do(p, other, "GET", "/whoami", nil, caller); w.Code != 401 {
+		t.Errorf("assertion of another signer returned %d", w.Code)
+	}
+}
@@ -89,3 +89,100 @@ table ip accounting {
 
 }
 EOF
+
+# ipv6 accounting mirrors the ip table. Without LANIP6_PREFIX the local_lan
+# set is empty and all ipv6 traffic is counted as wan traffic
+LOCAL_LAN6=""
+if [ "$LANIP6_PREFIX" ]; then
+  LOCAL_LAN6="elements = { $LANIP6_PREFIX }"
+fi
+
+nft -f - << EOF
+
+table ip6 accounting
+delete table ip6 accounting
+
+table ip6 accounting {
+
+      set local_lan {
+        type ipv6_addr
+        flags interval
+        $LOCAL_LAN6
+      }
+
+      set outgoing_traffic_lan {
+        type ipv6_addr
+        counter
+        flags dynamic
+        timeout 24h
+        size 65535
+      }
+
+      set outgoing_traffic_wan {
+        type ipv6_addr
+        counter
+        flags dynamic
+        timeout 24h
+        size 65535
+      }
+
+      set incoming_traffic_lan {
+        type ipv6_addr
+        counter
+        flags dynamic
+        timeout 24h
+        size 65535
+      }
+
+      set incoming_traffic_wan {
+        type ipv6_addr
+        counter
+        flags dynamic
+        timeout 24h
+        size 65535
+      }
+
+      set all_ip {
+        type ifname . ipv6_addr . ipv6_addr
+        counter
+        flags dynamic
+        timeout 1h
+        size 4096
+      }
+
+      chain FORWARD {
+        type filter hook forward priority -150 ; policy accept;
+
+        # Log all input ip pairs (input interface, src ip, dst ip)
+        add @all_ip { iifname . ip6 saddr . ip6 daddr }
+        iifname . ip6 saddr . ip6 daddr @all_ip
+
+        ip6 daddr @local_lan jump count_in
+        ip6 saddr @local_lan jump count_out
+      }
+
+      chain count_in {
+        ip6 saddr @local_lan goto count_in_lan
+        add @incoming_traffic_wan { ip6 daddr }
+        ip6 daddr @incoming_traffic_wan
+      }
+
+      chain count_in_lan {
+        add @incoming_traffic_lan { ip6 daddr }
+        ip6 daddr @incoming_traffic_lan
+      }
+
+
+      chain count_out {
+        ip6 daddr @local_lan goto count_out_lan
+        add @outgoing_traffic_wan { ip6 saddr }
+        ip6 saddr @outgoing_traffic_wan
+      }
+
+      chain count_out_lan {
+        add @outgoing_traffic_lan { ip6 saddr }
+        ip6 saddr @outgoing_traffic_lan
+      }
+
+}
+EOF
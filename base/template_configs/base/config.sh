@@ -27,3 +27,5 @@ WIREGUARD_PORT=51280
 #WIREGUARD_NETWORK=192.168.3.1/24
 
 
+# Uncomment to enable ipv6 accounting for the lan prefix
+#LANIP6_PREFIX=fd00:2::/64
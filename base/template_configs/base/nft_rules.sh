@@ -21,8 +21,10 @@ if [ "$LANIF" ]; then
 fi
 
 LANIFFORWARD=""
+LANIFFORWARD6=""
 if [ "$LANIF" ]; then
     LANIFFORWARD="oifname $LANIF ip saddr . iifname . ether saddr vmap @lan_access"
+    LANIFFORWARD6="oifname $LANIF ip6 saddr . iifname . ether saddr vmap @lan_access6"
 fi
 
 WIREGUARD_DNS=""
@@ -52,6 +54,19 @@ table inet filter {
     type ipv4_addr . ifname . ether_addr: verdict;
   }
 
+  # ipv6 counterparts, filled from dhcpUpdate6
+  map dns_access6 {
+    type ipv6_addr . ifname . ether_addr: verdict;
+  }
+
+  map internet_access6 {
+    type ipv6_addr . ifname . ether_addr: verdict;
+  }
+
+  map lan_access6 {
+    type ipv6_addr . ifname . ether_addr: verdict;
+  }
+
 
   chain INPUT {
     type filter hook input priority 0; policy drop;
@@ -75,6 +90,10 @@ table inet filter {
     # Allow multicast
     udp dport {1900, 5353} counter accept
 
+    # Neighbor discovery and router solicitation are required for ipv6
+    iifname != $WANIF icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-solicit, echo-request } counter accept
+    iifname $WANIF icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-advert } counter accept
+
     # DNS Allow rules
     # Docker can DNS
     iif $DOCKERIF ip saddr $DOCKERNET udp dport 53 counter accept
@@ -84,6 +103,7 @@ table inet filter {
 
     # Dynamic verdict map
     udp dport 53  ip saddr . iifname . ether saddr vmap @dns_access
+    udp dport 53  ip6 saddr . iifname . ether saddr vmap @dns_access6
 
     # DHCP Allow rules
     # Wired lan
@@ -91,6 +111,7 @@ table inet filter {
 
     # Authorized wireless stations & MACs. They do not have an ip address yet
     udp dport 67 iifname . ether saddr vmap @dhcp_access
+    udp dport 547 iifname . ether saddr vmap @dhcp_access
 
     # Fall through to log + drop
     counter jump DROPLOGINP
@@ -99,6 +120,9 @@ table inet filter {
   chain FORWARD {
     type filter hook forward priority 0; policy drop;
 
+    # Rate limits of devices, managed by the api
+    jump QUOTA_THROTTLE
+
     counter jump F_EST_RELATED
     iif $DOCKERIF oifname $WANIF ip saddr $DOCKERNET counter accept
 
@@ -107,12 +131,15 @@ table inet filter {
 
     # Forward to WAN
     oifname $WANIF ip saddr . iifname . ether saddr vmap @internet_access
+    oifname $WANIF ip6 saddr . iifname . ether saddr vmap @internet_access6
 
     # Forward to wired LAN
     $LANIFFORWARD
+    $LANIFFORWARD6
 
     # Forward to wireless LAN
     oifname "$VLANSIF*" ip saddr . iifname . ether saddr vmap @lan_access
+    oifname "$VLANSIF*" ip6 saddr . iifname . ether saddr vmap @lan_access6
 
     # Forward * from wireguard
     $WIREGUARD_FORWARD
@@ -125,6 +152,9 @@ table inet filter {
     type filter hook output priority 0; policy accept
   }
 
+  chain QUOTA_THROTTLE {
+  }
+
   chain DROPLOGFWD {
     counter log prefix "DRP:FWD "
     counter drop
@@ -139,6 +169,7 @@ table inet filter {
     ip protocol udp ct state related,established counter accept
     ip protocol tcp ct state related,established counter accept
     ip protocol icmp ct state related,established counter accept
+    meta nfproto ipv6 meta l4proto { udp, tcp, icmpv6 } ct state related,established counter accept
   }
 
 }
@@ -15,3 +15,20 @@ server4:
 
 END
 
+# dhcpv6 is served when ipv6 is enabled, leases are reported to the api by
+# dhcp6_helper.sh. SLAAC addresses are picked up by slaac_monitor.sh
+if [ -n "$LANIP6_PREFIX" ]; then
+LANMAC=$(cat /sys/class/net/${LANIF:-$VLANIF}/address 2>/dev/null)
+# addresses are leased from the lan prefix, fd00:2::1000-fd00:2::1fff for fd00:2::/64
+LANIP6_NET=${LANIP6_PREFIX%/*}
+DHCP6START=${DHCP6START:-${LANIP6_NET}1000}
+DHCP6STOP=${DHCP6STOP:-${LANIP6_NET}1fff}
+cat << END
+server6:
+  plugins:
+    - server_id: LL $LANMAC
+    - range: /state/dhcp/leases6.txt $DHCP6START $DHCP6STOP 730h0m0s
+    - execute: /scripts/dhcp6_helper.sh
+
+END
+fi
@@ -0,0 +1,19 @@
+#!/bin/bash
+. /configs/base/config.sh
+
+IP=$1
+MAC=$2
+NAME=$(echo "$3" | tr -cd '[:alnum:]._-')
+IFACE=$4
+# dhcpv6 or slaac, coredhcp does not pass one
+SOURCE=${5:-dhcpv6}
+
+# the api replies with a non-2xx status when the update was rolled back
+RESULT=$(mktemp)
+STATUS=$(curl -s -o $RESULT -w "%{http_code}" --unix-socket /state/dhcp/apisock http://localhost/dhcpUpdate6 -X PUT -d "{\"IP\": \"$IP\", \"MAC\": \"$MAC\", \"Name\": \"$NAME\", \"Iface\": \"$IFACE\", \"Source\": \"$SOURCE\"}")
+if [ "$STATUS" != "200" ]; then
+  echo "dhcpUpdate6 failed for $MAC $IP ($STATUS): $(cat $RESULT)" >&2
+  rm -f $RESULT
+  exit 1
+fi
+rm -f $RESULT
@@ -9,4 +9,12 @@ NAME=${NAME:=DefaultMissingName}
 IFACE=$4
 ROUTER=$5
 
-curl --unix-socket /state/dhcp/apisock http://localhost/dhcpUpdate -X PUT -d "{\"IP\": \"$1\", \"MAC\": \"$2\", \"Name\": \"$NAME\", \"Iface\": \"$IFACE\", \"Router\": \"$ROUTER\"}"
+# the api replies with a non-2xx status when the update was rolled back
+RESULT=$(mktemp)
+STATUS=$(curl -s -o $RESULT -w "%{http_code}" --unix-socket /state/dhcp/apisock http://localhost/dhcpUpdate -X PUT -d "{\"IP\": \"$1\", \"MAC\": \"$2\", \"Name\": \"$NAME\", \"Iface\": \"$IFACE\", \"Router\": \"$ROUTER\"}")
+if [ "$STATUS" != "200" ]; then
+  echo "dhcpUpdate failed for $MAC $IP ($STATUS): $(cat $RESULT)" >&2
+  rm -f $RESULT
+  exit 1
+fi
+rm -f $RESULT
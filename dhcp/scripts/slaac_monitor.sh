@@ -0,0 +1,23 @@
+#!/bin/bash
+. /configs/base/config.sh
+
+# SLAAC clients pick their own addresses. Report the global addresses that
+# show up in the neighbor table of the lan interfaces, the api pins them
+# as permanent entries afterwards
+ip -6 monitor neigh | while read -r LINE; do
+  set -- $LINE
+  IP=$1
+  STATE=${@: -1}
+  if [ "$2" != "dev" ] || [ "$4" != "lladdr" ] || [ "$STATE" != "REACHABLE" ]; then
+    continue
+  fi
+  IFACE=$3
+  MAC=$5
+  if [ "$IFACE" == "$WANIF" ]; then
+    continue
+  fi
+  case "$IP" in
+    fe80:*|ff*) continue ;;
+  esac
+  /scripts/dhcp6_helper.sh "$IP" "$MAC" "" "$IFACE" slaac
+done
@@ -1,2 +1,3 @@
 #!/bin/bash
+/scripts/slaac_monitor.sh &
 /coredhcpd -c /configs/dhcp/coredhcp.yml
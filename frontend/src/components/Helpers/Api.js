@@ -48,7 +48,8 @@ export function testLogin(username, password, callback) {
     return response.json()
   })
   .then(data => {
-    if (data == "Online") {
+    //the status is an object since the tls details were added
+    if (data == "Online" || data.Status == "Online") {
       console.log('Success:', data);
       return callback(true)
     }
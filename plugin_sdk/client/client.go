@@ -0,0 +1,215 @@
+// Package client calls the api on the callback socket of a plugin.
+//
+// The api serves every plugin a restricted api on
+// /state/api/plugins/{Name}/apisock. Each call has to be covered by the
+// Capabilities of the plugin in the api config, {resource}:read or
+// {resource}:write. Calls that are not fail with an *APIError of status 403.
+//
+// The container of a plugin mounts only /state/api/plugins/{Name}/, as the
+// socket grants its capabilities to anyone who can reach it.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var CallbackDir = "/state/api/plugins"
+
+// SocketPath returns the callback socket of a plugin
+func SocketPath(name string) string {
+	return CallbackDir + "/" + name + "/apisock"
+}
+
+type Device struct {
+	Mac     string
+	PskType string
+	Comment string
+	Zones   []string
+
+	//from the device inventory
+	FirstSeen time.Time `json:",omitempty"`
+	LastSeen  time.Time `json:",omitempty"`
+	LastIP    string    `json:",omitempty"`
+	Interface string    `json:",omitempty"`
+	Hostname  string    `json:",omitempty"`
+	Vendor    string    `json:",omitempty"`
+	Name      string    `json:",omitempty"`
+	Owner     string    `json:",omitempty"`
+	Tags      []string  `json:",omitempty"`
+}
+
+// DeviceRecord is the inventory entry of a device
+type DeviceRecord struct {
+	Mac       string
+	FirstSeen time.Time `json:",omitempty"`
+	LastSeen  time.Time `json:",omitempty"`
+	LastIP    string    `json:",omitempty"`
+	Interface string    `json:",omitempty"`
+	Hostname  string    `json:",omitempty"`
+	Vendor    string    `json:",omitempty"`
+	Name      string    `json:",omitempty"`
+	Owner     string    `json:",omitempty"`
+	Tags      []string  `json:",omitempty"`
+}
+
+type ZoneMember struct {
+	Mac     string
+	Comment string
+}
+
+type ZonePort struct {
+	Zone     string
+	Protocol string
+	Port     uint16
+}
+
+type Zone struct {
+	Name    string
+	Clients []ZoneMember
+
+	Description  string     `json:",omitempty"`
+	AllowedZones []string   `json:",omitempty"`
+	AllowedPorts []ZonePort `json:",omitempty"`
+	WAN          bool       `json:",omitempty"`
+	DNS          bool       `json:",omitempty"`
+	LAN          bool       `json:",omitempty"`
+}
+
+type TrafficElement struct {
+	IP      string
+	Packets uint64
+	Bytes   uint64
+}
+
+type IPTrafficElement struct {
+	Interface string
+	Src       string
+	Dst       string
+	Packets   uint64
+	Bytes     uint64
+}
+
+// APIError is returned for replies of the api that are not 2xx
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api returned %d: %s", e.Status, e.Message)
+}
+
+type Client struct {
+	socketPath string
+	http       *http.Client
+}
+
+func New(socketPath string) *Client {
+	c := &Client{socketPath: socketPath}
+	c.http = &http.Client{
+		Transport: &http.Transport{Dial: c.dial},
+		Timeout:   30 * time.Second,
+	}
+	return c
+}
+
+func (c *Client) dial(network, addr string) (net.Conn, error) {
+	return net.Dial("unix", c.socketPath)
+}
+
+func (c *Client) do(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://api"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &APIError{resp.StatusCode, strings.TrimSpace(string(message))}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Devices returns the known devices by MAC, needs devices:read
+func (c *Client) Devices() (map[string]Device, error) {
+	devices := map[string]Device{}
+	err := c.do("GET", "/devices", nil, &devices)
+	return devices, err
+}
+
+// Device returns the inventory entry of a device, needs devices:read
+func (c *Client) Device(mac string) (DeviceRecord, error) {
+	record := DeviceRecord{}
+	err := c.do("GET", "/devices/"+url.PathEscape(mac), nil, &record)
+	return record, err
+}
+
+// Zones needs zones:read
+func (c *Client) Zones() ([]Zone, error) {
+	zones := []Zone{}
+	err := c.do("GET", "/zones", nil, &zones)
+	return zones, err
+}
+
+// Zone needs zones:read
+func (c *Client) Zone(name string) (Zone, error) {
+	zone := Zone{}
+	err := c.do("GET", "/zones/"+url.PathEscape(name), nil, &zone)
+	return zone, err
+}
+
+// AddZoneMember adds a device to a zone, or updates its comment. The zone
+// is created when it does not exist. Needs zones:write
+func (c *Client) AddZoneMember(zone string, member ZoneMember) error {
+	return c.do("PUT", "/zone/"+url.PathEscape(zone), member, nil)
+}
+
+// RemoveZoneMember needs zones:write
+func (c *Client) RemoveZoneMember(zone string, mac string) error {
+	return c.do("DELETE", "/zone/"+url.PathEscape(zone), ZoneMember{Mac: mac}, nil)
+}
+
+// DeviceTraffic returns the counters of an accounting set, such as
+// incoming_traffic_wan. Needs traffic:read
+func (c *Client) DeviceTraffic(set string) ([]TrafficElement, error) {
+	traffic := []TrafficElement{}
+	err := c.do("GET", "/traffic/"+url.PathEscape(set), nil, &traffic)
+	return traffic, err
+}
+
+// IPTraffic needs traffic:read
+func (c *Client) IPTraffic() ([]IPTrafficElement, error) {
+	traffic := []IPTrafficElement{}
+	err := c.do("GET", "/iptraffic", nil, &traffic)
+	return traffic, err
+}
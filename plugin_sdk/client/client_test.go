@@ -0,0 +1,133 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/spr-networks/plugin_sdk/client"
+	"github.com/spr-networks/plugin_sdk/plugintest"
+)
+
+func TestClientCapabilities(t *testing.T) {
+	devices := func(c *client.Client) error {
+		_, err := c.Devices()
+		return err
+	}
+	zones := func(c *client.Client) error {
+		_, err := c.Zones()
+		return err
+	}
+	missingZone := func(c *client.Client) error {
+		_, err := c.Zone("guests")
+		return err
+	}
+	addMember := func(c *client.Client) error {
+		return c.AddZoneMember("lan", client.ZoneMember{Mac: "aa:bb:cc:dd:ee:ff"})
+	}
+	ipTraffic := func(c *client.Client) error {
+		_, err := c.IPTraffic()
+		return err
+	}
+
+	tests := []struct {
+		name         string
+		capabilities []string
+		call         func(c *client.Client) error
+		status       int
+	}{
+		{"devices", []string{"devices:read"}, devices, 0},
+		{"devices without capability", []string{"zones:read"}, devices, 403},
+		{"zones", []string{"zones:read"}, zones, 0},
+		{"write covers read", []string{"zones:write"}, zones, 0},
+		{"missing zone", []string{"zones:read"}, missingZone, 404},
+		{"add member", []string{"zones:write"}, addMember, 0},
+		{"add member read only", []string{"zones:read"}, addMember, 403},
+		{"all", []string{"*"}, ipTraffic, 0},
+	}
+
+	for _, test := range tests {
+		api := plugintest.NewFakeAPI(t, test.capabilities...)
+		err := test.call(api.Client())
+
+		status := 0
+		apiError := &client.APIError{}
+		if errors.As(err, &apiError) {
+			status = apiError.Status
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if status != test.status {
+			t.Errorf("%s: status %d, expected %d", test.name, status, test.status)
+		}
+	}
+}
+
+func TestZoneMembers(t *testing.T) {
+	api := plugintest.NewFakeAPI(t, "zones:write")
+	c := api.Client()
+
+	err := c.AddZoneMember("Guests", client.ZoneMember{Mac: "aa:bb:cc:dd:ee:ff", Comment: "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone, err := c.Zone("guests")
+	if err != nil || len(zone.Clients) != 1 || zone.Clients[0].Comment != "laptop" {
+		t.Fatalf("unexpected zone %+v: %v", zone, err)
+	}
+
+	err = c.RemoveZoneMember("guests", "AA:BB:CC:DD:EE:FF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone, _ = c.Zone("guests")
+	if len(zone.Clients) != 0 {
+		t.Errorf("member was not removed: %+v", zone)
+	}
+	if err = c.RemoveZoneMember("guests", "aa:bb:cc:dd:ee:ff"); err == nil {
+		t.Errorf("removed a missing member")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	api := plugintest.NewFakeAPI(t, "events:read", "devices:read")
+	//published before the subscription, replayed with Since
+	api.Publish("DeviceDiscovered", "aa:bb:cc:dd:ee:ff", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events := make(chan client.Event, 8)
+	since := uint64(0)
+	subscription := client.Subscription{MACs: []string{"aa:bb:cc:dd:ee:ff"}, Since: &since}
+	go api.Client().Subscribe(ctx, subscription, func(event client.Event) {
+		events <- event
+	})
+	for api.Subscribers() == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("no subscription")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//skipped: another device, and a type the capabilities do not cover
+	api.Publish("DHCPUpdateRequest", "11:22:33:44:55:66", nil)
+	api.Publish("QuotaExceeded", "aa:bb:cc:dd:ee:ff", nil)
+	api.Publish("DHCPUpdateRequest", "aa:bb:cc:dd:ee:ff", nil)
+
+	expected := []string{"DeviceDiscovered", "DHCPUpdateRequest"}
+	for _, eventType := range expected {
+		select {
+		case event := <-events:
+			if event.Type != eventType || event.MAC != "aa:bb:cc:dd:ee:ff" {
+				t.Errorf("got %s for %s, expected %s", event.Type, event.MAC, eventType)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no %s event", eventType)
+		}
+	}
+}
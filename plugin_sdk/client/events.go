@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// Event is an event of the api, as sent on the websocket. Needs events:read,
+// and only the event types covered by the other capabilities are sent, e.g.
+// DHCPUpdateRequest with devices:read. Audit, lockout and plugin events
+// need "*"
+type Event struct {
+	Seq  uint64
+	Time time.Time
+	Type string
+	//device the event is about, if any
+	MAC  string `json:",omitempty"`
+	Data json.RawMessage
+}
+
+// Subscription selects events, empty lists select every type or device
+type Subscription struct {
+	Types []string
+	MACs  []string
+	//replay the events the api still buffers after this sequence number
+	Since *uint64
+}
+
+// ReplayGapType is the type of the event sent instead of the events that
+// were dropped from the replay buffer of the api, with ReplayGap as Data
+const ReplayGapType = "ReplayGap"
+
+type ReplayGap struct {
+	Since  uint64
+	Oldest uint64
+}
+
+// Subscribe calls handler for the events of the subscription until ctx is
+// done or the connection fails
+func (c *Client) Subscribe(ctx context.Context, subscription Subscription, handler func(Event)) error {
+	dialer := websocket.Dialer{NetDial: c.dial, HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.DialContext(ctx, "ws://api/events", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if string(msg) != "success" {
+		return fmt.Errorf("event subscription refused: %s", msg)
+	}
+
+	err = conn.WriteJSON(subscription)
+	if err != nil {
+		return err
+	}
+
+	//unblock the read below when the context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		event := Event{}
+		if json.Unmarshal(msg, &event) != nil {
+			continue
+		}
+		handler(event)
+	}
+}
+
+// Watch subscribes like Subscribe and reconnects when the connection
+// fails, resuming after the last event it handled. It returns when ctx is
+// done
+func (c *Client) Watch(ctx context.Context, subscription Subscription, handler func(Event)) error {
+	var last *uint64
+	track := func(event Event) {
+		if event.Seq != 0 {
+			seq := event.Seq
+			last = &seq
+		}
+		handler(event)
+	}
+
+	delay := time.Second
+	for {
+		if last != nil {
+			subscription.Since = last
+		}
+		started := time.Now()
+		err := c.Subscribe(ctx, subscription, track)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		//back off while the api is unreachable
+		if time.Since(started) > time.Minute {
+			delay = time.Second
+		}
+		fmt.Println("event subscription failed, retrying in", delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
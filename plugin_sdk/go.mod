@@ -0,0 +1,8 @@
+module github.com/spr-networks/plugin_sdk
+
+go 1.17
+
+require (
+	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.1
+)
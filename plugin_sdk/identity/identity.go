@@ -0,0 +1,152 @@
+// Package identity verifies the caller assertion the api attaches to the
+// requests it proxies to a plugin.
+//
+// The api strips every header of a proxied request, the credentials of the
+// caller included, and sets X-SPR-Identity to base64url(claims json) "."
+// base64url(ed25519 signature). The public key is published by the api in
+// /state/api/plugin_identity/identity.pub, a directory plugins mount read
+// only.
+package identity
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const Header = "X-SPR-Identity"
+
+var DefaultPublicKeyPath = "/state/api/plugin_identity/identity.pub"
+
+// assertions are accepted this long past their expiry
+var ClockSkew = 5 * time.Second
+
+var ErrMissing = errors.New("missing identity assertion")
+
+// Identity is the caller of a request as asserted by the api
+type Identity struct {
+	//name of the plugin the assertion is meant for
+	Plugin string
+	User   string
+	Role   string
+	//capabilities of the plugin the caller holds, {resource}:read,
+	//{resource}:write or "*"
+	Scopes []string
+	//unix seconds
+	Issued  int64
+	Expires int64
+}
+
+// Can reports whether the caller granted access to a resource. Write
+// includes read
+func (i Identity) Can(resource string, access string) bool {
+	for _, scope := range i.Scopes {
+		if scope == "*" || scope == resource+":"+access || scope == resource+":write" {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadPublicKey reads the PEM encoded public key of the api
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no key in %s", path)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ed25519 key in %s", path)
+	}
+	return key, nil
+}
+
+// Sign returns the assertion of an identity, as the api creates it
+func Sign(key ed25519.PrivateKey, identity Identity) (string, error) {
+	claims, err := json.Marshal(identity)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	signature := ed25519.Sign(key, []byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature and lifetime of an assertion and that it was
+// issued for the plugin
+func Verify(assertion string, key ed25519.PublicKey, plugin string) (Identity, error) {
+	identity := Identity{}
+	if assertion == "" {
+		return identity, ErrMissing
+	}
+
+	pieces := strings.Split(assertion, ".")
+	if len(pieces) != 2 {
+		return identity, errors.New("malformed identity assertion")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(pieces[1])
+	if err != nil {
+		return identity, errors.New("malformed identity signature")
+	}
+	if !ed25519.Verify(key, []byte(pieces[0]), signature) {
+		return identity, errors.New("invalid identity signature")
+	}
+
+	claims, err := base64.RawURLEncoding.DecodeString(pieces[0])
+	if err != nil {
+		return identity, errors.New("malformed identity claims")
+	}
+	err = json.Unmarshal(claims, &identity)
+	if err != nil {
+		return identity, err
+	}
+
+	if identity.Plugin != plugin {
+		return identity, fmt.Errorf("identity was issued for plugin %q", identity.Plugin)
+	}
+	if time.Now().Add(-ClockSkew).Unix() > identity.Expires {
+		return identity, errors.New("identity assertion expired")
+	}
+	return identity, nil
+}
+
+type contextKey int
+
+const identityKey contextKey = 0
+
+// FromRequest returns the identity Middleware verified for a request
+func FromRequest(r *http.Request) (Identity, bool) {
+	identity, ok := r.Context().Value(identityKey).(Identity)
+	return identity, ok
+}
+
+// Middleware rejects requests without a valid assertion for the plugin
+func Middleware(key ed25519.PublicKey, plugin string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, err := Verify(r.Header.Get(Header), key, plugin)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, identity)))
+		})
+	}
+}
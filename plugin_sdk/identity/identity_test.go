@@ -0,0 +1,42 @@
+package identity_test
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/spr-networks/plugin_sdk/identity"
+	"github.com/spr-networks/plugin_sdk/plugintest"
+)
+
+func TestVerify(t *testing.T) {
+	signer := plugintest.NewSigner(t, "sample_plugin")
+	other := plugintest.NewSigner(t, "sample_plugin")
+	expired := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name      string
+		assertion string
+		valid     bool
+	}{
+		{"valid", signer.Assert(plugintest.Admin), true},
+		{"missing", "", false},
+		{"malformed", "abc", false},
+		{"other key", other.Assert(plugintest.Admin), false},
+		{"other plugin", signer.Assert(identity.Identity{Plugin: "other_plugin", User: "admin"}), false},
+		{"expired", signer.Assert(identity.Identity{User: "admin", Issued: expired.Add(-time.Minute).Unix(), Expires: expired.Unix()}), false},
+		{"within the clock skew", signer.Assert(identity.Identity{User: "admin", Issued: time.Now().Add(-time.Minute).Unix(), Expires: time.Now().Unix() - 1}), true},
+	}
+
+	for _, test := range tests {
+		id, err := identity.Verify(test.assertion, signer.PublicKey, "sample_plugin")
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, err)
+			continue
+		}
+		if test.valid && id.User != "admin" {
+			t.Errorf("%s: unexpected identity %+v", test.name, id)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Package plugin serves an SPR api plugin on its unix socket.
+//
+// The api proxies /plugins/{URI}/ to the UnixPath of the plugin. Routes
+// added to Authenticated need a caller asserted by the api, routes added to
+// Router are served to anyone who reaches the socket. /health is answered
+// for the health checks of the api.
+package plugin
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/spr-networks/plugin_sdk/identity"
+)
+
+type Config struct {
+	//has to match the Name of the plugin in the api config
+	Name string
+	//socket the api proxies to, the UnixPath of the plugin in the api config
+	UnixPath string
+	//public key of the api, read from PublicKeyPath when not set
+	PublicKey     ed25519.PublicKey
+	PublicKeyPath string
+	//time in flight requests get to finish on shutdown, 10s by default
+	ShutdownTimeout time.Duration
+	//log every request, as the services of the router do
+	LogRequests bool
+}
+
+type Plugin struct {
+	config Config
+	//routes served without an identity
+	Router *mux.Router
+	//routes that need an identity asserted by the api
+	Authenticated *mux.Router
+
+	server *http.Server
+}
+
+func New(config Config) (*Plugin, error) {
+	if config.Name == "" {
+		return nil, errors.New("the plugin needs a name")
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 10 * time.Second
+	}
+	if config.PublicKey == nil {
+		path := config.PublicKeyPath
+		if path == "" {
+			path = identity.DefaultPublicKeyPath
+		}
+		key, err := identity.LoadPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the api public key: %v", err)
+		}
+		config.PublicKey = key
+	}
+
+	p := &Plugin{config: config}
+	p.Router = mux.NewRouter().StrictSlash(true)
+	p.Router.HandleFunc("/health", health).Methods("GET")
+
+	p.Authenticated = p.Router.NewRoute().Subrouter()
+	p.Authenticated.Use(identity.Middleware(config.PublicKey, config.Name))
+
+	p.server = &http.Server{
+		Handler:           p.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return p, nil
+}
+
+func (p *Plugin) Name() string {
+	return p.config.Name
+}
+
+func health(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func logRequest(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Handler returns the handler of the plugin, to serve it on another
+// listener or to call it from tests
+func (p *Plugin) Handler() http.Handler {
+	if p.config.LogRequests {
+		return logRequest(p.Router)
+	}
+	return p.Router
+}
+
+// Serve serves the plugin on a listener until Shutdown
+func (p *Plugin) Serve(listener net.Listener) error {
+	err := p.server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests and waits for those in flight
+func (p *Plugin) Shutdown(ctx context.Context) error {
+	return p.server.Shutdown(ctx)
+}
+
+// ListenAndServe serves the plugin on its UnixPath until the process gets
+// SIGINT or SIGTERM, then shuts down gracefully and removes the socket
+func (p *Plugin) ListenAndServe() error {
+	if p.config.UnixPath == "" {
+		return errors.New("the plugin needs a UnixPath")
+	}
+
+	//a socket left behind by an earlier run
+	os.Remove(p.config.UnixPath)
+	listener, err := net.Listen("unix", p.config.UnixPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(p.config.UnixPath)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- p.Serve(listener)
+	}()
+
+	select {
+	case err = <-served:
+		return err
+	case <-signals:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.ShutdownTimeout)
+	defer cancel()
+	err = p.Shutdown(ctx)
+	<-served
+	return err
+}
@@ -0,0 +1,53 @@
+package plugin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+import (
+	"github.com/spr-networks/plugin_sdk/identity"
+	"github.com/spr-networks/plugin_sdk/plugin"
+	"github.com/spr-networks/plugin_sdk/plugintest"
+)
+
+func TestPluginRoutes(t *testing.T) {
+	p, signer := plugintest.NewPlugin(t, plugin.Config{Name: "sample_plugin"})
+	p.Router.HandleFunc("/public", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("public"))
+	})
+	p.Authenticated.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := identity.FromRequest(r)
+		w.Write([]byte(caller.User))
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		signed bool
+		status int
+		body   string
+	}{
+		{"health", "/health", false, 200, "ok"},
+		{"public", "/public", false, 200, "public"},
+		{"authenticated", "/whoami", true, 200, "admin"},
+		{"no identity", "/whoami", false, 401, ""},
+		{"unknown route", "/missing", true, 404, ""},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		if test.signed {
+			w = plugintest.Do(p, signer, "GET", test.target, nil, plugintest.Admin)
+		} else {
+			p.Handler().ServeHTTP(w, httptest.NewRequest("GET", test.target, nil))
+		}
+		if w.Code != test.status {
+			t.Errorf("%s: returned %d, expected %d", test.name, w.Code, test.status)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s: returned %q, expected %q", test.name, w.Body.String(), test.body)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package plugintest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/spr-networks/plugin_sdk/client"
+)
+
+// FakeAPI serves the callback api of a plugin from memory on a unix
+// socket. Calls are checked against Capabilities like the api does. The
+// fields may be changed between calls while holding Lock
+type FakeAPI struct {
+	sync.Mutex
+
+	Capabilities []string
+	Devices      map[string]client.Device
+	//inventory entries by MAC, in the lower case colon form
+	Inventory map[string]client.DeviceRecord
+	Zones     []client.Zone
+	//by accounting set
+	Traffic   map[string][]client.TrafficElement
+	IPTraffic []client.IPTrafficElement
+	//"METHOD path" of every call
+	Calls []string
+
+	SocketPath string
+
+	server      *http.Server
+	seq         uint64
+	events      []client.Event
+	subscribers map[*fakeSubscriber]bool
+}
+
+type fakeSubscriber struct {
+	conn         *websocket.Conn
+	subscription client.Subscription
+}
+
+// resource of every route, for the capability check
+var fakeRouteScopes = map[string]string{
+	"/devices":        "devices",
+	"/devices/{mac}":  "devices",
+	"/zones":          "zones",
+	"/zones/{name}":   "zones",
+	"/zone/{name}":    "zones",
+	"/traffic/{name}": "traffic",
+	"/iptraffic":      "traffic",
+	"/events":         "events",
+}
+
+// resource of the event types, like on the websocket of the api. Other types
+// are only sent with "*"
+var fakeEventScopes = map[string]string{
+	"StatusCalled":        "status",
+	"InfluxWriteFailed":   "status",
+	"DHCPUpdateRequest":   "devices",
+	"DHCPUpdateProcessed": "devices",
+	"DHCPUpdateFailed":    "devices",
+	"DeviceDiscovered":    "devices",
+	"PSKAuthFailure":      "psk",
+	"PSKAuthSuccess":      "psk",
+	"QuotaExceeded":       "quotas",
+	"QuotaRestored":       "quotas",
+	"ReconcileFixed":      "network",
+	"VerdictMapsRestored": "network",
+	"ScheduleTransition":  "zones",
+}
+
+// NewFakeAPI serves a fake api for a plugin with the given capabilities
+// until the test ends
+func NewFakeAPI(t testing.TB, capabilities ...string) *FakeAPI {
+	//unix socket paths are short, t.TempDir can be too long
+	dir, err := os.MkdirTemp("", "plugintest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &FakeAPI{
+		Capabilities: capabilities,
+		Devices:      map[string]client.Device{},
+		Inventory:    map[string]client.DeviceRecord{},
+		Zones:        []client.Zone{},
+		Traffic:      map[string][]client.TrafficElement{},
+		IPTraffic:    []client.IPTrafficElement{},
+		SocketPath:   dir + "/apisock",
+		subscribers:  map[*fakeSubscriber]bool{},
+	}
+
+	listener, err := net.Listen("unix", f.SocketPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter().StrictSlash(true)
+	router.Use(f.authorize)
+	router.HandleFunc("/devices", f.getDevices).Methods("GET")
+	router.HandleFunc("/devices/{mac}", f.getDevice).Methods("GET")
+	router.HandleFunc("/zones", f.getZones).Methods("GET")
+	router.HandleFunc("/zones/{name}", f.getZone).Methods("GET")
+	router.HandleFunc("/zone/{name}", f.modifyZoneMember).Methods("PUT", "DELETE")
+	router.HandleFunc("/traffic/{name}", f.getTraffic).Methods("GET")
+	router.HandleFunc("/iptraffic", f.getIPTraffic).Methods("GET")
+	router.HandleFunc("/events", f.subscribe).Methods("GET")
+
+	f.server = &http.Server{Handler: router}
+	go f.server.Serve(listener)
+
+	t.Cleanup(func() {
+		f.server.Close()
+		f.Lock()
+		for subscriber := range f.subscribers {
+			subscriber.conn.Close()
+		}
+		f.Unlock()
+		os.RemoveAll(dir)
+	})
+	return f
+}
+
+// Client returns a client of the fake api
+func (f *FakeAPI) Client() *client.Client {
+	return client.New(f.SocketPath)
+}
+
+func (f *FakeAPI) allowed(template string, method string) bool {
+	access := "write"
+	if method == http.MethodGet {
+		access = "read"
+	}
+	return f.permits(fakeRouteScopes[template], access)
+}
+
+func (f *FakeAPI) permits(resource string, access string) bool {
+	for _, scope := range f.Capabilities {
+		if scope == "*" || (resource != "" && (scope == resource+":"+access || scope == resource+":write")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FakeAPI) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template, _ := mux.CurrentRoute(r).GetPathTemplate()
+
+		f.Lock()
+		f.Calls = append(f.Calls, r.Method+" "+r.URL.Path)
+		allowed := f.allowed(template, r.Method)
+		f.Unlock()
+
+		if !allowed {
+			http.Error(w, "Forbidden, the plugin lacks the capability", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *FakeAPI) reply(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func (f *FakeAPI) getDevices(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.reply(w, f.Devices)
+}
+
+func (f *FakeAPI) getDevice(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	record, exists := f.Inventory[strings.ToLower(mux.Vars(r)["mac"])]
+	if !exists {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	f.reply(w, record)
+}
+
+func (f *FakeAPI) getZones(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.reply(w, f.Zones)
+}
+
+func (f *FakeAPI) getZone(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	for _, zone := range f.Zones {
+		if zone.Name == mux.Vars(r)["name"] {
+			f.reply(w, zone)
+			return
+		}
+	}
+	http.Error(w, "Not found", 404)
+}
+
+// modifyZoneMember adds (PUT) or removes (DELETE) a member, the zone is
+// created as needed
+func (f *FakeAPI) modifyZoneMember(w http.ResponseWriter, r *http.Request) {
+	member := client.ZoneMember{}
+	err := json.NewDecoder(r.Body).Decode(&member)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	name := strings.ToLower(mux.Vars(r)["name"])
+	idx := -1
+	for i, zone := range f.Zones {
+		if zone.Name == name {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		if r.Method == http.MethodDelete {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		f.Zones = append(f.Zones, client.Zone{Name: name, Clients: []client.ZoneMember{}})
+		idx = len(f.Zones) - 1
+	}
+
+	members := []client.ZoneMember{}
+	found := false
+	for _, entry := range f.Zones[idx].Clients {
+		if strings.EqualFold(entry.Mac, member.Mac) {
+			found = true
+			continue
+		}
+		members = append(members, entry)
+	}
+	if r.Method == http.MethodDelete && !found {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	if r.Method == http.MethodPut {
+		members = append(members, member)
+	}
+	f.Zones[idx].Clients = members
+	f.reply(w, true)
+}
+
+func (f *FakeAPI) getTraffic(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	traffic, exists := f.Traffic[mux.Vars(r)["name"]]
+	if !exists {
+		http.Error(w, "Failed to collect traffic statistics", 400)
+		return
+	}
+	f.reply(w, traffic)
+}
+
+func (f *FakeAPI) getIPTraffic(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.reply(w, f.IPTraffic)
+}
+
+func (s *fakeSubscriber) wants(event client.Event) bool {
+	if len(s.subscription.Types) > 0 && !contains(s.subscription.Types, event.Type) {
+		return false
+	}
+	if len(s.subscription.MACs) > 0 && !contains(s.subscription.MACs, event.MAC) {
+		return false
+	}
+	return true
+}
+
+// sends reports whether an event goes to a subscriber, the caller holds f
+func (f *FakeAPI) sends(subscriber *fakeSubscriber, event client.Event) bool {
+	return f.permits(fakeEventScopes[event.Type], "read") && subscriber.wants(event)
+}
+
+func contains(list []string, value string) bool {
+	for _, entry := range list {
+		if strings.EqualFold(entry, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FakeAPI) subscribe(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	subscriber := &fakeSubscriber{conn: conn}
+	if conn.WriteMessage(websocket.TextMessage, []byte("success")) != nil {
+		return
+	}
+	if conn.ReadJSON(&subscriber.subscription) != nil {
+		return
+	}
+
+	//replay and register at once, so that no event is missed or repeated
+	f.Lock()
+	if subscriber.subscription.Since != nil {
+		for _, event := range f.events {
+			if event.Seq > *subscriber.subscription.Since && f.sends(subscriber, event) {
+				conn.WriteJSON(event)
+			}
+		}
+	}
+	f.subscribers[subscriber] = true
+	f.Unlock()
+
+	//wait for the client to disconnect
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	f.Lock()
+	delete(f.subscribers, subscriber)
+	f.Unlock()
+}
+
+// Publish sends an event to the subscribers and keeps it for replays
+func (f *FakeAPI) Publish(eventType string, mac string, data interface{}) client.Event {
+	value, _ := json.Marshal(data)
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.seq++
+	event := client.Event{Seq: f.seq, Time: time.Now(), Type: eventType, MAC: mac, Data: value}
+	f.events = append(f.events, event)
+	for subscriber := range f.subscribers {
+		if f.sends(subscriber, event) {
+			subscriber.conn.WriteJSON(event)
+		}
+	}
+	return event
+}
+
+// Subscribers returns the number of event subscriptions, for tests to wait
+// until a plugin subscribed
+func (f *FakeAPI) Subscribers() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.subscribers)
+}
@@ -0,0 +1,79 @@
+// Package plugintest helps to test plugins without a router. A Signer
+// stands in for the api when calling the routes of a plugin, a FakeAPI for
+// the callback socket of the plugin.
+package plugintest
+
+import (
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/spr-networks/plugin_sdk/identity"
+	"github.com/spr-networks/plugin_sdk/plugin"
+)
+
+// Admin is the identity of an administrator, who holds every capability
+var Admin = identity.Identity{User: "admin", Role: "admin", Scopes: []string{"*"}}
+
+// Signer asserts identities for a plugin, like the api does
+type Signer struct {
+	Plugin    string
+	PublicKey ed25519.PublicKey
+
+	key ed25519.PrivateKey
+}
+
+func NewSigner(t testing.TB, pluginName string) *Signer {
+	public, private, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Signer{Plugin: pluginName, PublicKey: public, key: private}
+}
+
+// Assert returns the assertion of an identity. The plugin and lifetime are
+// filled in when they are not set
+func (s *Signer) Assert(id identity.Identity) string {
+	if id.Plugin == "" {
+		id.Plugin = s.Plugin
+	}
+	if id.Issued == 0 {
+		id.Issued = time.Now().Unix()
+	}
+	if id.Expires == 0 {
+		id.Expires = time.Unix(id.Issued, 0).Add(time.Minute).Unix()
+	}
+	assertion, _ := identity.Sign(s.key, id)
+	return assertion
+}
+
+// Request returns a request to the plugin made by id
+func (s *Signer) Request(method string, target string, body io.Reader, id identity.Identity) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set(identity.Header, s.Assert(id))
+	return req
+}
+
+// NewPlugin returns a plugin that trusts the returned signer
+func NewPlugin(t testing.TB, config plugin.Config) (*plugin.Plugin, *Signer) {
+	signer := NewSigner(t, config.Name)
+	config.PublicKey = signer.PublicKey
+	p, err := plugin.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, signer
+}
+
+// Do serves a request made by id with the handler of a plugin
+func Do(p *plugin.Plugin, signer *Signer, method string, target string, body io.Reader, id identity.Identity) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	p.Handler().ServeHTTP(recorder, signer.Request(method, target, body, id))
+	return recorder
+}